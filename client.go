@@ -0,0 +1,1211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClientConnClosed = errors.New("client connection closed")
+	ErrH2NotNegotiated  = errors.New("server did not negotiate h2")
+	ErrBodyClosed       = errors.New("read on closed response body")
+)
+
+const (
+	// clientStreamWindow and clientConnWindow are the receive windows we
+	// grant the server, larger than the defaults so that the round trip
+	// time does not bound the download rate.
+	clientStreamWindow = 1 << 20
+	clientConnWindow   = 1 << 24
+	// defaultMaxConcurrentStreams is assumed until the server sends its
+	// SETTINGS, as the initial value is unlimited.
+	defaultMaxConcurrentStreams = 100
+)
+
+// GoAwayError is the error of a request the server did not process before
+// sending GOAWAY. It can safely be sent again on another connection.
+type GoAwayError struct {
+	LastStreamID uint32
+	Code         ErrCode
+	DebugData    string
+}
+
+func (e GoAwayError) Error() string {
+	return fmt.Sprintf("server sent GOAWAY (last stream %d, %s): %q", e.LastStreamID, e.Code, e.DebugData)
+}
+
+type ClientConnConfig struct {
+	// FrameTracer, if set, logs the frames of the connection.
+	FrameTracer *FrameTracer
+	// EventSink, if set, receives the events of the connection.
+	EventSink EventSink
+	// IdleTimeout, if non-zero, closes the connection once it has had no
+	// stream for that long.
+	IdleTimeout time.Duration
+	// ReadIdleTimeout, if non-zero, sends a PING once no frame was
+	// received for that long, and closes the connection if its ACK does
+	// not arrive within PingTimeout.
+	ReadIdleTimeout time.Duration
+	// PingTimeout bounds the wait for the ACK of a keepalive PING, 15s if
+	// zero.
+	PingTimeout time.Duration
+	// MaxConnectionAge, if non-zero, stops the connection from taking new
+	// requests once that old, closing it after its last stream.
+	MaxConnectionAge time.Duration
+}
+
+// ClientRequest is a request sent on a ClientConn.
+type ClientRequest struct {
+	Header *RequestHeader
+	// Body is sent as DATA frames, nil for a request without content. It
+	// is closed, if it is an io.Closer, once sent or when the request
+	// fails.
+	Body io.Reader
+	// Trailer is sent after Body in a HEADERS frame. It is read once
+	// Body returned io.EOF, so it can be filled in while the body is sent.
+	Trailer []HeaderField
+}
+
+// ClientResponse is the response to a ClientRequest. Body must be closed,
+// which resets the stream if it was not read to the end.
+type ClientResponse struct {
+	StreamID uint32
+	Header   *ResponseHeader
+	Body     io.ReadCloser
+
+	stream *clientStream
+}
+
+// Trailer returns the trailer fields of the response, available once Body
+// returned io.EOF.
+func (r *ClientResponse) Trailer() []HeaderField {
+	r.stream.cc.mu.Lock()
+	defer r.stream.cc.mu.Unlock()
+	return r.stream.trailer
+}
+
+// ClientConn is the client side of an HTTP/2 connection. Requests can be
+// sent from several goroutines, each on its own stream.
+type ClientConn struct {
+	conn     *Conn
+	tlsState *tls.ConnectionState
+
+	// headersMu is held from the allocation of a stream identifier to the
+	// write of its HEADERS, so that streams are opened in order.
+	headersMu sync.Mutex
+
+	mu sync.Mutex
+	// cond is broadcast on every change of the state below.
+	cond         *sync.Cond
+	streams      map[uint32]*clientStream
+	nextStreamID uint32
+	used         bool
+	// gotSettings is set once the SETTINGS of the server preface arrived.
+	gotSettings bool
+	// reserved counts the streams promised to requests of a pool, which
+	// count against MAX_CONCURRENT_STREAMS until opened.
+	reserved             int
+	maxConcurrentStreams uint32
+	peerInitialWindow    int64
+	maxFrameSize         uint32
+	sendWindow           int64
+	recvWindow           int64
+	// unacked counts the octets received and consumed, but not yet
+	// returned to the server with a WINDOW_UPDATE.
+	unacked int64
+	goAway  *GoAwayFrame
+	// draining is set once the connection takes no new request. It is
+	// closed with its last stream.
+	draining bool
+	// origins is the ORIGIN set of the server, nil until it sends one;
+	// misdirected are the origins it answered 421 Misdirected Request.
+	origins     map[string]bool
+	misdirected map[string]bool
+	// err is set once the connection is closed.
+	err error
+
+	// idleTimer closes the connection after IdleTimeout without streams.
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	// pings are the PINGs awaiting their ACK, by opaque data.
+	pings map[[8]byte]chan struct{}
+
+	// readIdleTimer checks the health of the connection after
+	// ReadIdleTimeout without frames, and ageTimer drains it after
+	// MaxConnectionAge. They are set before the read loop starts.
+	readIdleTimeout time.Duration
+	pingTimeout     time.Duration
+	maxAge          time.Duration
+	readIdleTimer   *time.Timer
+	ageTimer        *time.Timer
+
+	readerDone chan struct{}
+}
+
+// DialClientConn connects to addr over TLS, negotiating h2 with ALPN. The
+// TLS hooks of the ClientTrace of ctx are called during the handshake.
+func DialClientConn(ctx context.Context, network, addr string, tlsConfig *tls.Config, config *ClientConnConfig) (*ClientConn, error) {
+	tlsConn, err := dialTLS(ctx, network, addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if protocol := tlsConn.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+		tlsConn.Close()
+		return nil, fmt.Errorf("%w: got %q", ErrH2NotNegotiated, protocol)
+	}
+
+	cc, err := NewClientConn(tlsConn, config)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// dialTLS connects to addr over TLS, offering h2 unless tlsConfig lists
+// its own NextProtos, and returns whatever protocol was negotiated. The
+// TLS policy of HTTP/2 applies to tlsConfig, and a server negotiating h2
+// without meeting it is sent GOAWAY with INADEQUATE_SECURITY.
+func dialTLS(ctx context.Context, network, addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
+	trace := ContextClientTrace(ctx)
+	tlsConfig = applyTLSPolicy(tlsConfig)
+	if tlsConfig.NextProtos == nil {
+		tlsConfig.NextProtos = []string{"h2"}
+	}
+	if tlsConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	dialer := net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(netConn, tlsConfig)
+	err = tlsConn.HandshakeContext(ctx)
+	state := tlsConn.ConnectionState()
+	trace.tlsHandshakeDone(state, err)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	trace.alpnNegotiated(state.NegotiatedProtocol)
+	if err := checkTLSPolicy(state); err != nil {
+		if state.NegotiatedProtocol == "h2" {
+			conn := NewConn(tlsConn)
+			if conn.WritePreface() == nil {
+				conn.WriteFrame(Frame{
+					Type: GoAwayFrameType,
+					Data: GoAwayFrame{ErrorCode: InadequateSecurity, DebugData: []byte(err.Error())},
+				})
+			}
+		}
+		tlsConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// NewClientConn starts an HTTP/2 connection on conn, which must already
+// have negotiated h2 if it uses TLS. config may be nil.
+func NewClientConn(conn net.Conn, config *ClientConnConfig) (*ClientConn, error) {
+	cc := newClientConn(conn, config)
+	if err := cc.start(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// clientSettings are the settings a client connection sends.
+func clientSettings() map[SettingParam]uint32 {
+	return map[SettingParam]uint32{
+		SettingsEnablePush:        0,
+		SettingsInitialWindowSize: clientStreamWindow,
+		SettingsMaxHeaderListSize: defaultMaxHeaderListSize,
+	}
+}
+
+func newClientConn(conn net.Conn, config *ClientConnConfig) *ClientConn {
+	if config == nil {
+		config = &ClientConnConfig{}
+	}
+	cc := &ClientConn{
+		conn:                 NewConn(conn),
+		streams:              map[uint32]*clientStream{},
+		nextStreamID:         1,
+		maxConcurrentStreams: defaultMaxConcurrentStreams,
+		peerInitialWindow:    defaultInitialWindowSize,
+		maxFrameSize:         defaultMaxFrameSize,
+		sendWindow:           defaultInitialWindowSize,
+		recvWindow:           clientConnWindow,
+		idleTimeout:          config.IdleTimeout,
+		readIdleTimeout:      config.ReadIdleTimeout,
+		pingTimeout:          config.PingTimeout,
+		maxAge:               config.MaxConnectionAge,
+		readerDone:           make(chan struct{}),
+	}
+	cc.cond = sync.NewCond(&cc.mu)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		cc.tlsState = &state
+	}
+	cc.conn.SetFrameTracer(config.FrameTracer)
+	cc.conn.SetEventSink(config.EventSink)
+	return cc
+}
+
+// start sends the connection preface and starts reading frames.
+func (cc *ClientConn) start() error {
+	if err := cc.conn.WritePreface(); err != nil {
+		return err
+	}
+	settings := Frame{
+		Type: SettingFrameType,
+		Data: SettingFrame{Params: clientSettings()},
+	}
+	windowUpdate := Frame{
+		Type: WindowUpdateFrameType,
+		Data: WindowUpdateFrame{WindowSizeIncrement: clientConnWindow - defaultInitialWindowSize},
+	}
+	for _, frame := range []Frame{settings, windowUpdate} {
+		if err := cc.conn.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+
+	cc.startKeepalive()
+	go cc.readLoop()
+	cc.mu.Lock()
+	cc.startIdleTimer()
+	cc.mu.Unlock()
+	return nil
+}
+
+// ConnectionState returns the state of the TLS connection, false if the
+// connection does not use TLS.
+func (cc *ClientConn) ConnectionState() (tls.ConnectionState, bool) {
+	if cc.tlsState == nil {
+		return tls.ConnectionState{}, false
+	}
+	return *cc.tlsState, true
+}
+
+// canTakeNewRequest reports whether a new stream could be opened, perhaps
+// after waiting for MAX_CONCURRENT_STREAMS.
+func (cc *ClientConn) canTakeNewRequest() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err == nil && cc.goAway == nil && !cc.draining && cc.nextStreamID <= maxStreamID
+}
+
+// waitSettings waits for the SETTINGS of the server preface, which tell
+// how many streams the connection can take.
+func (cc *ClientConn) waitSettings(ctx context.Context) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if err := cc.wait(ctx, func() bool { return cc.gotSettings || cc.err != nil }); err != nil {
+		return err
+	}
+	return cc.err
+}
+
+// reserveStream reserves a stream for a request, if the connection can
+// take one now without exceeding MAX_CONCURRENT_STREAMS. The request must
+// then be sent with roundTrip.
+func (cc *ClientConn) reserveStream() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.err != nil || cc.goAway != nil || cc.draining ||
+		int64(cc.nextStreamID)+2*int64(cc.reserved) > maxStreamID ||
+		uint32(len(cc.streams)+cc.reserved) >= cc.maxConcurrentStreams {
+		return false
+	}
+	cc.reserved++
+	cc.stopIdleTimer()
+	return true
+}
+
+// idle reports whether no stream is open or reserved.
+func (cc *ClientConn) idle() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.isIdle()
+}
+
+// isIdle is idle with cc.mu held.
+func (cc *ClientConn) isIdle() bool {
+	return len(cc.streams) == 0 && cc.reserved == 0
+}
+
+// startIdleTimer starts the idle timer if the connection is idle, with
+// cc.mu held.
+func (cc *ClientConn) startIdleTimer() {
+	if !cc.isIdle() || cc.err != nil {
+		return
+	}
+	if cc.draining {
+		go cc.closeIfIdle()
+		return
+	}
+	if cc.idleTimeout <= 0 {
+		return
+	}
+	if cc.idleTimer == nil {
+		cc.idleTimer = time.AfterFunc(cc.idleTimeout, cc.closeIfIdle)
+	} else {
+		cc.idleTimer.Reset(cc.idleTimeout)
+	}
+}
+
+// stopIdleTimer stops the idle timer, with cc.mu held.
+func (cc *ClientConn) stopIdleTimer() {
+	if cc.idleTimer != nil {
+		cc.idleTimer.Stop()
+	}
+}
+
+// drain stops the connection from taking new requests, and closes it once
+// its streams, open or reserved, are done.
+func (cc *ClientConn) drain() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.draining = true
+	cc.startIdleTimer()
+	cc.cond.Broadcast()
+}
+
+// canCoalesce reports whether a request to origin, on host, may be sent on
+// the connection although it was dialed for another authority (RFC 9113
+// section 9.1.1). The certificate of the server must cover host, and
+// origin be in the ORIGIN set of the server if it sent one (RFC 8336), or
+// addrs, where host resolves to, include the address of the connection.
+func (cc *ClientConn) canCoalesce(origin, host string, addrs []string) bool {
+	if cc.tlsState == nil || len(cc.tlsState.PeerCertificates) == 0 ||
+		cc.tlsState.PeerCertificates[0].VerifyHostname(host) != nil {
+		return false
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.misdirected[origin] {
+		return false
+	}
+	if cc.origins != nil {
+		return cc.origins[origin]
+	}
+	remote := cc.conn.conn.RemoteAddr().String()
+	for _, addr := range addrs {
+		if addr == remote {
+			return true
+		}
+	}
+	return false
+}
+
+// setMisdirected records that the server answered a request to origin
+// with 421 Misdirected Request.
+func (cc *ClientConn) setMisdirected(origin string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.misdirected == nil {
+		cc.misdirected = map[string]bool{}
+	}
+	cc.misdirected[origin] = true
+}
+
+// closeIfIdle closes the connection once the idle timeout expired, unless
+// a stream was opened meanwhile.
+func (cc *ClientConn) closeIfIdle() {
+	cc.mu.Lock()
+	if !cc.isIdle() || cc.err != nil {
+		cc.mu.Unlock()
+		return
+	}
+	// No request can take the connection from now on.
+	if cc.draining {
+		cc.err = fmt.Errorf("%w: drained", ErrClientConnClosed)
+	} else {
+		cc.err = fmt.Errorf("%w: idle timeout", ErrClientConnClosed)
+	}
+	cc.mu.Unlock()
+	cc.Close()
+}
+
+// Close sends GOAWAY and closes the connection, failing the requests in
+// flight.
+func (cc *ClientConn) Close() error {
+	cc.conn.WriteFrame(Frame{Type: GoAwayFrameType, Data: GoAwayFrame{ErrorCode: NoError}})
+	cc.closeWithError(ErrClientConnClosed)
+	<-cc.readerDone
+	return nil
+}
+
+// closeWithError closes the connection because of err, sending GOAWAY
+// first if the server violated the protocol.
+func (cc *ClientConn) closeWithError(err error) {
+	if !errors.Is(err, ErrClientConnClosed) {
+		if !isConnBroken(err) {
+			connErr := connectionError(err)
+			cc.conn.WriteFrame(Frame{
+				Type: GoAwayFrameType,
+				Data: GoAwayFrame{ErrorCode: connErr.Code, DebugData: []byte(connErr.Reason)},
+			})
+		}
+		err = fmt.Errorf("%w: %w", ErrClientConnClosed, err)
+	}
+
+	cc.mu.Lock()
+	if cc.err == nil {
+		cc.err = err
+	}
+	for _, cs := range cc.streams {
+		cs.fail(cc.err)
+	}
+	cc.stopIdleTimer()
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+	cc.stopKeepalive()
+	cc.conn.Close()
+}
+
+// wait waits on cc.cond, with cc.mu held, until cond holds or ctx is done.
+func (cc *ClientConn) wait(ctx context.Context, cond func() bool) error {
+	if cond() {
+		return nil
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cc.mu.Lock()
+			cc.cond.Broadcast()
+			cc.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	for !cond() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cc.cond.Wait()
+	}
+	return nil
+}
+
+// RoundTrip sends req on a new stream and waits for the response header.
+// Canceling ctx resets the stream, until the response is complete.
+func (cc *ClientConn) RoundTrip(ctx context.Context, req *ClientRequest) (*ClientResponse, error) {
+	return cc.roundTrip(ctx, req, false)
+}
+
+// roundTrip is RoundTrip, on a stream reserved with reserveStream if
+// reserved is set.
+func (cc *ClientConn) roundTrip(ctx context.Context, req *ClientRequest, reserved bool) (*ClientResponse, error) {
+	cs, err := cc.openStream(ctx, req, ContextClientTrace(ctx), reserved)
+	if err != nil {
+		if closer, ok := req.Body.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	if req.Body != nil {
+		go cs.writeBody()
+	}
+	return cs.awaitResponse(ctx)
+}
+
+// awaitResponse waits for the response of the stream, resetting it with
+// CANCEL if ctx is done first.
+func (cs *clientStream) awaitResponse(ctx context.Context) (*ClientResponse, error) {
+	cc := cs.cc
+	go func() {
+		select {
+		case <-ctx.Done():
+			cs.abort(Cancel, ctx.Err())
+		case <-cs.done:
+		}
+	}()
+
+	<-cs.respReady
+	cc.mu.Lock()
+	resp, err := cs.resp, cs.err
+	cc.mu.Unlock()
+	if resp == nil {
+		return nil, err
+	}
+	return &ClientResponse{
+		StreamID: cs.id,
+		Header:   resp,
+		Body:     &clientBody{cs: cs},
+		stream:   cs,
+	}, nil
+}
+
+// openStream allocates a stream, once MAX_CONCURRENT_STREAMS allows it
+// unless one was reserved, and sends the HEADERS of req.
+func (cc *ClientConn) openStream(ctx context.Context, req *ClientRequest, trace *ClientTrace, reserved bool) (*clientStream, error) {
+	cc.headersMu.Lock()
+	defer cc.headersMu.Unlock()
+
+	cc.mu.Lock()
+	if reserved {
+		// The reservation is used or given up.
+		cc.reserved--
+	}
+	err := cc.wait(ctx, func() bool {
+		return cc.err != nil || cc.goAway != nil || reserved ||
+			uint32(len(cc.streams)+cc.reserved) < cc.maxConcurrentStreams
+	})
+	switch {
+	case err != nil:
+	case cc.err != nil:
+		err = cc.err
+	case cc.goAway != nil:
+		err = GoAwayError{LastStreamID: cc.goAway.LastStreamID, Code: cc.goAway.ErrorCode, DebugData: string(cc.goAway.DebugData)}
+	case cc.draining && !reserved:
+		err = fmt.Errorf("%w: draining", ErrClientConnClosed)
+	case cc.nextStreamID > maxStreamID:
+		err = fmt.Errorf("%w: stream identifiers exhausted", ErrClientConnClosed)
+	}
+	if err != nil {
+		cc.startIdleTimer()
+		cc.cond.Broadcast()
+		cc.mu.Unlock()
+		return nil, err
+	}
+	cc.stopIdleTimer()
+	cs := &clientStream{
+		cc:         cc,
+		id:         cc.nextStreamID,
+		trace:      trace,
+		req:        req,
+		sendWindow: cc.peerInitialWindow,
+		recvWindow: clientStreamWindow,
+		sentEnd:    req.Body == nil,
+		respReady:  make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	cc.nextStreamID += 2
+	cc.streams[cs.id] = cs
+	reused := cc.used
+	cc.used = true
+	cc.mu.Unlock()
+
+	trace.gotConn(GotConnInfo{Conn: cc, Reused: reused})
+	flags := EndHeaderFlag
+	if req.Body == nil {
+		flags |= EndStreamFlag
+	}
+	err = cc.conn.WriteFrame(Frame{
+		Type:     HeaderFrameType,
+		Flags:    flags,
+		StreamID: cs.id,
+		Data:     HeaderFrame{HeaderFields: req.Header.HeaderFields()},
+	})
+	if err != nil {
+		// The HPACK state of the server can no longer be trusted.
+		cc.closeWithError(err)
+		return nil, err
+	}
+	trace.wroteHeaders(WroteHeadersInfo{StreamID: cs.id})
+	return cs, nil
+}
+
+func (cc *ClientConn) readLoop() {
+	defer close(cc.readerDone)
+	for {
+		frame, err := cc.conn.ReadFrame()
+		if cc.readIdleTimer != nil && err == nil {
+			cc.readIdleTimer.Reset(cc.readIdleTimeout)
+		}
+		if errors.Is(err, ErrHeaderListTooLarge) && frame.Type == HeaderFrameType {
+			cc.mu.Lock()
+			cs := cc.streams[frame.StreamID]
+			cc.mu.Unlock()
+			if cs != nil {
+				cs.abort(Cancel, err)
+			}
+			continue
+		}
+		if err == nil {
+			err = cc.handleFrame(frame)
+		}
+		if err != nil {
+			cc.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (cc *ClientConn) handleFrame(frame Frame) error {
+	switch payload := frame.Data.(type) {
+	case SettingFrame:
+		if frame.Flags&AckFlag != UnsetFlag {
+			return nil
+		}
+		return cc.handleSettings(payload.Params)
+	case HeaderFrame:
+		return cc.handleHeaders(frame, payload)
+	case DataFrame:
+		return cc.handleData(frame, payload)
+	case RSTStreamFrame:
+		return cc.handleReset(frame, payload)
+	case PingFrame:
+		if frame.Flags&AckFlag != UnsetFlag {
+			cc.handlePingAck(payload)
+			return nil
+		}
+		return cc.conn.WriteFrame(Frame{Type: PingFrameType, Flags: AckFlag, Data: payload})
+	case GoAwayFrame:
+		cc.handleGoAway(payload)
+	case WindowUpdateFrame:
+		return cc.handleWindowUpdate(frame, payload)
+	case PushPromiseFrame:
+		return ConnectionError{Code: ProtocolError, Reason: "PUSH_PROMISE with push disabled"}
+	case OriginFrame:
+		cc.handleOrigin(frame, payload)
+	}
+	return nil
+}
+
+// stream returns the open stream id, nil if it is closed. Frames on
+// streams we never opened are connection errors.
+func (cc *ClientConn) stream(id uint32, frameType FrameType) (*clientStream, error) {
+	if cs := cc.streams[id]; cs != nil {
+		return cs, nil
+	}
+	if id == 0 || id%2 == 0 || id >= cc.nextStreamID {
+		return nil, ConnectionError{Code: ProtocolError, Reason: fmt.Sprintf("%s frame on idle stream %d", frameType, id)}
+	}
+	return nil, nil
+}
+
+func (cc *ClientConn) handleSettings(params map[SettingParam]uint32) error {
+	cc.mu.Lock()
+	for param, value := range params {
+		switch param {
+		case SettingsEnablePush:
+			if value != 0 {
+				cc.mu.Unlock()
+				return ConnectionError{Code: ProtocolError, Reason: fmt.Sprintf("%s of %d from a server", param, value)}
+			}
+		case SettingsMaxConcurrentStreams:
+			cc.maxConcurrentStreams = value
+		case SettingsInitialWindowSize:
+			if value > maxWindowSize {
+				cc.mu.Unlock()
+				return ConnectionError{Code: FlowControlError, Reason: fmt.Sprintf("%s of %d", param, value)}
+			}
+			delta := int64(value) - cc.peerInitialWindow
+			for _, cs := range cc.streams {
+				cs.sendWindow += delta
+				if cs.sendWindow > maxWindowSize {
+					cc.mu.Unlock()
+					return ConnectionError{Code: FlowControlError, Reason: fmt.Sprintf("window of stream %d overflows", cs.id)}
+				}
+			}
+			cc.peerInitialWindow = int64(value)
+		case SettingsMaxFrameSize:
+			if value < defaultMaxFrameSize || value > maxFrameSize {
+				cc.mu.Unlock()
+				return ConnectionError{Code: ProtocolError, Reason: fmt.Sprintf("%s of %d", param, value)}
+			}
+			cc.maxFrameSize = value
+		}
+	}
+	cc.gotSettings = true
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	cc.conn.ApplySettings(params)
+	return cc.conn.WriteFrame(Frame{Type: SettingFrameType, Flags: AckFlag, Data: SettingFrame{}})
+}
+
+func (cc *ClientConn) handleHeaders(frame Frame, payload HeaderFrame) error {
+	cc.mu.Lock()
+	cs, err := cc.stream(frame.StreamID, frame.Type)
+	if cs == nil {
+		cc.mu.Unlock()
+		return err
+	}
+	first := !cs.gotFirstByte
+	cs.gotFirstByte = true
+	isTrailer, ended := cs.resp != nil, cs.recvEnd
+	cc.mu.Unlock()
+
+	if ended {
+		cs.abort(StreamClosed, fmt.Errorf("%w: HEADERS after END_STREAM on stream %d", ErrProtocol, cs.id))
+		return nil
+	}
+	if first {
+		cs.trace.gotFirstResponseByte()
+	}
+	endStream := frame.Flags&EndStreamFlag != UnsetFlag
+	if isTrailer {
+		if !endStream {
+			cs.abort(ProtocolError, fmt.Errorf("%w: trailers without END_STREAM", ErrMalformedHeader))
+			return nil
+		}
+		for _, hf := range payload.HeaderFields {
+			err := validateField(hf)
+			if hf.IsPseudo() {
+				err = fmt.Errorf("%w: %s in trailers", ErrMalformedHeader, hf.name)
+			}
+			if err != nil {
+				cs.abort(ProtocolError, err)
+				return nil
+			}
+		}
+		cc.mu.Lock()
+		cs.trailer = payload.HeaderFields
+		cs.endRecv()
+		cc.mu.Unlock()
+		return nil
+	}
+
+	resp, err := ParseResponseHeader(payload.HeaderFields)
+	if err == nil && resp.Status < 200 && (endStream || resp.Status == 101) {
+		err = fmt.Errorf("%w: invalid informational response %d", ErrMalformedHeader, resp.Status)
+	}
+	if err != nil {
+		cs.abort(ProtocolError, err)
+		return nil
+	}
+	if resp.Status < 200 {
+		if err := cs.trace.got1xxResponse(resp.Status, resp.Fields); err != nil {
+			cs.abort(Cancel, err)
+		}
+		return nil
+	}
+
+	cc.mu.Lock()
+	cs.resp = resp
+	cs.ready()
+	if endStream {
+		cs.endRecv()
+	}
+	cc.mu.Unlock()
+	return nil
+}
+
+func (cc *ClientConn) handleData(frame Frame, payload DataFrame) error {
+	length := int64(frame.Length)
+	cc.mu.Lock()
+	if length > cc.recvWindow {
+		cc.mu.Unlock()
+		return ConnectionError{Code: FlowControlError, Reason: "connection window exceeded"}
+	}
+	cc.recvWindow -= length
+	cs, err := cc.stream(frame.StreamID, frame.Type)
+	if err != nil {
+		cc.mu.Unlock()
+		return err
+	}
+
+	// Padding, and the data nobody will read, are returned at once.
+	var code ErrCode
+	var streamIncrement uint32
+	returned := length - int64(len(payload.Data))
+	switch {
+	case cs == nil:
+		returned = length
+	case cs.recvEnd:
+		returned = length
+		code, err = StreamClosed, fmt.Errorf("%w: DATA after END_STREAM on stream %d", ErrProtocol, cs.id)
+	case cs.resp == nil:
+		returned = length
+		code, err = ProtocolError, fmt.Errorf("%w: DATA before the response HEADERS on stream %d", ErrProtocol, cs.id)
+	case length > cs.recvWindow:
+		returned = length
+		code, err = FlowControlError, fmt.Errorf("%w: window of stream %d exceeded", ErrProtocol, cs.id)
+	default:
+		cs.recvWindow -= length
+		cs.body.Write(payload.Data)
+		if frame.Flags&EndStreamFlag != UnsetFlag {
+			cs.endRecv()
+		}
+		streamIncrement = cs.consumed(returned)
+		cc.cond.Broadcast()
+	}
+	increment := cc.consumed(returned)
+	cc.mu.Unlock()
+
+	switch {
+	case cs == nil:
+		// The stream was closed, maybe reset by us while the server was
+		// still sending: only the connection window is returned.
+	case err != nil:
+		cs.abort(code, err)
+	default:
+		if err := cc.writeWindowUpdate(cs.id, streamIncrement); err != nil {
+			return err
+		}
+	}
+	return cc.writeWindowUpdate(0, increment)
+}
+
+func (cc *ClientConn) handleReset(frame Frame, payload RSTStreamFrame) error {
+	cc.mu.Lock()
+	cs, err := cc.stream(frame.StreamID, frame.Type)
+	if cs == nil {
+		cc.mu.Unlock()
+		return err
+	}
+	cs.fail(StreamError{StreamID: cs.id, Code: payload.ErrorCode, Remote: true})
+	cc.mu.Unlock()
+
+	cs.trace.streamReset(StreamResetInfo{StreamID: cs.id, ErrorCode: payload.ErrorCode, Remote: true})
+	return nil
+}
+
+// handleGoAway fails the streams the server will not process; the others
+// complete before the connection is closed.
+func (cc *ClientConn) handleGoAway(payload GoAwayFrame) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.goAway = &payload
+	goAwayErr := GoAwayError{LastStreamID: payload.LastStreamID, Code: payload.ErrorCode, DebugData: string(payload.DebugData)}
+	for id, cs := range cc.streams {
+		if id > payload.LastStreamID {
+			cs.fail(goAwayErr)
+		}
+	}
+	if len(cc.streams) == 0 {
+		cc.conn.Close()
+	}
+	cc.cond.Broadcast()
+}
+
+// handleOrigin adds to the ORIGIN set of the server. ORIGIN frames on
+// streams, or over cleartext, are ignored (RFC 8336 section 2.1).
+func (cc *ClientConn) handleOrigin(frame Frame, payload OriginFrame) {
+	if frame.StreamID != 0 || cc.tlsState == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.origins == nil {
+		cc.origins = map[string]bool{}
+	}
+	for _, origin := range payload.Origins {
+		cc.origins[strings.ToLower(origin)] = true
+	}
+}
+
+func (cc *ClientConn) handleWindowUpdate(frame Frame, payload WindowUpdateFrame) error {
+	increment := int64(payload.WindowSizeIncrement)
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if frame.StreamID == 0 {
+		if increment == 0 {
+			return ConnectionError{Code: ProtocolError, Reason: "WINDOW_UPDATE of 0"}
+		}
+		cc.sendWindow += increment
+		if cc.sendWindow > maxWindowSize {
+			return ConnectionError{Code: FlowControlError, Reason: "connection window overflows"}
+		}
+		cc.cond.Broadcast()
+		return nil
+	}
+
+	cs, err := cc.stream(frame.StreamID, frame.Type)
+	if cs == nil {
+		return err
+	}
+	switch cs.sendWindow += increment; {
+	case increment == 0:
+		go cs.abort(ProtocolError, fmt.Errorf("%w: WINDOW_UPDATE of 0 on stream %d", ErrProtocol, cs.id))
+	case cs.sendWindow > maxWindowSize:
+		go cs.abort(FlowControlError, fmt.Errorf("%w: window of stream %d overflows", ErrProtocol, cs.id))
+	}
+	cc.cond.Broadcast()
+	return nil
+}
+
+// consumed returns n octets to the connection window and, once half of it
+// is used, returns the increment to send.
+func (cc *ClientConn) consumed(n int64) uint32 {
+	cc.unacked += n
+	if cc.unacked < clientConnWindow/2 {
+		return 0
+	}
+	increment := cc.unacked
+	cc.recvWindow += increment
+	cc.unacked = 0
+	return uint32(increment)
+}
+
+func (cc *ClientConn) writeWindowUpdate(streamID uint32, increment uint32) error {
+	if increment == 0 {
+		return nil
+	}
+	return cc.conn.WriteFrame(Frame{
+		Type:     WindowUpdateFrameType,
+		StreamID: streamID,
+		Data:     WindowUpdateFrame{WindowSizeIncrement: increment},
+	})
+}
+
+// removeStream forgets a closed stream, with cc.mu held. After GOAWAY the
+// connection is closed with its last stream.
+func (cc *ClientConn) removeStream(cs *clientStream) {
+	if cs.removed {
+		return
+	}
+	cs.removed = true
+	delete(cc.streams, cs.id)
+	close(cs.done)
+	if cc.goAway != nil && len(cc.streams) == 0 {
+		cc.conn.Close()
+	}
+	cc.startIdleTimer()
+	cc.cond.Broadcast()
+}
+
+type clientStream struct {
+	cc    *ClientConn
+	id    uint32
+	trace *ClientTrace
+	req   *ClientRequest
+
+	// The fields below are guarded by cc.mu.
+	sendWindow   int64
+	recvWindow   int64
+	unacked      int64
+	sentEnd      bool
+	recvEnd      bool
+	gotFirstByte bool
+	resp         *ResponseHeader
+	body         bytes.Buffer
+	bodyClosed   bool
+	trailer      []HeaderField
+	// err is set once the stream is reset or the connection closed.
+	err     error
+	removed bool
+
+	// respReady is closed once resp or err is set, done once the stream
+	// is closed.
+	respReady chan struct{}
+	done      chan struct{}
+}
+
+// ready wakes up RoundTrip, with cc.mu held.
+func (cs *clientStream) ready() {
+	select {
+	case <-cs.respReady:
+	default:
+		close(cs.respReady)
+	}
+}
+
+// fail closes the stream with err, with cc.mu held.
+func (cs *clientStream) fail(err error) {
+	if cs.err == nil {
+		cs.err = err
+	}
+	cs.ready()
+	cs.cc.removeStream(cs)
+}
+
+// endRecv records END_STREAM from the server, with cc.mu held.
+func (cs *clientStream) endRecv() {
+	cs.recvEnd = true
+	if cs.sentEnd {
+		cs.cc.removeStream(cs)
+	}
+	cs.cc.cond.Broadcast()
+}
+
+// abort resets the stream with code, unless it is already closed, and
+// fails it with err.
+func (cs *clientStream) abort(code ErrCode, err error) {
+	cc := cs.cc
+	cc.mu.Lock()
+	open := !cs.removed
+	cs.fail(err)
+	cc.mu.Unlock()
+	if !open {
+		return
+	}
+	cc.conn.WriteFrame(Frame{Type: RSTStreamFrameType, StreamID: cs.id, Data: RSTStreamFrame{ErrorCode: code}})
+	cs.trace.streamReset(StreamResetInfo{StreamID: cs.id, ErrorCode: code})
+}
+
+// consumed returns n octets to the stream window and, once half of it is
+// used, returns the increment to send.
+func (cs *clientStream) consumed(n int64) uint32 {
+	if cs.recvEnd || cs.err != nil {
+		return 0
+	}
+	cs.unacked += n
+	if cs.unacked < clientStreamWindow/2 {
+		return 0
+	}
+	increment := cs.unacked
+	cs.recvWindow += increment
+	cs.unacked = 0
+	return uint32(increment)
+}
+
+// writeBody sends the request body and trailers, then ends the stream.
+func (cs *clientStream) writeBody() {
+	cc := cs.cc
+	if closer, ok := cs.req.Body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	buf := make([]byte, defaultMaxFrameSize)
+	for {
+		n, err := cs.req.Body.Read(buf)
+		for data := buf[:n]; len(data) > 0; {
+			allowed, werr := cs.reserveWindow(len(data))
+			if werr == nil {
+				werr = cc.conn.WriteFrame(Frame{Type: DataFrameType, StreamID: cs.id, Data: DataFrame{Data: data[:allowed]}})
+			}
+			if werr != nil {
+				return
+			}
+			data = data[allowed:]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cs.abort(Cancel, fmt.Errorf("reading request body: %w", err))
+			return
+		}
+	}
+
+	cc.mu.Lock()
+	failed := cs.err != nil
+	cc.mu.Unlock()
+	if failed {
+		return
+	}
+	end := Frame{Type: DataFrameType, Flags: EndStreamFlag, StreamID: cs.id, Data: DataFrame{}}
+	if len(cs.req.Trailer) > 0 {
+		end = Frame{
+			Type:     HeaderFrameType,
+			Flags:    EndStreamFlag | EndHeaderFlag,
+			StreamID: cs.id,
+			Data:     HeaderFrame{HeaderFields: cs.req.Trailer},
+		}
+	}
+	if err := cc.conn.WriteFrame(end); err != nil {
+		return
+	}
+
+	cc.mu.Lock()
+	cs.sentEnd = true
+	if cs.recvEnd {
+		cc.removeStream(cs)
+	}
+	cc.mu.Unlock()
+}
+
+// reserveWindow waits until both send windows are open and takes up to n
+// octets from them, no more than a frame can carry.
+func (cs *clientStream) reserveWindow(n int) (int, error) {
+	cc := cs.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for stalled := false; ; stalled = true {
+		if cs.err != nil {
+			return 0, cs.err
+		}
+		window := cs.sendWindow
+		if cc.sendWindow < window {
+			window = cc.sendWindow
+		}
+		if window > 0 {
+			if int64(n) > window {
+				n = int(window)
+			}
+			if n > int(cc.maxFrameSize) {
+				n = int(cc.maxFrameSize)
+			}
+			cs.sendWindow -= int64(n)
+			cc.sendWindow -= int64(n)
+			return n, nil
+		}
+
+		if !stalled {
+			info := FlowControlStallInfo{StreamID: cs.id, ConnWindow: cc.sendWindow, StreamWindow: cs.sendWindow}
+			cc.mu.Unlock()
+			cs.trace.flowControlStalled(info)
+			cc.mu.Lock()
+			continue
+		}
+		cc.cond.Wait()
+	}
+}
+
+// clientBody is the body of a ClientResponse, read from the DATA frames
+// buffered by the connection.
+type clientBody struct {
+	cs *clientStream
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	cs := b.cs
+	cc := cs.cc
+	cc.mu.Lock()
+	for cs.body.Len() == 0 && !cs.recvEnd && cs.err == nil && !cs.bodyClosed {
+		cc.cond.Wait()
+	}
+	switch {
+	case cs.bodyClosed:
+		cc.mu.Unlock()
+		return 0, ErrBodyClosed
+	case cs.recvEnd && cs.body.Len() == 0:
+		cc.mu.Unlock()
+		return 0, io.EOF
+	case !cs.recvEnd && cs.err != nil:
+		// A complete body is still delivered if the stream is
+		// reset afterwards.
+		err := cs.err
+		cc.mu.Unlock()
+		return 0, err
+	}
+	n, _ := cs.body.Read(p)
+	connIncrement := cc.consumed(int64(n))
+	streamIncrement := cs.consumed(int64(n))
+	cc.mu.Unlock()
+
+	cc.writeWindowUpdate(0, connIncrement)
+	cc.writeWindowUpdate(cs.id, streamIncrement)
+	return n, nil
+}
+
+// Close discards the unread body, resetting the stream if the response is
+// not complete.
+func (b *clientBody) Close() error {
+	cs := b.cs
+	cc := cs.cc
+	cc.mu.Lock()
+	if cs.bodyClosed {
+		cc.mu.Unlock()
+		return nil
+	}
+	cs.bodyClosed = true
+	increment := cc.consumed(int64(cs.body.Len()))
+	cs.body.Reset()
+	complete := cs.recvEnd
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	cc.writeWindowUpdate(0, increment)
+	if !complete {
+		cs.abort(Cancel, ErrBodyClosed)
+	}
+	return nil
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is the server end of a connection under test, driven frame
+// by frame.
+type testServer struct {
+	t      *testing.T
+	conn   *Conn
+	frames chan Frame
+}
+
+// newTestServer reads the client preface and then every frame of conn in
+// the background.
+func newTestServer(t *testing.T, conn net.Conn) *testServer {
+	s := &testServer{t: t, conn: NewConn(conn), frames: make(chan Frame, 1000)}
+	go func() {
+		defer close(s.frames)
+		if err := s.conn.ReadPreface(); err != nil {
+			return
+		}
+		for {
+			frame, err := s.conn.ReadFrame()
+			if err != nil {
+				return
+			}
+			s.frames <- frame
+		}
+	}()
+	t.Cleanup(func() { s.conn.Close() })
+	return s
+}
+
+// newTestClientConn returns a client connection to a test server which
+// has sent settings and received their acknowledgement.
+func newTestClientConn(t *testing.T, settings map[SettingParam]uint32) (*ClientConn, *testServer) {
+	clientConn, serverConn := net.Pipe()
+	s := newTestServer(t, serverConn)
+	cc, err := NewClientConn(clientConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	s.write(Frame{Type: SettingFrameType, Data: SettingFrame{Params: settings}})
+	for {
+		if frame := s.next(SettingFrameType); frame.Flags&AckFlag != UnsetFlag {
+			return cc, s
+		}
+	}
+}
+
+func (s *testServer) write(frames ...Frame) {
+	s.t.Helper()
+	for _, frame := range frames {
+		if err := s.conn.WriteFrame(frame); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+}
+
+// next returns the next frame of one of types, skipping the others.
+func (s *testServer) next(types ...FrameType) Frame {
+	s.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame, ok := <-s.frames:
+			if !ok {
+				s.t.Fatal("connection closed")
+			}
+			for _, frameType := range types {
+				if frame.Type == frameType {
+					return frame
+				}
+			}
+		case <-timeout:
+			s.t.Fatalf("no %v frame received", types)
+		}
+	}
+}
+
+func (s *testServer) writeHeaders(streamID uint32, flags FlagType, headerFields []HeaderField) {
+	s.t.Helper()
+	s.write(Frame{Type: HeaderFrameType, Flags: EndHeaderFlag | flags, StreamID: streamID, Data: HeaderFrame{HeaderFields: headerFields}})
+}
+
+type roundTripResult struct {
+	resp *ClientResponse
+	err  error
+}
+
+func goRoundTrip(ctx context.Context, cc *ClientConn, req *ClientRequest) <-chan roundTripResult {
+	result := make(chan roundTripResult, 1)
+	go func() {
+		resp, err := cc.RoundTrip(ctx, req)
+		result <- roundTripResult{resp, err}
+	}()
+	return result
+}
+
+// traceRecorder returns a context tracing every hook into a log.
+type traceRecorder struct {
+	mu  sync.Mutex
+	log []string
+}
+
+func (r *traceRecorder) add(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log = append(r.log, fmt.Sprintf(format, args...))
+}
+
+func (r *traceRecorder) lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.log...)
+}
+
+// waitFor waits until line is logged, as hooks may run after the frames
+// they follow are received.
+func (r *traceRecorder) waitFor(t *testing.T, line string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		for _, l := range r.lines() {
+			if l == line {
+				return
+			}
+		}
+	}
+	t.Fatalf("%q not traced in %q", line, r.lines())
+}
+
+func (r *traceRecorder) context() context.Context {
+	return WithClientTrace(context.Background(), &ClientTrace{
+		GotConn:          func(info GotConnInfo) { r.add("got conn reused=%t", info.Reused) },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) { r.add("tls handshake done err=%v", err) },
+		ALPNNegotiated:   func(protocol string) { r.add("alpn %s", protocol) },
+		WroteHeaders:     func(info WroteHeadersInfo) { r.add("wrote headers %d", info.StreamID) },
+		GotFirstResponseByte: func() {
+			r.add("first response byte")
+		},
+		Got1xxResponse: func(status int, header []HeaderField) error {
+			r.add("1xx %d %v", status, header)
+			return nil
+		},
+		FlowControlStalled: func(info FlowControlStallInfo) {
+			r.add("stalled %d conn=%d stream=%d", info.StreamID, info.ConnWindow, info.StreamWindow)
+		},
+		StreamReset: func(info StreamResetInfo) {
+			r.add("reset %d %s remote=%t", info.StreamID, info.ErrorCode, info.Remote)
+		},
+	})
+}
+
+func TestClientConnRoundTrip(t *testing.T) {
+	cc, s := newTestClientConn(t, nil)
+	trace := &traceRecorder{}
+
+	for i, streamID := range []uint32{1, 3} {
+		result := goRoundTrip(trace.context(), cc, &ClientRequest{
+			Header: NewRequestHeader("GET", "https", "example.com", "/").Add("Accept", "*/*"),
+		})
+
+		headers := s.next(HeaderFrameType)
+		expected := []HeaderField{
+			{name: ":method", value: "GET"},
+			{name: ":scheme", value: "https"},
+			{name: ":authority", value: "example.com"},
+			{name: ":path", value: "/"},
+			{name: "accept", value: "*/*"},
+		}
+		if headers.StreamID != streamID || headers.Flags&EndStreamFlag == UnsetFlag ||
+			!reflect.DeepEqual(headers.Data.(HeaderFrame).HeaderFields, expected) {
+			t.Fatalf("unexpected request %v", headers)
+		}
+		trace.waitFor(t, fmt.Sprint("wrote headers ", streamID))
+		s.writeHeaders(streamID, UnsetFlag, NewResponseHeader(200).Add("content-type", "text/plain").HeaderFields())
+		s.write(Frame{Type: DataFrameType, Flags: EndStreamFlag, StreamID: streamID, Data: DataFrame{Data: []byte(fmt.Sprint("hello ", i))}})
+
+		r := <-result
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		body, err := io.ReadAll(r.resp.Body)
+		r.resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.resp.Header.Status != 200 || r.resp.Header.Get("content-type") != "text/plain" || string(body) != fmt.Sprint("hello ", i) {
+			t.Errorf("unexpected response %v %q", r.resp.Header, body)
+		}
+	}
+
+	expected := []string{
+		"got conn reused=false", "wrote headers 1", "first response byte",
+		"got conn reused=true", "wrote headers 3", "first response byte",
+	}
+	if lines := trace.lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected trace %q got %q", expected, lines)
+	}
+}
+
+func TestClientConnRequestBody(t *testing.T) {
+	cc, s := newTestClientConn(t, map[SettingParam]uint32{SettingsInitialWindowSize: 4})
+	trace := &traceRecorder{}
+
+	result := goRoundTrip(trace.context(), cc, &ClientRequest{
+		Header:  NewRequestHeader("POST", "https", "example.com", "/upload"),
+		Body:    strings.NewReader("abcdefgh"),
+		Trailer: []HeaderField{NewHeaderField("x-checksum", "42")},
+	})
+
+	if headers := s.next(HeaderFrameType); headers.Flags&EndStreamFlag != UnsetFlag {
+		t.Fatalf("unexpected END_STREAM on %v", headers)
+	}
+	if data := s.next(DataFrameType); string(data.Data.(DataFrame).Data) != "abcd" {
+		t.Fatalf("expected the first 4 octets got %v", data)
+	}
+	trace.waitFor(t, "stalled 1 conn=65531 stream=0")
+	s.write(Frame{Type: WindowUpdateFrameType, StreamID: 1, Data: WindowUpdateFrame{WindowSizeIncrement: 100}})
+	if data := s.next(DataFrameType); string(data.Data.(DataFrame).Data) != "efgh" {
+		t.Fatalf("expected the last 4 octets got %v", data)
+	}
+	trailer := s.next(HeaderFrameType)
+	if trailer.Flags&EndStreamFlag == UnsetFlag ||
+		!reflect.DeepEqual(trailer.Data.(HeaderFrame).HeaderFields, []HeaderField{NewHeaderField("x-checksum", "42")}) {
+		t.Fatalf("unexpected trailer %v", trailer)
+	}
+
+	s.writeHeaders(1, EndStreamFlag, NewResponseHeader(204).HeaderFields())
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if n, err := r.resp.Body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("expected an empty body got %d %v", n, err)
+	}
+}
+
+func TestClientConnInformationalAndTrailers(t *testing.T) {
+	cc, s := newTestClientConn(t, nil)
+	trace := &traceRecorder{}
+
+	result := goRoundTrip(trace.context(), cc, &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/")})
+	s.next(HeaderFrameType)
+	trace.waitFor(t, "wrote headers 1")
+	s.writeHeaders(1, UnsetFlag, NewResponseHeader(103).Add("link", "</style.css>; rel=preload").HeaderFields())
+	s.writeHeaders(1, UnsetFlag, NewResponseHeader(200).Add("trailer", "grpc-status").HeaderFields())
+	s.write(Frame{Type: DataFrameType, StreamID: 1, Data: DataFrame{Data: []byte("body")}})
+	s.writeHeaders(1, EndStreamFlag, []HeaderField{NewHeaderField("grpc-status", "0")})
+
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	body, err := io.ReadAll(r.resp.Body)
+	if err != nil || string(body) != "body" {
+		t.Fatalf("unexpected body %q %v", body, err)
+	}
+	if trailer := r.resp.Trailer(); !reflect.DeepEqual(trailer, []HeaderField{NewHeaderField("grpc-status", "0")}) {
+		t.Errorf("unexpected trailer %v", trailer)
+	}
+	expected := []string{"got conn reused=false", "wrote headers 1", "first response byte", "1xx 103 [link: </style.css>; rel=preload]"}
+	if lines := trace.lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected trace %q got %q", expected, lines)
+	}
+}
+
+func TestClientConnStreamReset(t *testing.T) {
+	cc, s := newTestClientConn(t, nil)
+	trace := &traceRecorder{}
+
+	result := goRoundTrip(trace.context(), cc, &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/")})
+	s.next(HeaderFrameType)
+	s.write(Frame{Type: RSTStreamFrameType, StreamID: 1, Data: RSTStreamFrame{ErrorCode: RefusedStream}})
+
+	r := <-result
+	var streamErr StreamError
+	if !errors.As(r.err, &streamErr) || streamErr != (StreamError{StreamID: 1, Code: RefusedStream, Remote: true}) {
+		t.Fatalf("expected a stream error got %v", r.err)
+	}
+	trace.waitFor(t, "reset 1 REFUSED_STREAM remote=true")
+}
+
+func TestClientConnCancel(t *testing.T) {
+	cc, s := newTestClientConn(t, nil)
+	trace := &traceRecorder{}
+
+	ctx, cancel := context.WithCancel(trace.context())
+	result := goRoundTrip(ctx, cc, &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/")})
+	s.next(HeaderFrameType)
+	cancel()
+
+	if reset := s.next(RSTStreamFrameType); reset.StreamID != 1 || reset.Data.(RSTStreamFrame).ErrorCode != Cancel {
+		t.Fatalf("expected RST_STREAM CANCEL got %v", reset)
+	}
+	if r := <-result; !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("expected %s got %v", context.Canceled, r.err)
+	}
+	trace.waitFor(t, "reset 1 CANCEL remote=false")
+}
+
+func TestClientConnDataAfterCancel(t *testing.T) {
+	cc, s := newTestClientConn(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := goRoundTrip(ctx, cc, &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/")})
+	s.next(HeaderFrameType)
+	cancel()
+	s.next(RSTStreamFrameType)
+	<-result
+
+	// The server sent these before it received the RST_STREAM.
+	s.writeHeaders(1, UnsetFlag, []HeaderField{{name: ":status", value: "200"}})
+	s.write(Frame{Type: DataFrameType, StreamID: 1, Data: DataFrame{Data: []byte("late")}})
+	s.write(Frame{Type: PingFrameType, Data: PingFrame{Data: [8]byte{9}}})
+	if ping := s.next(PingFrameType); ping.Flags&AckFlag == UnsetFlag || ping.Data.(PingFrame).Data != [8]byte{9} {
+		t.Fatalf("expected a PING ACK got %v", ping)
+	}
+	if !cc.canTakeNewRequest() {
+		t.Error("connection closed by DATA on a reset stream")
+	}
+}
+
+func TestClientConnMaxConcurrentStreams(t *testing.T) {
+	cc, s := newTestClientConn(t, map[SettingParam]uint32{SettingsMaxConcurrentStreams: 1})
+
+	first := goRoundTrip(context.Background(), cc, &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/1")})
+	s.next(HeaderFrameType)
+	second := goRoundTrip(context.Background(), cc, &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/2")})
+	select {
+	case frame := <-s.frames:
+		t.Fatalf("unexpected %v beyond the stream limit", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.writeHeaders(1, EndStreamFlag, NewResponseHeader(200).HeaderFields())
+	if r := <-first; r.err != nil {
+		t.Fatal(r.err)
+	}
+	if headers := s.next(HeaderFrameType); headers.StreamID != 3 {
+		t.Fatalf("unexpected %v", headers)
+	}
+	s.writeHeaders(3, EndStreamFlag, NewResponseHeader(200).HeaderFields())
+	if r := <-second; r.err != nil {
+		t.Fatal(r.err)
+	}
+}
+
+func TestClientConnGoAway(t *testing.T) {
+	cc, s := newTestClientConn(t, nil)
+
+	first := goRoundTrip(context.Background(), cc, &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/1")})
+	s.next(HeaderFrameType)
+	second := goRoundTrip(context.Background(), cc, &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/2")})
+	s.next(HeaderFrameType)
+	s.write(Frame{Type: GoAwayFrameType, Data: GoAwayFrame{LastStreamID: 1, ErrorCode: NoError}})
+
+	var goAwayErr GoAwayError
+	if r := <-second; !errors.As(r.err, &goAwayErr) || goAwayErr.LastStreamID != 1 {
+		t.Fatalf("expected a GOAWAY error got %v", r.err)
+	}
+	if _, err := cc.RoundTrip(context.Background(), &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/3")}); !errors.As(err, &goAwayErr) {
+		t.Fatalf("expected a GOAWAY error got %v", err)
+	}
+
+	// Streams up to the last one are still processed.
+	s.writeHeaders(1, EndStreamFlag, NewResponseHeader(200).HeaderFields())
+	if r := <-first; r.err != nil || r.resp.Header.Status != 200 {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
+
+func TestClientConnProtocolError(t *testing.T) {
+	cc, s := newTestClientConn(t, nil)
+
+	result := goRoundTrip(context.Background(), cc, &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/")})
+	s.next(HeaderFrameType)
+	s.write(Frame{
+		Type:     PushPromiseFrameType,
+		Flags:    EndHeaderFlag,
+		StreamID: 1,
+		Data:     PushPromiseFrame{PromisedStreamID: 2, HeaderFields: NewRequestHeader("GET", "https", "example.com", "/pushed").HeaderFields()},
+	})
+
+	goAway := s.next(GoAwayFrameType).Data.(GoAwayFrame)
+	if goAway.ErrorCode != ProtocolError {
+		t.Errorf("expected PROTOCOL_ERROR got %s", goAway.ErrorCode)
+	}
+	if r := <-result; !errors.Is(r.err, ErrClientConnClosed) {
+		t.Errorf("expected %s got %v", ErrClientConnClosed, r.err)
+	}
+}
+
+func TestDialClientConn(t *testing.T) {
+	cert, pool := newTestCertificate(t, "127.0.0.1")
+	// The second server does not support ALPN.
+	for _, protocols := range [][]string{{"h2"}, nil} {
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   protocols,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if protocols == nil {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+				return
+			}
+			s := newTestServer(t, conn)
+			s.write(Frame{Type: SettingFrameType, Data: SettingFrame{}})
+			for frame := range s.frames {
+				if frame.Type == HeaderFrameType {
+					s.write(Frame{Type: HeaderFrameType, Flags: EndStreamFlag | EndHeaderFlag, StreamID: frame.StreamID, Data: HeaderFrame{HeaderFields: NewResponseHeader(200).HeaderFields()}})
+				}
+			}
+		}()
+
+		trace := &traceRecorder{}
+		ctx := trace.context()
+		cc, err := DialClientConn(ctx, "tcp", listener.Addr().String(), &tls.Config{RootCAs: pool}, nil)
+		if protocols == nil {
+			if !errors.Is(err, ErrH2NotNegotiated) {
+				t.Errorf("expected %s got %v", ErrH2NotNegotiated, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := cc.RoundTrip(ctx, &ClientRequest{Header: NewRequestHeader("GET", "https", "127.0.0.1", "/")})
+		if err != nil || resp.Header.Status != 200 {
+			t.Fatalf("unexpected response %v %v", resp, err)
+		}
+		if state, ok := cc.ConnectionState(); !ok || state.NegotiatedProtocol != "h2" {
+			t.Errorf("unexpected connection state %v", state)
+		}
+		cc.Close()
+		expected := []string{"tls handshake done err=<nil>", "alpn h2", "got conn reused=false"}
+		if lines := trace.lines(); !reflect.DeepEqual(lines[:3], expected) {
+			t.Errorf("expected trace %q got %q", expected, lines)
+		}
+	}
+}
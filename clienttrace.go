@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+)
+
+// ClientTrace is a set of hooks called at the stages of a request sent
+// on a ClientConn, in the manner of net/http/httptrace. Any hook may be
+// nil. Hooks are called from the goroutines of the connection and must
+// not block.
+type ClientTrace struct {
+	// GotConn is called once a connection has been obtained for the
+	// request, before its HEADERS are sent.
+	GotConn func(GotConnInfo)
+	// TLSHandshakeDone is called after the TLS handshake of a new
+	// connection, with the error if it failed.
+	TLSHandshakeDone func(tls.ConnectionState, error)
+	// ALPNNegotiated is called with the protocol selected by the server,
+	// "" if it did not select any.
+	ALPNNegotiated func(protocol string)
+	// WroteHeaders is called once the HEADERS of the request are written.
+	WroteHeaders func(WroteHeadersInfo)
+	// GotFirstResponseByte is called when the first frame of the response
+	// arrives.
+	GotFirstResponseByte func()
+	// Got1xxResponse is called for every informational response before
+	// the final one. Returning an error cancels the request.
+	Got1xxResponse func(status int, header []HeaderField) error
+	// FlowControlStalled is called when the request body cannot be sent
+	// because a flow-control window is exhausted.
+	FlowControlStalled func(FlowControlStallInfo)
+	// StreamReset is called when the stream of the request is reset, by
+	// either endpoint.
+	StreamReset func(StreamResetInfo)
+}
+
+type GotConnInfo struct {
+	Conn *ClientConn
+	// Reused is whether the connection carried other requests before.
+	Reused bool
+}
+
+type WroteHeadersInfo struct {
+	StreamID uint32
+}
+
+// FlowControlStallInfo reports the windows a stream is waiting on, of
+// which at least one is exhausted.
+type FlowControlStallInfo struct {
+	StreamID     uint32
+	ConnWindow   int64
+	StreamWindow int64
+}
+
+type StreamResetInfo struct {
+	StreamID  uint32
+	ErrorCode ErrCode
+	// Remote is whether the peer sent the RST_STREAM.
+	Remote bool
+}
+
+type clientTraceKey struct{}
+
+// WithClientTrace returns a context carrying trace. Hooks of a trace
+// already in ctx are still called, after those of trace.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	if trace == nil {
+		panic("nil trace")
+	}
+	if old := ContextClientTrace(ctx); old != nil {
+		trace = trace.compose(old)
+	}
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// ContextClientTrace returns the trace of ctx, nil if there is none.
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+// compose returns a trace calling the hooks of t, then those of old.
+func (t *ClientTrace) compose(old *ClientTrace) *ClientTrace {
+	return &ClientTrace{
+		GotConn:              composeHook(t.GotConn, old.GotConn),
+		TLSHandshakeDone:     composeHook2(t.TLSHandshakeDone, old.TLSHandshakeDone),
+		ALPNNegotiated:       composeHook(t.ALPNNegotiated, old.ALPNNegotiated),
+		WroteHeaders:         composeHook(t.WroteHeaders, old.WroteHeaders),
+		GotFirstResponseByte: composeHook0(t.GotFirstResponseByte, old.GotFirstResponseByte),
+		Got1xxResponse:       compose1xxHook(t.Got1xxResponse, old.Got1xxResponse),
+		FlowControlStalled:   composeHook(t.FlowControlStalled, old.FlowControlStalled),
+		StreamReset:          composeHook(t.StreamReset, old.StreamReset),
+	}
+}
+
+func composeHook0(f, g func()) func() {
+	if f == nil || g == nil {
+		if f == nil {
+			return g
+		}
+		return f
+	}
+	return func() { f(); g() }
+}
+
+func composeHook[A any](f, g func(A)) func(A) {
+	if f == nil || g == nil {
+		if f == nil {
+			return g
+		}
+		return f
+	}
+	return func(a A) { f(a); g(a) }
+}
+
+func composeHook2[A, B any](f, g func(A, B)) func(A, B) {
+	if f == nil || g == nil {
+		if f == nil {
+			return g
+		}
+		return f
+	}
+	return func(a A, b B) { f(a, b); g(a, b) }
+}
+
+func compose1xxHook(f, g func(int, []HeaderField) error) func(int, []HeaderField) error {
+	if f == nil || g == nil {
+		if f == nil {
+			return g
+		}
+		return f
+	}
+	return func(status int, header []HeaderField) error {
+		if err := f(status, header); err != nil {
+			return err
+		}
+		return g(status, header)
+	}
+}
+
+// The methods below call a hook if the trace and the hook are set.
+
+func (t *ClientTrace) gotConn(info GotConnInfo) {
+	if t != nil && t.GotConn != nil {
+		t.GotConn(info)
+	}
+}
+
+func (t *ClientTrace) tlsHandshakeDone(state tls.ConnectionState, err error) {
+	if t != nil && t.TLSHandshakeDone != nil {
+		t.TLSHandshakeDone(state, err)
+	}
+}
+
+func (t *ClientTrace) alpnNegotiated(protocol string) {
+	if t != nil && t.ALPNNegotiated != nil {
+		t.ALPNNegotiated(protocol)
+	}
+}
+
+func (t *ClientTrace) wroteHeaders(info WroteHeadersInfo) {
+	if t != nil && t.WroteHeaders != nil {
+		t.WroteHeaders(info)
+	}
+}
+
+func (t *ClientTrace) gotFirstResponseByte() {
+	if t != nil && t.GotFirstResponseByte != nil {
+		t.GotFirstResponseByte()
+	}
+}
+
+func (t *ClientTrace) got1xxResponse(status int, header []HeaderField) error {
+	if t != nil && t.Got1xxResponse != nil {
+		return t.Got1xxResponse(status, header)
+	}
+	return nil
+}
+
+func (t *ClientTrace) flowControlStalled(info FlowControlStallInfo) {
+	if t != nil && t.FlowControlStalled != nil {
+		t.FlowControlStalled(info)
+	}
+}
+
+func (t *ClientTrace) streamReset(info StreamResetInfo) {
+	if t != nil && t.StreamReset != nil {
+		t.StreamReset(info)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWithClientTraceComposes(t *testing.T) {
+	calls := []string{}
+	errStop := errors.New("stop")
+	ctx := WithClientTrace(context.Background(), &ClientTrace{
+		WroteHeaders:   func(WroteHeadersInfo) { calls = append(calls, "outer headers") },
+		Got1xxResponse: func(int, []HeaderField) error { calls = append(calls, "outer 1xx"); return nil },
+		StreamReset:    func(StreamResetInfo) { calls = append(calls, "outer reset") },
+	})
+	ctx = WithClientTrace(ctx, &ClientTrace{
+		WroteHeaders:   func(WroteHeadersInfo) { calls = append(calls, "inner headers") },
+		Got1xxResponse: func(int, []HeaderField) error { calls = append(calls, "inner 1xx"); return errStop },
+		ALPNNegotiated: func(string) { calls = append(calls, "inner alpn") },
+	})
+
+	trace := ContextClientTrace(ctx)
+	trace.wroteHeaders(WroteHeadersInfo{StreamID: 1})
+	trace.alpnNegotiated("h2")
+	trace.streamReset(StreamResetInfo{})
+	if err := trace.got1xxResponse(100, nil); err != errStop {
+		t.Errorf("expected %v got %v", errStop, err)
+	}
+	trace.gotFirstResponseByte()
+
+	expected := []string{"inner headers", "outer headers", "inner alpn", "outer reset", "inner 1xx"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %q got %q", expected, calls)
+	}
+
+	// Hooks are safe to call without a trace.
+	ContextClientTrace(context.Background()).gotFirstResponseByte()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// maxWindowSize is the largest flow-control window (RFC 9113
+	// section 6.9.1).
+	maxWindowSize = 1<<31 - 1
+	// maxStreamID is the largest stream identifier.
+	maxStreamID = 1<<31 - 1
+)
+
+// ConnectionError is a connection error of RFC 9113 section 5.4.1, sent
+// to the peer in a GOAWAY frame.
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("connection error %s: %s", e.Code, e.Reason)
+}
+
+// StreamError is the error of a stream reset with RST_STREAM.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	// Remote is whether the peer sent the RST_STREAM.
+	Remote bool
+}
+
+func (e StreamError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("stream %d reset by peer: %s", e.StreamID, e.Code)
+	}
+	return fmt.Sprintf("stream %d reset: %s", e.StreamID, e.Code)
+}
+
+// connectionError returns the connection error for a frame that could not
+// be decoded or processed.
+func connectionError(err error) ConnectionError {
+	var connErr ConnectionError
+	switch {
+	case errors.As(err, &connErr):
+		return connErr
+	case errors.Is(err, ErrFrameSize):
+		return ConnectionError{Code: FrameSizeError, Reason: err.Error()}
+	case errors.Is(err, ErrProtocol):
+		return ConnectionError{Code: ProtocolError, Reason: err.Error()}
+	case errors.Is(err, ErrHeaderBlockTooLarge):
+		return ConnectionError{Code: EnhanceYourCalm, Reason: err.Error()}
+	}
+	// The HPACK decoder is the only other source of errors.
+	return ConnectionError{Code: CompressionError, Reason: err.Error()}
+}
+
+// isConnBroken reports whether err comes from the transport rather than
+// from the peer violating the protocol.
+func isConnBroken(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &netErr)
+}
+
+// Conn frames an HTTP/2 connection on top of a net.Conn. Frames can be
+// written from several goroutines, but only one may read.
+type Conn struct {
+	conn    net.Conn
+	handler *frameHandler
+	reader  *bufio.Reader
+
+	writeMu sync.Mutex
+	tracer  *FrameTracer
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn:    conn,
+		handler: NewFrameHandler(),
+		reader:  bufio.NewReader(conn),
+	}
+}
+
+// SetFrameTracer logs every frame sent and received to t, nil to stop.
+// It must be called before the connection is used.
+func (c *Conn) SetFrameTracer(t *FrameTracer) {
+	c.tracer = t
+}
+
+// SetEventSink emits the events of the connection to sink, nil to stop.
+// It must be called before the connection is used.
+func (c *Conn) SetEventSink(sink EventSink) {
+	c.handler.SetEventSink(sink)
+}
+
+// SetMaxReadFrameSize sets the largest frame payload accepted, which must
+// match the SETTINGS_MAX_FRAME_SIZE we advertise. Only the reader may
+// call it.
+func (c *Conn) SetMaxReadFrameSize(n uint32) {
+	c.handler.SetMaxReadFrameSize(n)
+}
+
+// SetMaxHeaderListSize bounds the header lists received, see
+// SETTINGS_MAX_HEADER_LIST_SIZE. Only the reader may call it.
+func (c *Conn) SetMaxHeaderListSize(n uint32) {
+	c.handler.decoder.SetMaxHeaderListSize(n)
+}
+
+// ApplySettings applies the settings of the peer that change how frames are
+// written: its dynamic table size and maximum frame size.
+func (c *Conn) ApplySettings(params map[SettingParam]uint32) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if n, ok := params[SettingsHeaderTableSize]; ok {
+		c.handler.encoder.SetMaxDynamicTableSize(n)
+	}
+	if n, ok := params[SettingsMaxFrameSize]; ok {
+		c.handler.SetMaxWriteFrameSize(n)
+	}
+}
+
+// WritePreface sends the client connection preface.
+func (c *Conn) WritePreface() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := io.WriteString(c.conn, ClientPreface)
+	return err
+}
+
+// ReadPreface reads the client connection preface.
+func (c *Conn) ReadPreface() error {
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(c.reader, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return fmt.Errorf("%w: invalid client preface %q", ErrProtocol, preface)
+	}
+	return nil
+}
+
+func (c *Conn) WriteFrame(frame Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	n, err := c.handler.Encode(c.conn, frame)
+	if err != nil {
+		return err
+	}
+	if c.tracer != nil {
+		frame.Length = uint32(n - frameHeaderLength)
+		c.tracer.TraceFrame(true, frame)
+	}
+	return nil
+}
+
+// ReadFrame reads the next frame. A frame whose header list exceeds our
+// limit is returned along with ErrHeaderListTooLarge.
+func (c *Conn) ReadFrame() (Frame, error) {
+	frame := Frame{}
+	err := c.handler.Decode(c.reader, &frame)
+	if c.tracer != nil && frame.Data != nil {
+		c.tracer.TraceFrame(false, frame)
+	}
+	return frame, err
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+The dump command prints the frames of a raw HTTP/2 byte stream, such as
+one direction of a connection captured by a proxy:
+
+	h2dump [-data n] [-table-size n] [file]
+	h2 dump [-data n] [-table-size n] [file]
+
+The stream is read from file or stdin and may start with the client
+preface. Header blocks are decoded with one HPACK context, as the peer
+would.
+*/
+func runDump(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	dataLimit := flags.Int("data", 64, "number of DATA octets printed per frame, -1 for all")
+	tableSize := flags.Uint("table-size", defaultDynamicTableSize, "SETTINGS_HEADER_TABLE_SIZE advertised to the sender")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("dump reads a single stream, got %d files", flags.NArg())
+	}
+
+	input := stdin
+	if flags.NArg() == 1 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+	r := bufio.NewReader(input)
+
+	if preface, err := r.Peek(len(ClientPreface)); err == nil && string(preface) == ClientPreface {
+		r.Discard(len(ClientPreface))
+		fmt.Fprintln(stdout, "client preface")
+	}
+
+	handler := NewFrameHandler()
+	// The frame size the peers agreed on is not known.
+	handler.SetMaxReadFrameSize(maxFrameSize)
+	decoder := handler.decoder.(*hPackDecoder)
+	decoder.maxTableSize = uint32(*tableSize)
+	decoder.table.setMaxSize(uint32(*tableSize))
+	// A capture is shown whole, whatever the limits of the receiver.
+	decoder.SetMaxHeaderListSize(0)
+	for {
+		frame := Frame{}
+		if err := handler.Decode(r, &frame); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%s frame on stream %d: %w", frame.Type, frame.StreamID, err)
+		}
+		printFrame(stdout, frame, *dataLimit)
+	}
+}
+
+// printFrame writes a frame header on one line, then its decoded payload.
+func printFrame(w io.Writer, frame Frame, dataLimit int) {
+	flags := "-"
+	if names := frame.FlagNames(); len(names) > 0 {
+		flags = strings.Join(names, "|")
+	}
+	fmt.Fprintf(w, "%s flags=%s stream=%d length=%d\n", frame.Type, flags, frame.StreamID, frame.Length)
+
+	switch data := frame.Data.(type) {
+	case DataFrame:
+		if len(data.Data) > 0 {
+			fmt.Fprintf(w, "    %s\n", truncateData(data.Data, dataLimit))
+		}
+	case HeaderFrame:
+		if frame.Flags&PriorityFlag != UnsetFlag {
+			fmt.Fprintf(w, "    priority exclusive=%t dependency=%d weight=%d\n", data.Exclusive, data.StreamDependency, data.Weight)
+		}
+		for _, hf := range data.HeaderFields {
+			fmt.Fprintf(w, "    %s\n", hf)
+		}
+	case PriorityFrame:
+		fmt.Fprintf(w, "    exclusive=%t dependency=%d weight=%d\n", data.Exclusive, data.StreamDependency, data.Weight)
+	case RSTStreamFrame:
+		fmt.Fprintf(w, "    error=%s\n", data.ErrorCode)
+	case SettingFrame:
+		params := make([]SettingParam, 0, len(data.Params))
+		for param := range data.Params {
+			params = append(params, param)
+		}
+		sort.Slice(params, func(i, j int) bool { return params[i] < params[j] })
+		for _, param := range params {
+			fmt.Fprintf(w, "    %s=%d\n", param, data.Params[param])
+		}
+	case PushPromiseFrame:
+		fmt.Fprintf(w, "    promised_stream=%d\n", data.PromisedStreamID)
+		for _, hf := range data.HeaderFields {
+			fmt.Fprintf(w, "    %s\n", hf)
+		}
+	case PingFrame:
+		fmt.Fprintf(w, "    data=%s\n", hex.EncodeToString(data.Data[:]))
+	case GoAwayFrame:
+		fmt.Fprintf(w, "    last_stream=%d error=%s", data.LastStreamID, data.ErrorCode)
+		if len(data.DebugData) > 0 {
+			fmt.Fprintf(w, " debug=%s", truncateData(data.DebugData, dataLimit))
+		}
+		fmt.Fprintln(w)
+	case WindowUpdateFrame:
+		fmt.Fprintf(w, "    increment=%d\n", data.WindowSizeIncrement)
+	case OriginFrame:
+		for _, origin := range data.Origins {
+			fmt.Fprintf(w, "    %s\n", origin)
+		}
+	case UnknownFrame:
+		if len(data.Payload) > 0 {
+			fmt.Fprintf(w, "    %s\n", truncateData(data.Payload, dataLimit))
+		}
+	}
+}
+
+// truncateData quotes at most limit octets of b, all of them if limit is
+// negative.
+func truncateData(b []byte, limit int) string {
+	if limit < 0 || len(b) <= limit {
+		return fmt.Sprintf("%q", b)
+	}
+	return fmt.Sprintf("%q... (%d more octets)", b[:limit], len(b)-limit)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func encodeFrames(t *testing.T, frames ...Frame) []byte {
+	t.Helper()
+	buf := bytes.Buffer{}
+	handler := NewFrameHandler()
+	for _, frame := range frames {
+		if _, err := handler.Encode(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestDump(t *testing.T) {
+	request := NewRequestHeader("POST", "https", "example.com", "/upload").Add("content-type", "text/plain").HeaderFields()
+	stream := []byte(ClientPreface)
+	stream = append(stream, encodeFrames(t,
+		Frame{Type: SettingFrameType, Data: SettingFrame{Params: map[SettingParam]uint32{
+			SettingsInitialWindowSize: 1 << 20,
+			SettingsEnablePush:        0,
+		}}},
+		Frame{Type: HeaderFrameType, StreamID: 1, Flags: EndHeaderFlag, Data: HeaderFrame{HeaderFields: request}},
+		// The second request references the dynamic table.
+		Frame{Type: HeaderFrameType, StreamID: 3, Flags: EndHeaderFlag, Data: HeaderFrame{HeaderFields: request}},
+		Frame{Type: DataFrameType, StreamID: 1, Flags: EndStreamFlag, Data: DataFrame{Data: []byte(strings.Repeat("a", 20))}},
+		Frame{Type: WindowUpdateFrameType, Data: WindowUpdateFrame{WindowSizeIncrement: 1000}},
+		Frame{Type: RSTStreamFrameType, StreamID: 3, Data: RSTStreamFrame{ErrorCode: Cancel}},
+		Frame{Type: PingFrameType, Flags: AckFlag, Data: PingFrame{Data: [8]byte{0xde, 0xad, 0xbe, 0xef}}},
+		Frame{Type: GoAwayFrameType, Data: GoAwayFrame{LastStreamID: 3, ErrorCode: NoError}},
+	)...)
+
+	expected := `client preface
+SETTINGS flags=- stream=0 length=12
+    SETTINGS_ENABLE_PUSH=0
+    SETTINGS_INITIAL_WINDOW_SIZE=1048576
+HEADERS flags=END_HEADERS stream=1 length=28
+    :method: POST
+    :scheme: https
+    :authority: example.com
+    :path: /upload
+    content-type: text/plain
+HEADERS flags=END_HEADERS stream=3 length=11
+    :method: POST
+    :scheme: https
+    :authority: example.com
+    :path: /upload
+    content-type: text/plain
+DATA flags=END_STREAM stream=1 length=20
+    "aaaaaaaaaaaaaaaa"... (4 more octets)
+WINDOW_UPDATE flags=- stream=0 length=4
+    increment=1000
+RST_STREAM flags=- stream=3 length=4
+    error=CANCEL
+PING flags=ACK stream=0 length=8
+    data=deadbeef00000000
+GOAWAY flags=- stream=0 length=8
+    last_stream=3 error=NO_ERROR
+`
+	path := filepath.Join(t.TempDir(), "capture.bin")
+	if err := os.WriteFile(path, stream, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.Buffer{}
+	if err := runDump([]string{"-data", "16", path}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestDumpWithoutPreface(t *testing.T) {
+	stream := encodeFrames(t,
+		Frame{Type: HeaderFrameType, StreamID: 1, Flags: EndHeaderFlag | EndStreamFlag, Data: HeaderFrame{
+			HeaderFields: NewResponseHeader(204).HeaderFields(),
+		}},
+	)
+	// A truncated frame is reported after the complete ones.
+	stream = append(stream, 0x00, 0x00, 0x08, 0x06)
+
+	out := bytes.Buffer{}
+	err := runDump(nil, bytes.NewReader(stream), &out)
+	if err == nil {
+		t.Error("expected an error for the truncated frame")
+	}
+	if out.String() != "HEADERS flags=END_STREAM|END_HEADERS stream=1 length=1\n    :status: 204\n" {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
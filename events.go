@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+Connection events follow the naming and shape of the qlog HTTP/2 and
+HPACK drafts where possible, so that the JSON-lines output can be loaded
+in qlog tooling. Events are emitted by the frame layer, from the frames
+going through it, and by the HPACK layer, from its dynamic tables.
+*/
+const (
+	EventFrameCreated       = "http2:frame_created"
+	EventFrameParsed        = "http2:frame_parsed"
+	EventParametersSet      = "http2:parameters_set"
+	EventFlowControlUpdated = "http2:flow_control_updated"
+	EventStreamStateUpdated = "http2:stream_state_updated"
+	EventDynamicTableUpdate = "hpack:dynamic_table_updated"
+)
+
+// Owners of settings, windows and tables: "local" is ours, "remote" the
+// peer's. The local window is the one we grant for receiving, the remote
+// window the one the peer grants us for sending.
+const (
+	OwnerLocal  = "local"
+	OwnerRemote = "remote"
+)
+
+type Event struct {
+	Time time.Time
+	Name string
+	// Data is one of the *EventData types below.
+	Data any
+}
+
+// EventSink receives the events of one or more connections. LogEvent is
+// called synchronously and must not block.
+type EventSink interface {
+	LogEvent(Event)
+}
+
+type FrameEventData struct {
+	Frame Frame
+}
+
+type ParametersSetEventData struct {
+	Owner    string
+	Settings map[SettingParam]uint32
+}
+
+// FlowControlEventData reports a new window size, of the connection if
+// StreamID is 0. Windows can go negative after a SETTINGS change.
+type FlowControlEventData struct {
+	Owner    string
+	StreamID uint32
+	Window   int64
+}
+
+type StreamStateEventData struct {
+	StreamID uint32
+	Old, New StreamState
+}
+
+type DynamicTableEventData struct {
+	Owner string
+	// Inserted is false for an eviction.
+	Inserted    bool
+	Index       int
+	HeaderField HeaderField
+}
+
+// StreamState is a state of RFC 9113 section 5.1.
+type StreamState uint8
+
+const (
+	StateIdle StreamState = iota
+	StateReservedLocal
+	StateReservedRemote
+	StateOpen
+	StateHalfClosedLocal
+	StateHalfClosedRemote
+	StateClosed
+)
+
+func (s StreamState) String() string {
+	return [...]string{"idle", "reserved_local", "reserved_remote", "open", "half_closed_local", "half_closed_remote", "closed"}[s]
+}
+
+// defaultInitialWindowSize is the flow-control window before any SETTINGS.
+const defaultInitialWindowSize = 65535
+
+type observedStream struct {
+	state                  StreamState
+	sendWindow, recvWindow int64
+}
+
+// connObserver derives the events of a connection from the frames sent
+// and received.
+type connObserver struct {
+	sink EventSink
+	now  func() time.Time
+
+	// mu guards the state below, as frames are sent and received from
+	// different goroutines.
+	mu                                      sync.Mutex
+	localInitialWindow, remoteInitialWindow int64
+	sendWindow, recvWindow                  int64
+	streams                                 map[uint32]*observedStream
+}
+
+func newConnObserver(sink EventSink) *connObserver {
+	return &connObserver{
+		sink:                sink,
+		now:                 time.Now,
+		localInitialWindow:  defaultInitialWindowSize,
+		remoteInitialWindow: defaultInitialWindowSize,
+		sendWindow:          defaultInitialWindowSize,
+		recvWindow:          defaultInitialWindowSize,
+		streams:             map[uint32]*observedStream{},
+	}
+}
+
+func (o *connObserver) emit(name string, data any) {
+	o.sink.LogEvent(Event{Time: o.now(), Name: name, Data: data})
+}
+
+// tableObserver returns the observer of an HPACK dynamic table.
+func (o *connObserver) tableObserver(owner string) func(bool, int, HeaderField) {
+	return func(inserted bool, index int, hf HeaderField) {
+		o.emit(EventDynamicTableUpdate, DynamicTableEventData{Owner: owner, Inserted: inserted, Index: index, HeaderField: hf})
+	}
+}
+
+func (o *connObserver) stream(id uint32) *observedStream {
+	s, ok := o.streams[id]
+	if !ok {
+		s = &observedStream{sendWindow: o.remoteInitialWindow, recvWindow: o.localInitialWindow}
+		o.streams[id] = s
+	}
+	return s
+}
+
+func (o *connObserver) setState(id uint32, s *observedStream, state StreamState) {
+	if s.state == state {
+		return
+	}
+	o.emit(EventStreamStateUpdated, StreamStateEventData{StreamID: id, Old: s.state, New: state})
+	s.state = state
+	if state == StateClosed {
+		delete(o.streams, id)
+	}
+}
+
+// endStream applies END_STREAM, sent by us if local.
+func (o *connObserver) endStream(id uint32, s *observedStream, local bool) {
+	switch {
+	case s.state == StateOpen && local:
+		o.setState(id, s, StateHalfClosedLocal)
+	case s.state == StateOpen:
+		o.setState(id, s, StateHalfClosedRemote)
+	case s.state == StateHalfClosedRemote && local, s.state == StateHalfClosedLocal && !local:
+		o.setState(id, s, StateClosed)
+	}
+}
+
+func (o *connObserver) window(owner string, id uint32, window *int64, delta int64) {
+	*window += delta
+	o.emit(EventFlowControlUpdated, FlowControlEventData{Owner: owner, StreamID: id, Window: *window})
+}
+
+// frame records a frame sent by us, or received if sent is false.
+func (o *connObserver) frame(sent bool, frame Frame) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if sent {
+		o.emit(EventFrameCreated, FrameEventData{Frame: frame})
+	} else {
+		o.emit(EventFrameParsed, FrameEventData{Frame: frame})
+	}
+
+	switch frame.Type {
+	case SettingFrameType:
+		settingFrame, ok := frame.Data.(SettingFrame)
+		if !ok || frame.Flags&AckFlag != UnsetFlag {
+			return
+		}
+		owner, initial := OwnerRemote, &o.remoteInitialWindow
+		if sent {
+			owner, initial = OwnerLocal, &o.localInitialWindow
+		}
+		o.emit(EventParametersSet, ParametersSetEventData{Owner: owner, Settings: settingFrame.Params})
+
+		// A new initial window size shifts the windows of every stream.
+		size, ok := settingFrame.Params[SettingsInitialWindowSize]
+		if !ok {
+			return
+		}
+		delta := int64(size) - *initial
+		*initial = int64(size)
+		if delta == 0 {
+			return
+		}
+		for id, s := range o.streams {
+			if sent {
+				o.window(OwnerLocal, id, &s.recvWindow, delta)
+			} else {
+				o.window(OwnerRemote, id, &s.sendWindow, delta)
+			}
+		}
+	case HeaderFrameType:
+		s := o.stream(frame.StreamID)
+		switch {
+		case s.state == StateIdle:
+			o.setState(frame.StreamID, s, StateOpen)
+		case s.state == StateReservedLocal && sent:
+			o.setState(frame.StreamID, s, StateHalfClosedRemote)
+		case s.state == StateReservedRemote && !sent:
+			o.setState(frame.StreamID, s, StateHalfClosedLocal)
+		}
+		if frame.Flags&EndStreamFlag != UnsetFlag {
+			o.endStream(frame.StreamID, s, sent)
+		}
+	case PushPromiseFrameType:
+		pushPromiseFrame, ok := frame.Data.(PushPromiseFrame)
+		if !ok {
+			return
+		}
+		state := StateReservedRemote
+		if sent {
+			state = StateReservedLocal
+		}
+		o.setState(pushPromiseFrame.PromisedStreamID, o.stream(pushPromiseFrame.PromisedStreamID), state)
+	case DataFrameType:
+		s := o.stream(frame.StreamID)
+		if length := int64(frame.Length); length > 0 {
+			if sent {
+				o.window(OwnerRemote, 0, &o.sendWindow, -length)
+				o.window(OwnerRemote, frame.StreamID, &s.sendWindow, -length)
+			} else {
+				o.window(OwnerLocal, 0, &o.recvWindow, -length)
+				o.window(OwnerLocal, frame.StreamID, &s.recvWindow, -length)
+			}
+		}
+		if frame.Flags&EndStreamFlag != UnsetFlag {
+			o.endStream(frame.StreamID, s, sent)
+		}
+	case WindowUpdateFrameType:
+		windowUpdateFrame, ok := frame.Data.(WindowUpdateFrame)
+		if !ok {
+			return
+		}
+		increment := int64(windowUpdateFrame.WindowSizeIncrement)
+		owner, connWindow := OwnerRemote, &o.sendWindow
+		if sent {
+			owner, connWindow = OwnerLocal, &o.recvWindow
+		}
+		if frame.StreamID == 0 {
+			o.window(owner, 0, connWindow, increment)
+			return
+		}
+		s, ok := o.streams[frame.StreamID]
+		if !ok {
+			return
+		}
+		if sent {
+			o.window(owner, frame.StreamID, &s.recvWindow, increment)
+		} else {
+			o.window(owner, frame.StreamID, &s.sendWindow, increment)
+		}
+	case RSTStreamFrameType:
+		if s, ok := o.streams[frame.StreamID]; ok {
+			o.setState(frame.StreamID, s, StateClosed)
+		}
+	}
+}
+
+// JSONEventWriter is an EventSink writing one JSON object per line: a
+// qlog header, then the events with their time in milliseconds relative
+// to the first one.
+type JSONEventWriter struct {
+	mu           sync.Mutex
+	w            io.Writer
+	vantagePoint string
+	// DataLimit is the number of DATA octets written per frame, -1
+	// for all of them.
+	DataLimit     int
+	referenceTime time.Time
+}
+
+// NewJSONEventWriter returns a writer for the events seen from
+// vantagePoint, "client" or "server".
+func NewJSONEventWriter(w io.Writer, vantagePoint string) *JSONEventWriter {
+	return &JSONEventWriter{w: w, vantagePoint: vantagePoint, DataLimit: defaultTraceDataLimit}
+}
+
+type qlogHeader struct {
+	QlogVersion string `json:"qlog_version"`
+	QlogFormat  string `json:"qlog_format"`
+	Trace       struct {
+		VantagePoint struct {
+			Type string `json:"type"`
+		} `json:"vantage_point"`
+		CommonFields struct {
+			TimeFormat    string  `json:"time_format"`
+			ReferenceTime float64 `json:"reference_time"`
+		} `json:"common_fields"`
+	} `json:"trace"`
+}
+
+type qlogEvent struct {
+	Time float64 `json:"time"`
+	Name string  `json:"name"`
+	Data any     `json:"data"`
+}
+
+type qlogTableEntry struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (j *JSONEventWriter) LogEvent(event Event) {
+	data := map[string]any{}
+	switch eventData := event.Data.(type) {
+	case FrameEventData:
+		data["stream_id"] = eventData.Frame.StreamID
+		data["frame"] = newTraceFrame(eventData.Frame, j.DataLimit)
+	case ParametersSetEventData:
+		data["owner"] = eventData.Owner
+		for param, value := range eventData.Settings {
+			data[param.String()] = value
+		}
+	case FlowControlEventData:
+		data["owner"] = eventData.Owner
+		if eventData.StreamID != 0 {
+			data["stream_id"] = eventData.StreamID
+		}
+		data["window"] = eventData.Window
+	case StreamStateEventData:
+		data["stream_id"] = eventData.StreamID
+		data["old"] = eventData.Old.String()
+		data["new"] = eventData.New.String()
+	case DynamicTableEventData:
+		data["owner"] = eventData.Owner
+		data["update_type"] = "evicted"
+		if eventData.Inserted {
+			data["update_type"] = "inserted"
+		}
+		data["entries"] = []qlogTableEntry{{eventData.Index, eventData.HeaderField.name, eventData.HeaderField.value}}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	if j.referenceTime.IsZero() {
+		j.referenceTime = event.Time
+		header := qlogHeader{QlogVersion: "0.3", QlogFormat: "JSON-SEQ"}
+		header.Trace.VantagePoint.Type = j.vantagePoint
+		header.Trace.CommonFields.TimeFormat = "relative"
+		header.Trace.CommonFields.ReferenceTime = milliseconds(time.Duration(event.Time.UnixNano()))
+		encoder.Encode(header)
+	}
+	encoder.Encode(qlogEvent{Time: milliseconds(event.Time.Sub(j.referenceTime)), Name: event.Name, Data: data})
+	j.w.Write(buf.Bytes())
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	events []Event
+}
+
+func (r *eventRecorder) LogEvent(event Event) {
+	r.events = append(r.events, event)
+}
+
+// summary describes the events other than frames in a compact form.
+func (r *eventRecorder) summary() []string {
+	summary := []string{}
+	for _, event := range r.events {
+		switch data := event.Data.(type) {
+		case FrameEventData:
+			summary = append(summary, fmt.Sprintf("%s %s", event.Name, data.Frame.Type))
+		case ParametersSetEventData:
+			summary = append(summary, fmt.Sprintf("%s %s %v", event.Name, data.Owner, data.Settings))
+		case FlowControlEventData:
+			summary = append(summary, fmt.Sprintf("%s %s %d %d", event.Name, data.Owner, data.StreamID, data.Window))
+		case StreamStateEventData:
+			summary = append(summary, fmt.Sprintf("%s %d %s->%s", event.Name, data.StreamID, data.Old, data.New))
+		case DynamicTableEventData:
+			summary = append(summary, fmt.Sprintf("%s %s %t %d %s", event.Name, data.Owner, data.Inserted, data.Index, data.HeaderField))
+		}
+	}
+	return summary
+}
+
+func TestConnectionEvents(t *testing.T) {
+	client, server := NewFrameHandler(), NewFrameHandler()
+	clientEvents, serverEvents := &eventRecorder{}, &eventRecorder{}
+	client.SetEventSink(clientEvents)
+	server.SetEventSink(serverEvents)
+	// A small table to see evictions.
+	client.encoder.SetMaxDynamicTableSize(100)
+	server.decoder.(*hPackDecoder).table.setMaxSize(100)
+
+	buf := bytes.Buffer{}
+	frames := []Frame{
+		{Type: SettingFrameType, Data: SettingFrame{Params: map[SettingParam]uint32{SettingsInitialWindowSize: 1000}}},
+		{Type: HeaderFrameType, StreamID: 1, Flags: EndHeaderFlag, Data: HeaderFrame{HeaderFields: []HeaderField{
+			{name: "custom-key", value: "custom-value-1"},
+			{name: "custom-key", value: "custom-value-2"},
+		}}},
+		{Type: DataFrameType, StreamID: 1, Flags: EndStreamFlag, Data: DataFrame{Data: make([]byte, 100)}},
+		{Type: WindowUpdateFrameType, StreamID: 0, Data: WindowUpdateFrame{WindowSizeIncrement: 100}},
+	}
+	for _, frame := range frames {
+		if _, err := client.Encode(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+		decoded := Frame{}
+		if err := server.Decode(&buf, &decoded); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The server resets the stream.
+	if _, err := server.Encode(&buf, Frame{Type: RSTStreamFrameType, StreamID: 1, Data: RSTStreamFrame{ErrorCode: Cancel}}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"http2:frame_created SETTINGS",
+		"http2:parameters_set local map[SETTINGS_INITIAL_WINDOW_SIZE:1000]",
+		"hpack:dynamic_table_updated local true 62 custom-key: custom-value-1",
+		"hpack:dynamic_table_updated local false 62 custom-key: custom-value-1",
+		"hpack:dynamic_table_updated local true 62 custom-key: custom-value-2",
+		"http2:frame_created HEADERS",
+		"http2:stream_state_updated 1 idle->open",
+		"http2:frame_created DATA",
+		"http2:flow_control_updated remote 0 65435",
+		"http2:flow_control_updated remote 1 65435",
+		"http2:stream_state_updated 1 open->half_closed_local",
+		"http2:frame_created WINDOW_UPDATE",
+		"http2:flow_control_updated local 0 65635",
+	}
+	checkSummary(t, expected, clientEvents.summary())
+
+	expected = []string{
+		"http2:frame_parsed SETTINGS",
+		"http2:parameters_set remote map[SETTINGS_INITIAL_WINDOW_SIZE:1000]",
+		"hpack:dynamic_table_updated remote true 62 custom-key: custom-value-1",
+		"hpack:dynamic_table_updated remote false 62 custom-key: custom-value-1",
+		"hpack:dynamic_table_updated remote true 62 custom-key: custom-value-2",
+		"http2:frame_parsed HEADERS",
+		"http2:stream_state_updated 1 idle->open",
+		"http2:frame_parsed DATA",
+		"http2:flow_control_updated local 0 65435",
+		"http2:flow_control_updated local 1 65435",
+		"http2:stream_state_updated 1 open->half_closed_remote",
+		"http2:frame_parsed WINDOW_UPDATE",
+		"http2:flow_control_updated remote 0 65635",
+		"http2:frame_created RST_STREAM",
+		"http2:stream_state_updated 1 half_closed_remote->closed",
+	}
+	checkSummary(t, expected, serverEvents.summary())
+}
+
+func checkSummary(t *testing.T, expected, summary []string) {
+	t.Helper()
+	if strings.Join(summary, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(summary, "\n"))
+	}
+}
+
+func TestInitialWindowSizeEvents(t *testing.T) {
+	handler := NewFrameHandler()
+	events := &eventRecorder{}
+	handler.SetEventSink(events)
+
+	buf := bytes.Buffer{}
+	if _, err := handler.Encode(&buf, Frame{Type: HeaderFrameType, StreamID: 1, Flags: EndHeaderFlag, Data: HeaderFrame{}}); err != nil {
+		t.Fatal(err)
+	}
+	// Received SETTINGS change the windows we can send on.
+	settings := encodeFrames(t, Frame{Type: SettingFrameType, Data: SettingFrame{Params: map[SettingParam]uint32{SettingsInitialWindowSize: 535}}})
+	if err := handler.Decode(bytes.NewReader(settings), &Frame{}); err != nil {
+		t.Fatal(err)
+	}
+	summary := events.summary()
+	if last := summary[len(summary)-1]; last != "http2:flow_control_updated remote 1 535" {
+		t.Errorf("expected the stream window to shrink got %s", last)
+	}
+}
+
+func TestJSONEventWriter(t *testing.T) {
+	out := bytes.Buffer{}
+	writer := NewJSONEventWriter(&out, "client")
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	writer.LogEvent(Event{Time: start, Name: EventStreamStateUpdated, Data: StreamStateEventData{StreamID: 1, Old: StateIdle, New: StateOpen}})
+	writer.LogEvent(Event{Time: start.Add(1500 * time.Microsecond), Name: EventDynamicTableUpdate, Data: DynamicTableEventData{
+		Owner: OwnerRemote, Inserted: true, Index: 62, HeaderField: HeaderField{name: "custom-key", value: "custom-value"},
+	}})
+	writer.LogEvent(Event{Time: start.Add(2 * time.Millisecond), Name: EventFrameParsed, Data: FrameEventData{Frame: Frame{
+		Type: PingFrameType, Length: 8, Data: PingFrame{},
+	}}})
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	expected := []string{
+		`{"qlog_version":"0.3","qlog_format":"JSON-SEQ","trace":{"vantage_point":{"type":"client"},"common_fields":{"time_format":"relative","reference_time":1792324800000}}}`,
+		`{"time":0,"name":"http2:stream_state_updated","data":{"new":"open","old":"idle","stream_id":1}}`,
+		`{"time":1.5,"name":"hpack:dynamic_table_updated","data":{"entries":[{"index":62,"name":"custom-key","value":"custom-value"}],"owner":"remote","update_type":"inserted"}}`,
+		`{"time":2,"name":"http2:frame_parsed","data":{"frame":{"type":"PING","flags":[],"stream_id":0,"length":8,"opaque_data":"0000000000000000"},"stream_id":0}}`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines got %d:\n%s", len(expected), len(lines), out.String())
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], lines[i])
+		}
+		if !json.Valid([]byte(lines[i])) {
+			t.Errorf("invalid JSON %s", lines[i])
+		}
+	}
+}
+
+// countingSink counts events from any goroutine.
+type countingSink struct {
+	mu     sync.Mutex
+	events map[string]int
+}
+
+func (s *countingSink) LogEvent(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events == nil {
+		s.events = map[string]int{}
+	}
+	s.events[event.Name]++
+}
+
+func TestConnectionEventsConcurrentStreams(t *testing.T) {
+	serverSink := &countingSink{}
+	url, _ := newTestH2CServer(t, &Server{
+		EventSink: serverSink,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		}),
+	})
+	clientSink := &countingSink{}
+	cc, err := DialClientConnH2C(context.Background(), "tcp", strings.TrimPrefix(url, "http://"), &ClientConnConfig{EventSink: clientSink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		// Each stream sends and receives while the others do.
+		go func() {
+			resp, err := cc.RoundTrip(context.Background(), &ClientRequest{
+				Header: NewRequestHeader("POST", "http", "example.com", "/"),
+				Body:   bytes.NewReader(bytes.Repeat([]byte("x"), 1<<20)),
+			})
+			if err == nil {
+				_, err = io.Copy(io.Discard, resp.Body)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sink := range []*countingSink{clientSink, serverSink} {
+		sink.mu.Lock()
+		if opened := sink.events[EventStreamStateUpdated]; opened < 2*n {
+			t.Errorf("expected stream state events for %d streams got %d", n, opened)
+		}
+		sink.mu.Unlock()
+	}
+}
@@ -2,28 +2,38 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 )
 
 var (
-	ErrProtocol = errors.New("protocol error")
+	ErrProtocol            = errors.New("protocol error")
+	ErrFrameSize           = errors.New("frame size error")
+	ErrHeaderBlockTooLarge = errors.New("header block too large")
 )
 
 type (
 	FrameType    uint8
 	FlagType     uint8
 	SettingParam uint16
+	ErrCode      uint32
 )
 
 const (
 	DataFrameType         FrameType = 0x00
 	HeaderFrameType       FrameType = 0x01
+	PriorityFrameType     FrameType = 0x02
+	RSTStreamFrameType    FrameType = 0x03
 	SettingFrameType      FrameType = 0x04
+	PushPromiseFrameType  FrameType = 0x05
+	PingFrameType         FrameType = 0x06
+	GoAwayFrameType       FrameType = 0x07
 	WindowUpdateFrameType FrameType = 0x08
+	ContinuationFrameType FrameType = 0x09
+	OriginFrameType       FrameType = 0x0c
 
 	UnsetFlag     FlagType = 0x00
 	AckFlag       FlagType = 0x01
@@ -38,8 +48,134 @@ const (
 	SettingsInitialWindowSize    SettingParam = 4 // 65,535
 	SettingsMaxFrameSize         SettingParam = 5 // 16,384
 	SettingsMaxHeaderListSize    SettingParam = 6 // unlimited
+
+	// Error codes of RFC 9113 section 7.
+	NoError            ErrCode = 0x0
+	ProtocolError      ErrCode = 0x1
+	InternalError      ErrCode = 0x2
+	FlowControlError   ErrCode = 0x3
+	SettingsTimeout    ErrCode = 0x4
+	StreamClosed       ErrCode = 0x5
+	FrameSizeError     ErrCode = 0x6
+	RefusedStream      ErrCode = 0x7
+	Cancel             ErrCode = 0x8
+	CompressionError   ErrCode = 0x9
+	ConnectError       ErrCode = 0xa
+	EnhanceYourCalm    ErrCode = 0xb
+	InadequateSecurity ErrCode = 0xc
+	HTTP11Required     ErrCode = 0xd
+)
+
+const (
+	// ClientPreface starts every HTTP/2 connection (RFC 9113 section 3.4).
+	ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	// frameHeaderLength is the length of the fixed frame header.
+	frameHeaderLength = 9
+	// defaultMaxFrameSize is SETTINGS_MAX_FRAME_SIZE until the peer
+	// says otherwise, maxFrameSize its upper bound.
+	defaultMaxFrameSize = 16384
+	maxFrameSize        = 1<<24 - 1
+	// maxContinuationFrames and maxHeaderBlockSize bound a header block
+	// split into CONTINUATION frames, the latter when the HPACK decoder
+	// sets no header list size limit. A peer never sending END_HEADERS
+	// would otherwise be buffered without end.
+	maxContinuationFrames = 1024
+	maxHeaderBlockSize    = 1 << 24
 )
 
+var frameTypeNames = map[FrameType]string{
+	DataFrameType:         "DATA",
+	HeaderFrameType:       "HEADERS",
+	PriorityFrameType:     "PRIORITY",
+	RSTStreamFrameType:    "RST_STREAM",
+	SettingFrameType:      "SETTINGS",
+	PushPromiseFrameType:  "PUSH_PROMISE",
+	PingFrameType:         "PING",
+	GoAwayFrameType:       "GOAWAY",
+	WindowUpdateFrameType: "WINDOW_UPDATE",
+	ContinuationFrameType: "CONTINUATION",
+	OriginFrameType:       "ORIGIN",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
+var settingParamNames = map[SettingParam]string{
+	SettingsHeaderTableSize:      "SETTINGS_HEADER_TABLE_SIZE",
+	SettingsEnablePush:           "SETTINGS_ENABLE_PUSH",
+	SettingsMaxConcurrentStreams: "SETTINGS_MAX_CONCURRENT_STREAMS",
+	SettingsInitialWindowSize:    "SETTINGS_INITIAL_WINDOW_SIZE",
+	SettingsMaxFrameSize:         "SETTINGS_MAX_FRAME_SIZE",
+	SettingsMaxHeaderListSize:    "SETTINGS_MAX_HEADER_LIST_SIZE",
+}
+
+func (p SettingParam) String() string {
+	if name, ok := settingParamNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_SETTING_%d", uint16(p))
+}
+
+var errCodeNames = map[ErrCode]string{
+	NoError:            "NO_ERROR",
+	ProtocolError:      "PROTOCOL_ERROR",
+	InternalError:      "INTERNAL_ERROR",
+	FlowControlError:   "FLOW_CONTROL_ERROR",
+	SettingsTimeout:    "SETTINGS_TIMEOUT",
+	StreamClosed:       "STREAM_CLOSED",
+	FrameSizeError:     "FRAME_SIZE_ERROR",
+	RefusedStream:      "REFUSED_STREAM",
+	Cancel:             "CANCEL",
+	CompressionError:   "COMPRESSION_ERROR",
+	ConnectError:       "CONNECT_ERROR",
+	EnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	InadequateSecurity: "INADEQUATE_SECURITY",
+	HTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_ERROR_%d", uint32(c))
+}
+
+type flagName struct {
+	flag FlagType
+	name string
+}
+
+// frameFlags are the flags defined for each frame type.
+var frameFlags = map[FrameType][]flagName{
+	DataFrameType:         {{EndStreamFlag, "END_STREAM"}, {PaddedFlag, "PADDED"}},
+	HeaderFrameType:       {{EndStreamFlag, "END_STREAM"}, {EndHeaderFlag, "END_HEADERS"}, {PaddedFlag, "PADDED"}, {PriorityFlag, "PRIORITY"}},
+	SettingFrameType:      {{AckFlag, "ACK"}},
+	PushPromiseFrameType:  {{EndHeaderFlag, "END_HEADERS"}, {PaddedFlag, "PADDED"}},
+	PingFrameType:         {{AckFlag, "ACK"}},
+	ContinuationFrameType: {{EndHeaderFlag, "END_HEADERS"}},
+}
+
+// FlagNames returns the names of the flags set, which depend on the frame
+// type. Flags not defined for the type are given by value.
+func (f Frame) FlagNames() []string {
+	names := []string{}
+	rest := f.Flags
+	for _, defined := range frameFlags[f.Type] {
+		if f.Flags&defined.flag != UnsetFlag {
+			names = append(names, defined.name)
+			rest &^= defined.flag
+		}
+	}
+	if rest != UnsetFlag {
+		names = append(names, fmt.Sprintf("0x%02x", uint8(rest)))
+	}
+	return names
+}
+
 /*
 All frames begin with a fixed 9-octet header followed by a variable-
 length payload.
@@ -60,7 +196,10 @@ type Frame struct {
 	Type     FrameType
 	Flags    FlagType
 	StreamID uint32
-	Data     any
+	// Length is the payload length of a decoded frame, including the
+	// CONTINUATION frames merged into it.
+	Length uint32
+	Data   any
 }
 
 /*
@@ -80,6 +219,33 @@ type SettingFrame struct {
 	Params map[SettingParam]uint32
 }
 
+// appendPayload appends the parameters of f to dst, in order so the
+// encoding is stable.
+func (f SettingFrame) appendPayload(dst []byte) []byte {
+	identifiers := make([]SettingParam, 0, len(f.Params))
+	for identifier := range f.Params {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Slice(identifiers, func(i, j int) bool { return identifiers[i] < identifiers[j] })
+	for _, identifier := range identifiers {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(identifier))
+		dst = binary.BigEndian.AppendUint32(dst, f.Params[identifier])
+	}
+	return dst
+}
+
+// parseSettingPayload parses the parameters of a SETTINGS payload, whose
+// length is a multiple of 6.
+func parseSettingPayload(payload []byte) SettingFrame {
+	settingFrame := SettingFrame{
+		Params: map[SettingParam]uint32{},
+	}
+	for i := 0; i+6 <= len(payload); i += 6 {
+		settingFrame.Params[SettingParam(binary.BigEndian.Uint16(payload[i:i+2]))] = binary.BigEndian.Uint32(payload[i+2 : i+6])
+	}
+	return settingFrame
+}
+
 /*
 Headers frame structure
 
@@ -96,8 +262,12 @@ Headers frame structure
 	+---------------------------------------------------------------+
 
 	Figure 7: HEADERS Frame Payload
+
+A header block split over CONTINUATION frames is decoded as a single
+HEADERS frame carrying END_HEADERS.
 */
 type HeaderFrame struct {
+	Exclusive        bool
 	StreamDependency uint32
 	PaddingLength    uint8
 	Weight           uint8
@@ -132,20 +302,216 @@ type DataFrame struct {
 	Data      []byte
 }
 
+/*
+PRIORITY frame structure
+
+	+-+-------------------------------------------------------------+
+	|E|                  Stream Dependency (31)                     |
+	+-+-------------+-----------------------------------------------+
+	|   Weight (8)  |
+	+-+-------------+
+*/
+type PriorityFrame struct {
+	Exclusive        bool
+	StreamDependency uint32
+	Weight           uint8
+}
+
+/*
+RST_STREAM frame structure
+
+	+---------------------------------------------------------------+
+	|                        Error Code (32)                        |
+	+---------------------------------------------------------------+
+*/
+type RSTStreamFrame struct {
+	ErrorCode ErrCode
+}
+
+/*
+PUSH_PROMISE frame structure
+
+	+---------------+
+	|Pad Length? (8)|
+	+-+-------------+-----------------------------------------------+
+	|R|                  Promised Stream ID (31)                    |
+	+-+-----------------------------+-------------------------------+
+	|                   Header Block Fragment (*)                 ...
+	+---------------------------------------------------------------+
+	|                           Padding (*)                       ...
+	+---------------------------------------------------------------+
+*/
+type PushPromiseFrame struct {
+	PadLength        uint8
+	PromisedStreamID uint32
+
+	HeaderFields []HeaderField
+}
+
+/*
+PING frame structure
+
+	+---------------------------------------------------------------+
+	|                                                               |
+	|                      Opaque Data (64)                         |
+	|                                                               |
+	+---------------------------------------------------------------+
+*/
+type PingFrame struct {
+	Data [8]byte
+}
+
+/*
+GOAWAY frame structure
+
+	+-+-------------------------------------------------------------+
+	|R|                  Last-Stream-ID (31)                        |
+	+-+-------------------------------------------------------------+
+	|                      Error Code (32)                          |
+	+---------------------------------------------------------------+
+	|                  Additional Debug Data (*)                    |
+	+---------------------------------------------------------------+
+*/
+type GoAwayFrame struct {
+	LastStreamID uint32
+	ErrorCode    ErrCode
+	DebugData    []byte
+}
+
+/*
+ORIGIN frame structure (RFC 8336), on stream 0 only
+
+	+-------------------------------+-------------------------------+
+	|         Origin-Len (16)       | ASCII-Origin?               ...
+	+-------------------------------+-------------------------------+
+
+The entry is repeated for each origin the server is authoritative for.
+*/
+type OriginFrame struct {
+	Origins []string
+}
+
+// UnknownFrame is the payload of a frame of an unknown type, which must be
+// ignored (RFC 9113 section 4.1).
+type UnknownFrame struct {
+	Payload []byte
+}
+
 type frameHandler struct {
 	encoder HPackEncoder
 	decoder HPackDecoder
+	// observer, if set, emits the events of the frames going through.
+	observer *connObserver
+
+	// maxReadFrameSize is the SETTINGS_MAX_FRAME_SIZE we advertised,
+	// maxWriteFrameSize the peer's.
+	maxReadFrameSize  uint32
+	maxWriteFrameSize uint32
 }
 
 func NewFrameHandler() *frameHandler {
 	return &frameHandler{
-		encoder: NewHPackEncoder(),
-		decoder: NewHPackDecoder(),
+		encoder:           NewHPackEncoder(),
+		decoder:           NewHPackDecoder(),
+		maxReadFrameSize:  defaultMaxFrameSize,
+		maxWriteFrameSize: defaultMaxFrameSize,
+	}
+}
+
+// SetMaxReadFrameSize sets the largest payload accepted, the
+// SETTINGS_MAX_FRAME_SIZE we advertise.
+func (h *frameHandler) SetMaxReadFrameSize(n uint32) {
+	h.maxReadFrameSize = n
+}
+
+// SetMaxWriteFrameSize sets the largest payload sent, the peer's
+// SETTINGS_MAX_FRAME_SIZE. Larger header blocks are split into
+// CONTINUATION frames, DATA is left to the caller.
+func (h *frameHandler) SetMaxWriteFrameSize(n uint32) {
+	h.maxWriteFrameSize = n
+}
+
+// SetEventSink emits the connection events derived from the frames, and
+// the updates of both HPACK dynamic tables, to sink. nil stops them.
+func (h *frameHandler) SetEventSink(sink EventSink) {
+	encoder, _ := h.encoder.(*hPackEncoder)
+	decoder, _ := h.decoder.(*hPackDecoder)
+	if sink == nil {
+		h.observer = nil
+		if encoder != nil {
+			encoder.table.observe = nil
+		}
+		if decoder != nil {
+			decoder.table.observe = nil
+		}
+		return
+	}
+
+	h.observer = newConnObserver(sink)
+	if encoder != nil {
+		encoder.table.observe = h.observer.tableObserver(OwnerLocal)
+	}
+	if decoder != nil {
+		decoder.table.observe = h.observer.tableObserver(OwnerRemote)
+	}
+}
+
+// appendPriority appends a stream dependency and its weight.
+func appendPriority(packet []byte, exclusive bool, streamDependency uint32, weight uint8) []byte {
+	if exclusive {
+		streamDependency |= 1 << 31
+	}
+	packet = binary.BigEndian.AppendUint32(packet, streamDependency)
+	return append(packet, weight)
+}
+
+// appendPadding appends the padding octets, which must be zero.
+func appendPadding(packet []byte, length uint8) []byte {
+	return append(packet, make([]byte, length)...)
+}
+
+func appendFrameHeader(dst []byte, length int, frameType FrameType, flags FlagType, streamID uint32) []byte {
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), byte(frameType), byte(flags))
+	return binary.BigEndian.AppendUint32(dst, streamID)
+}
+
+// splitHeaderBlock splits an encoded HEADERS or PUSH_PROMISE frame larger
+// than the peer's maximum frame size into CONTINUATION frames. prefix is
+// the length of the fields before the header block, padding the length of
+// the padding after it, both staying in the first frame.
+func (h *frameHandler) splitHeaderBlock(packet []byte, prefix, padding int) ([]byte, error) {
+	max := int(h.maxWriteFrameSize)
+	payload := packet[frameHeaderLength:]
+	block := payload[prefix : len(payload)-padding]
+	first := max - prefix - padding
+	if first <= 0 {
+		return nil, fmt.Errorf("%w: padding exceeds the maximum frame size", ErrFrameSize)
+	}
+
+	frameType, flags := FrameType(packet[3]), FlagType(packet[4])
+	streamID := binary.BigEndian.Uint32(packet[5:9])
+	split := make([]byte, 0, len(packet)+(len(block)/max+1)*frameHeaderLength)
+	split = appendFrameHeader(split, first+prefix+padding, frameType, flags&^EndHeaderFlag, streamID)
+	split = append(split, payload[:prefix]...)
+	split = append(split, block[:first]...)
+	split = append(split, payload[len(payload)-padding:]...)
+	for block = block[first:]; len(block) > 0; {
+		n, continuationFlags := max, UnsetFlag
+		if len(block) <= max {
+			n, continuationFlags = len(block), flags&EndHeaderFlag
+		}
+		split = appendFrameHeader(split, n, ContinuationFrameType, continuationFlags, streamID)
+		split = append(split, block[:n]...)
+		block = block[n:]
 	}
+	return split, nil
 }
 
 func (h *frameHandler) Encode(writer io.Writer, frame Frame) (int, error) {
-	packet := make([]byte, 9)
+	// prefix and padding locate the header block of HEADERS and
+	// PUSH_PROMISE frames, in case it has to be split.
+	var prefix, padding int
+	packet := make([]byte, frameHeaderLength)
 	packet[3] = byte(frame.Type)                           // Type (8)
 	packet[4] = byte(frame.Flags)                          // Flags (8)
 	binary.BigEndian.PutUint32(packet[5:], frame.StreamID) // StreamID (32)
@@ -157,9 +523,11 @@ func (h *frameHandler) Encode(writer io.Writer, frame Frame) (int, error) {
 			return 0, fmt.Errorf("invalid frame data")
 		}
 
-		for identifier, value := range settingFrame.Params {
-			packet = binary.BigEndian.AppendUint16(packet, uint16(identifier))
-			packet = binary.BigEndian.AppendUint32(packet, value)
+		packet = settingFrame.appendPayload(packet)
+		// The header list size we advertise is what we enforce when
+		// decoding the peer's header blocks.
+		if limit, ok := settingFrame.Params[SettingsMaxHeaderListSize]; ok && frame.Flags&AckFlag == UnsetFlag {
+			h.decoder.SetMaxHeaderListSize(limit)
 		}
 	case HeaderFrameType:
 		headerFrame, ok := frame.Data.(HeaderFrame)
@@ -171,9 +539,9 @@ func (h *frameHandler) Encode(writer io.Writer, frame Frame) (int, error) {
 			packet = append(packet, headerFrame.PaddingLength)
 		}
 		if (frame.Flags & PriorityFlag) != UnsetFlag {
-			packet = binary.BigEndian.AppendUint32(packet, headerFrame.StreamDependency)
-			packet = append(packet, headerFrame.Weight)
+			packet = appendPriority(packet, headerFrame.Exclusive, headerFrame.StreamDependency, headerFrame.Weight)
 		}
+		prefix = len(packet) - frameHeaderLength
 
 		buf := bytes.NewBuffer(packet)
 		_, err := h.encoder.Encode(buf, headerFrame.HeaderFields)
@@ -181,6 +549,62 @@ func (h *frameHandler) Encode(writer io.Writer, frame Frame) (int, error) {
 			return 0, err
 		}
 		packet = buf.Bytes()
+		if (frame.Flags & PaddedFlag) != UnsetFlag {
+			packet = appendPadding(packet, headerFrame.PaddingLength)
+			padding = int(headerFrame.PaddingLength)
+		}
+	case PriorityFrameType:
+		priorityFrame, ok := frame.Data.(PriorityFrame)
+		if !ok {
+			return 0, fmt.Errorf("invalid frame data")
+		}
+
+		packet = appendPriority(packet, priorityFrame.Exclusive, priorityFrame.StreamDependency, priorityFrame.Weight)
+	case RSTStreamFrameType:
+		rstStreamFrame, ok := frame.Data.(RSTStreamFrame)
+		if !ok {
+			return 0, fmt.Errorf("invalid frame data")
+		}
+
+		packet = binary.BigEndian.AppendUint32(packet, uint32(rstStreamFrame.ErrorCode))
+	case PushPromiseFrameType:
+		pushPromiseFrame, ok := frame.Data.(PushPromiseFrame)
+		if !ok {
+			return 0, fmt.Errorf("invalid frame data")
+		}
+
+		if (frame.Flags & PaddedFlag) != UnsetFlag {
+			packet = append(packet, pushPromiseFrame.PadLength)
+		}
+		packet = binary.BigEndian.AppendUint32(packet, pushPromiseFrame.PromisedStreamID)
+		prefix = len(packet) - frameHeaderLength
+
+		buf := bytes.NewBuffer(packet)
+		_, err := h.encoder.Encode(buf, pushPromiseFrame.HeaderFields)
+		if err != nil {
+			return 0, err
+		}
+		packet = buf.Bytes()
+		if (frame.Flags & PaddedFlag) != UnsetFlag {
+			packet = appendPadding(packet, pushPromiseFrame.PadLength)
+			padding = int(pushPromiseFrame.PadLength)
+		}
+	case PingFrameType:
+		pingFrame, ok := frame.Data.(PingFrame)
+		if !ok {
+			return 0, fmt.Errorf("invalid frame data")
+		}
+
+		packet = append(packet, pingFrame.Data[:]...)
+	case GoAwayFrameType:
+		goAwayFrame, ok := frame.Data.(GoAwayFrame)
+		if !ok {
+			return 0, fmt.Errorf("invalid frame data")
+		}
+
+		packet = binary.BigEndian.AppendUint32(packet, goAwayFrame.LastStreamID)
+		packet = binary.BigEndian.AppendUint32(packet, uint32(goAwayFrame.ErrorCode))
+		packet = append(packet, goAwayFrame.DebugData...)
 	case WindowUpdateFrameType:
 		windowUpdateFrame, ok := frame.Data.(WindowUpdateFrame)
 		if !ok {
@@ -188,6 +612,16 @@ func (h *frameHandler) Encode(writer io.Writer, frame Frame) (int, error) {
 		}
 
 		packet = binary.BigEndian.AppendUint32(packet, windowUpdateFrame.WindowSizeIncrement)
+	case OriginFrameType:
+		originFrame, ok := frame.Data.(OriginFrame)
+		if !ok {
+			return 0, fmt.Errorf("invalid frame data")
+		}
+
+		for _, origin := range originFrame.Origins {
+			packet = binary.BigEndian.AppendUint16(packet, uint16(len(origin)))
+			packet = append(packet, origin...)
+		}
 	case DataFrameType:
 		dataFrame, ok := frame.Data.(DataFrame)
 		if !ok {
@@ -199,101 +633,269 @@ func (h *frameHandler) Encode(writer io.Writer, frame Frame) (int, error) {
 		packet = append(packet, dataFrame.Data...)
 
 		if (frame.Flags & PaddedFlag) != 0 {
-			paddingData := make([]byte, dataFrame.PadLength)
-			_, err := rand.Read(paddingData)
-			if err != nil {
-				return 0, err
-			}
-			packet = append(packet, paddingData...)
+			packet = appendPadding(packet, dataFrame.PadLength)
 		}
 	default:
 		return 0, fmt.Errorf("invalid frame type")
 	}
 
-	frameLength := len(packet) - 9
+	frameLength := len(packet) - frameHeaderLength
 	packet[0] = byte((frameLength >> 16) & 0xFF)
 	packet[1] = byte((frameLength >> 8) & 0xFF)
 	packet[2] = byte(frameLength & 0xFF)
-	return writer.Write(packet)
+	if frameLength > int(h.maxWriteFrameSize) {
+		if frame.Type != HeaderFrameType && frame.Type != PushPromiseFrameType {
+			return 0, fmt.Errorf("%w: %s frame of length %d exceeds %d", ErrFrameSize, frame.Type, frameLength, h.maxWriteFrameSize)
+		}
+		var err error
+		if packet, err = h.splitHeaderBlock(packet, prefix, padding); err != nil {
+			return 0, err
+		}
+	}
+	n, err := writer.Write(packet)
+	if err == nil && h.observer != nil {
+		frame.Length = uint32(frameLength)
+		h.observer.frame(true, frame)
+	}
+	return n, err
 }
 
-func (h *frameHandler) Decode(reader io.Reader, frame *Frame) error {
-	packet := make([]byte, 9)
-	n, err := reader.Read(packet[:9])
-	if err != nil {
-		return err
+// readFrame reads the header and the payload of the next frame.
+func (h *frameHandler) readFrame(reader io.Reader, frame *Frame) ([]byte, error) {
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated frame header", ErrFrameSize)
+		}
+		return nil, err
+	}
+
+	frame.Length = uint32(uint32(header[0])<<16) + (uint32(header[1]) << 8) + uint32(header[2])
+	frame.Type = FrameType(header[3])
+	frame.Flags = FlagType(header[4])
+	frame.StreamID = binary.BigEndian.Uint32(header[5:9]) & (1<<31 - 1)
+	if frame.Length > h.maxReadFrameSize {
+		return nil, fmt.Errorf("%w: %s frame of length %d exceeds %d", ErrFrameSize, frame.Type, frame.Length, h.maxReadFrameSize)
+	}
+
+	payload := make([]byte, int(frame.Length))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated %s frame", ErrFrameSize, frame.Type)
+		}
+		return nil, err
 	}
-	if n != 9 {
-		return fmt.Errorf("invalid packet header")
+	return payload, nil
+}
+
+// removePadding strips the Pad Length field and the padding of a payload.
+func removePadding(frame *Frame, payload []byte) ([]byte, uint8, error) {
+	if frame.Flags&PaddedFlag == UnsetFlag {
+		return payload, 0, nil
+	}
+	if len(payload) == 0 {
+		return nil, 0, fmt.Errorf("%w: missing Pad Length in %s frame", ErrFrameSize, frame.Type)
+	}
+	padLength := payload[0]
+	if int(padLength) >= len(payload) {
+		return nil, 0, fmt.Errorf("%w: padding exceeds %s frame payload", ErrProtocol, frame.Type)
+	}
+	return payload[1 : len(payload)-int(padLength)], padLength, nil
+}
+
+// readContinuations appends the CONTINUATION frames of a header block to
+// fragment, up to the one carrying END_HEADERS.
+func (h *frameHandler) readContinuations(reader io.Reader, frame *Frame, fragment []byte) ([]byte, error) {
+	limit := h.headerBlockLimit()
+	for n := 0; frame.Flags&EndHeaderFlag == UnsetFlag; n++ {
+		continuation := Frame{}
+		payload, err := h.readFrame(reader, &continuation)
+		if err != nil {
+			return nil, err
+		}
+		if continuation.Type != ContinuationFrameType || continuation.StreamID != frame.StreamID {
+			return nil, fmt.Errorf("%w: %s frame on stream %d while expecting CONTINUATION on stream %d", ErrProtocol, continuation.Type, continuation.StreamID, frame.StreamID)
+		}
+		if n >= maxContinuationFrames || uint64(len(fragment))+uint64(len(payload)) > limit {
+			return nil, fmt.Errorf("%w: more than %d CONTINUATION frames or %d octets on stream %d", ErrHeaderBlockTooLarge, maxContinuationFrames, limit, frame.StreamID)
+		}
+		fragment = append(fragment, payload...)
+		frame.Length += continuation.Length
+		frame.Flags |= continuation.Flags & EndHeaderFlag
+	}
+	return fragment, nil
+}
+
+// headerBlockLimit returns the largest encoded header block read. A
+// Huffman code is at most 30 bits long, so that a block within the header
+// list size limit of the decoder is less than 4 times that size.
+func (h *frameHandler) headerBlockLimit() uint64 {
+	if decoder, ok := h.decoder.(*hPackDecoder); ok && decoder.maxHeaderListSize != 0 {
+		// The length of the frame must hold in 32 bits.
+		if limit := 4*uint64(decoder.maxHeaderListSize) + uint64(h.maxReadFrameSize); limit < 1<<31 {
+			return limit
+		}
+		return 1 << 31
 	}
+	return maxHeaderBlockSize
+}
 
-	frameLength := uint32(uint32(packet[0])<<16) + (uint32(packet[1]) << 8) + uint32(packet[2])
-	frame.Type = FrameType(packet[3])
-	frame.StreamID = binary.BigEndian.Uint32(packet[5:9])
-	frame.Flags = FlagType(packet[4])
-	// Resize packet size
-	packet = make([]byte, int(frameLength))
-	_, err = reader.Read(packet)
+func (h *frameHandler) Decode(reader io.Reader, frame *Frame) error {
+	err := h.decode(reader, frame)
+	if h.observer != nil && frame.Data != nil && (err == nil || errors.Is(err, ErrHeaderListTooLarge)) {
+		h.observer.frame(false, *frame)
+	}
+	return err
+}
+
+func (h *frameHandler) decode(reader io.Reader, frame *Frame) error {
+	packet, err := h.readFrame(reader, frame)
 	if err != nil {
 		return err
 	}
+	frameLength := frame.Length
 
 	switch frame.Type {
 	case SettingFrameType:
-		settingFrame := SettingFrame{
-			Params: map[SettingParam]uint32{},
+		if frame.StreamID != 0 {
+			return fmt.Errorf("%w: SETTINGS frame on stream %d", ErrProtocol, frame.StreamID)
 		}
-		for i := 0; i < int(frameLength); i += 6 {
-			settingFrame.Params[SettingParam(binary.BigEndian.Uint16(packet[i:i+2]))] = binary.BigEndian.Uint32(packet[i+2 : i+6])
+		if frameLength%6 != 0 || (frame.Flags&AckFlag != UnsetFlag && frameLength != 0) {
+			return fmt.Errorf("%w: SETTINGS frame of length %d", ErrFrameSize, frameLength)
 		}
-		frame.Data = settingFrame
+		frame.Data = parseSettingPayload(packet[:frameLength])
 		return nil
 	case HeaderFrameType:
 		headerFrame := HeaderFrame{}
-		base := 0
-		if frame.Flags&PaddedFlag != UnsetFlag {
-			headerFrame.PaddingLength = uint8(packet[0])
-			base++
+		fragment, padLength, err := removePadding(frame, packet)
+		if err != nil {
+			return err
 		}
+		headerFrame.PaddingLength = padLength
 		if frame.Flags&PriorityFlag != UnsetFlag {
-			headerFrame.StreamDependency = binary.BigEndian.Uint32(packet[base:4])
-			headerFrame.Weight = uint8(packet[base+4])
-			base += 5
+			if len(fragment) < 5 {
+				return fmt.Errorf("%w: HEADERS frame too short for priority", ErrFrameSize)
+			}
+			dependency := binary.BigEndian.Uint32(fragment[:4])
+			headerFrame.Exclusive = dependency&(1<<31) != 0
+			headerFrame.StreamDependency = dependency & (1<<31 - 1)
+			headerFrame.Weight = uint8(fragment[4])
+			fragment = fragment[5:]
 		}
-
-		if err := h.decoder.Decode(bytes.NewBuffer(packet[base:]), &headerFrame.HeaderFields); err != nil {
+		if fragment, err = h.readContinuations(reader, frame, fragment); err != nil {
 			return err
 		}
 
-		// if headerFrame.PaddingLength != 0 {
-		// 	n, err := reader.Read(packet[:headerFrame.PaddingLength])
-		// 	if err != nil {
-		// 		return err
-		// 	}
-		// 	if n != int(headerFrame.PaddingLength) {
-		// 		return fmt.Errorf("not enough padding")
-		// 	}
-		// }
+		if err := h.decoder.Decode(bytes.NewBuffer(fragment), &headerFrame.HeaderFields); err != nil {
+			if errors.Is(err, ErrHeaderListTooLarge) {
+				// The frame is still returned, so that the stream
+				// can be refused while the connection stays usable.
+				frame.Data = headerFrame
+			}
+			return err
+		}
 
 		frame.Data = headerFrame
 		return nil
+	case PriorityFrameType:
+		if frameLength != 5 {
+			return fmt.Errorf("%w: PRIORITY frame of length %d", ErrFrameSize, frameLength)
+		}
+		dependency := binary.BigEndian.Uint32(packet[:4])
+		frame.Data = PriorityFrame{
+			Exclusive:        dependency&(1<<31) != 0,
+			StreamDependency: dependency & (1<<31 - 1),
+			Weight:           packet[4],
+		}
+		return nil
+	case RSTStreamFrameType:
+		if frameLength != 4 {
+			return fmt.Errorf("%w: RST_STREAM frame of length %d", ErrFrameSize, frameLength)
+		}
+		frame.Data = RSTStreamFrame{ErrorCode: ErrCode(binary.BigEndian.Uint32(packet))}
+		return nil
+	case PushPromiseFrameType:
+		pushPromiseFrame := PushPromiseFrame{}
+		fragment, padLength, err := removePadding(frame, packet)
+		if err != nil {
+			return err
+		}
+		if len(fragment) < 4 {
+			return fmt.Errorf("%w: PUSH_PROMISE frame too short", ErrFrameSize)
+		}
+		pushPromiseFrame.PadLength = padLength
+		pushPromiseFrame.PromisedStreamID = binary.BigEndian.Uint32(fragment[:4]) & (1<<31 - 1)
+		if fragment, err = h.readContinuations(reader, frame, fragment[4:]); err != nil {
+			return err
+		}
+
+		if err := h.decoder.Decode(bytes.NewBuffer(fragment), &pushPromiseFrame.HeaderFields); err != nil {
+			if errors.Is(err, ErrHeaderListTooLarge) {
+				frame.Data = pushPromiseFrame
+			}
+			return err
+		}
+		frame.Data = pushPromiseFrame
+		return nil
+	case PingFrameType:
+		if frameLength != 8 {
+			return fmt.Errorf("%w: PING frame of length %d", ErrFrameSize, frameLength)
+		}
+		pingFrame := PingFrame{}
+		copy(pingFrame.Data[:], packet)
+		frame.Data = pingFrame
+		return nil
+	case GoAwayFrameType:
+		if frameLength < 8 {
+			return fmt.Errorf("%w: GOAWAY frame of length %d", ErrFrameSize, frameLength)
+		}
+		frame.Data = GoAwayFrame{
+			LastStreamID: binary.BigEndian.Uint32(packet[:4]) & (1<<31 - 1),
+			ErrorCode:    ErrCode(binary.BigEndian.Uint32(packet[4:8])),
+			DebugData:    packet[8:],
+		}
+		return nil
 	case WindowUpdateFrameType:
+		if frameLength != 4 {
+			return fmt.Errorf("%w: WINDOW_UPDATE frame of length %d", ErrFrameSize, frameLength)
+		}
 		windowUpdateFrame := WindowUpdateFrame{
-			WindowSizeIncrement: binary.BigEndian.Uint32(packet[:4]),
+			WindowSizeIncrement: binary.BigEndian.Uint32(packet[:4]) & (1<<31 - 1),
 		}
 
 		frame.Data = windowUpdateFrame
 		return nil
 	case DataFrameType:
 		dataFrame := DataFrame{}
-		if (frame.Flags & PaddedFlag) != 0 {
-			dataFrame.PadLength = uint8(packet[0])
-			dataFrame.Data = append(dataFrame.Data, packet[1:frameLength-uint32(dataFrame.PadLength)-1]...)
+		data, padLength, err := removePadding(frame, packet)
+		if err != nil {
+			return err
 		}
-		dataFrame.Data = append(dataFrame.Data, packet...)
+		dataFrame.PadLength = padLength
+		dataFrame.Data = data
 		frame.Data = dataFrame
 		return nil
+	case OriginFrameType:
+		// ORIGIN frames on other streams, or malformed, are ignored (RFC
+		// 8336 section 2.1).
+		originFrame := OriginFrame{}
+		for rest := packet; frame.StreamID == 0 && len(rest) > 0; {
+			if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+				originFrame.Origins = nil
+				break
+			}
+			n := 2 + int(binary.BigEndian.Uint16(rest))
+			originFrame.Origins = append(originFrame.Origins, string(rest[2:n]))
+			rest = rest[n:]
+		}
+		frame.Data = originFrame
+		return nil
+	case ContinuationFrameType:
+		// CONTINUATION frames are consumed with the HEADERS or
+		// PUSH_PROMISE frame they belong to.
+		return fmt.Errorf("%w: unexpected CONTINUATION frame on stream %d", ErrProtocol, frame.StreamID)
 	default:
-		return fmt.Errorf("unknown frame type")
+		frame.Data = UnknownFrame{Payload: packet}
+		return nil
 	}
 }
@@ -2,17 +2,22 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
 func TestEncodeSettingFrame(t *testing.T) {
+	// Parameters are encoded in identifier order.
 	expected := []byte{
 		0x00, 0x00, 0x12, 0x04,
 		0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x03, 0x00,
-		0x00, 0x00, 0x64, 0x00,
-		0x04, 0x02, 0x00, 0x00,
 		0x00, 0x00, 0x02, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x03, 0x00, 0x00, 0x00,
+		0x64, 0x00, 0x04, 0x02,
 		0x00, 0x00, 0x00,
 	}
 	frame := Frame{
@@ -109,10 +114,10 @@ func TestEncodeHeaderFrame(t *testing.T) {
 			Weight:           0,
 
 			HeaderFields: []HeaderField{
-				{name: ":method:", value: "GET"},
-				{name: ":path:", value: "/"},
-				{name: ":scheme:", value: "https"},
-				{name: ":authority:", value: "localhost"},
+				{name: ":method", value: "GET"},
+				{name: ":path", value: "/"},
+				{name: ":scheme", value: "https"},
+				{name: ":authority", value: "localhost"},
 				{name: "user-agent", value: "curl/7.85.0"},
 				{name: "accept", value: "*/*"},
 			},
@@ -142,10 +147,10 @@ func TestDecodeHeaderFrame(t *testing.T) {
 			Weight:           0,
 
 			HeaderFields: []HeaderField{
-				{name: ":method:", value: "GET"},
-				{name: ":path:", value: "/"},
-				{name: ":scheme:", value: "https"},
-				{name: ":authority:", value: "localhost"},
+				{name: ":method", value: "GET"},
+				{name: ":path", value: "/"},
+				{name: ":scheme", value: "https"},
+				{name: ":authority", value: "localhost"},
 				{name: "user-agent", value: "curl/7.85.0"},
 				{name: "accept", value: "*/*"},
 			},
@@ -310,3 +315,212 @@ func TestDecodeDataFrame(t *testing.T) {
 		t.Errorf("expected data: %v got %v", expectedFrame.Data.(DataFrame).Data, frame.Data.(DataFrame).Data)
 	}
 }
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Type: PriorityFrameType, StreamID: 3, Data: PriorityFrame{Exclusive: true, StreamDependency: 1, Weight: 15}},
+		{Type: RSTStreamFrameType, StreamID: 3, Data: RSTStreamFrame{ErrorCode: Cancel}},
+		{Type: PingFrameType, Flags: AckFlag, Data: PingFrame{Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{Type: GoAwayFrameType, Data: GoAwayFrame{LastStreamID: 7, ErrorCode: EnhanceYourCalm, DebugData: []byte("calm down")}},
+		{Type: DataFrameType, StreamID: 1, Flags: PaddedFlag, Data: DataFrame{PadLength: 4, Data: []byte("padded")}},
+		{Type: HeaderFrameType, StreamID: 5, Flags: EndHeaderFlag | PaddedFlag | PriorityFlag, Data: HeaderFrame{
+			Exclusive: true, StreamDependency: 3, Weight: 255, PaddingLength: 2,
+			HeaderFields: []HeaderField{{name: ":status", value: "200"}},
+		}},
+		{Type: PushPromiseFrameType, StreamID: 1, Flags: EndHeaderFlag, Data: PushPromiseFrame{
+			PromisedStreamID: 2,
+			HeaderFields:     []HeaderField{{name: ":path", value: "/style.css"}},
+		}},
+		{Type: OriginFrameType, Data: OriginFrame{Origins: []string{"https://a.example.com", "https://b.example.com"}}},
+	}
+
+	buf := bytes.Buffer{}
+	encoder := NewFrameHandler()
+	for _, frame := range frames {
+		if _, err := encoder.Encode(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoder := NewFrameHandler()
+	for _, expected := range frames {
+		frame := Frame{}
+		if err := decoder.Decode(&buf, &frame); err != nil {
+			t.Fatalf("%s: %s", expected.Type, err)
+		}
+		if frame.Type != expected.Type || frame.Flags != expected.Flags || frame.StreamID != expected.StreamID {
+			t.Errorf("expected %s flags %v on stream %d got %s flags %v on stream %d",
+				expected.Type, expected.FlagNames(), expected.StreamID, frame.Type, frame.FlagNames(), frame.StreamID)
+		}
+		if fmt.Sprint(frame.Data) != fmt.Sprint(expected.Data) {
+			t.Errorf("expected %v got %v", expected.Data, frame.Data)
+		}
+	}
+}
+
+func TestDecodeContinuation(t *testing.T) {
+	raw := []byte{
+		// HEADERS without END_HEADERS
+		0x00, 0x00, 0x02, 0x01, 0x01, 0x00, 0x00, 0x00, 0x01,
+		0x82, 0x84,
+		// CONTINUATION with END_HEADERS
+		0x00, 0x00, 0x01, 0x09, 0x04, 0x00, 0x00, 0x00, 0x01,
+		0x87,
+	}
+	frame := Frame{}
+	if err := NewFrameHandler().Decode(bytes.NewReader(raw), &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Flags != EndStreamFlag|EndHeaderFlag || frame.Length != 3 {
+		t.Errorf("expected END_STREAM|END_HEADERS and length 3 got %v and %d", frame.FlagNames(), frame.Length)
+	}
+	checkHeaderFields(t, []HeaderField{
+		{name: ":method", value: "GET"},
+		{name: ":path", value: "/"},
+		{name: ":scheme", value: "https"},
+	}, frame.Data.(HeaderFrame).HeaderFields)
+
+	// Anything but a CONTINUATION of the same stream is an error.
+	raw[len(raw)-5] = 0x03
+	if err := NewFrameHandler().Decode(bytes.NewReader(raw), &frame); !errors.Is(err, ErrProtocol) {
+		t.Errorf("expected %s got %v", ErrProtocol, err)
+	}
+}
+
+// continuationFlood is a HEADERS frame without END_HEADERS followed by
+// endless CONTINUATION frames of size octets.
+type continuationFlood struct {
+	size    int
+	pending []byte
+	frames  int
+}
+
+func (f *continuationFlood) Read(p []byte) (int, error) {
+	if len(f.pending) == 0 {
+		frameType := ContinuationFrameType
+		if f.frames == 0 {
+			frameType = HeaderFrameType
+		}
+		f.frames++
+		f.pending = appendFrameHeader(nil, f.size, frameType, UnsetFlag, 1)
+		f.pending = append(f.pending, make([]byte, f.size)...)
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func TestDecodeContinuationFlood(t *testing.T) {
+	for _, size := range []int{0, defaultMaxFrameSize} {
+		flood := &continuationFlood{size: size}
+		frame := Frame{}
+		if err := NewFrameHandler().Decode(flood, &frame); !errors.Is(err, ErrHeaderBlockTooLarge) {
+			t.Errorf("%d octets: expected %s got %v", size, ErrHeaderBlockTooLarge, err)
+		}
+		// The HEADERS, the CONTINUATION frames allowed, and the first beyond.
+		if flood.frames > maxContinuationFrames+2 {
+			t.Errorf("%d octets: read %d frames", size, flood.frames)
+		}
+		if connErr := connectionError(ErrHeaderBlockTooLarge); connErr.Code != EnhanceYourCalm {
+			t.Errorf("expected ENHANCE_YOUR_CALM got %s", connErr.Code)
+		}
+	}
+}
+
+func TestDecodeFrameErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{"truncated header", []byte{0x00, 0x00, 0x04, 0x08}, ErrFrameSize},
+		{"truncated payload", []byte{0x00, 0x00, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7f}, ErrFrameSize},
+		{"padding too long", []byte{0x00, 0x00, 0x02, 0x00, 0x08, 0x00, 0x00, 0x00, 0x01, 0x02, 0x00}, ErrProtocol},
+		{"SETTINGS length", []byte{0x00, 0x00, 0x01, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, ErrFrameSize},
+		{"SETTINGS ACK with payload", []byte{0x00, 0x00, 0x06, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}, ErrFrameSize},
+		{"PING length", []byte{0x00, 0x00, 0x01, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, ErrFrameSize},
+		{"lone CONTINUATION", []byte{0x00, 0x00, 0x00, 0x09, 0x04, 0x00, 0x00, 0x00, 0x01}, ErrProtocol},
+		{"above SETTINGS_MAX_FRAME_SIZE", []byte{0x00, 0x40, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, ErrFrameSize},
+	} {
+		frame := Frame{}
+		if err := NewFrameHandler().Decode(bytes.NewReader(test.raw), &frame); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %s got %v", test.name, test.err, err)
+		}
+	}
+
+	// Frames of unknown types are returned for the caller to ignore.
+	frame := Frame{}
+	if err := NewFrameHandler().Decode(bytes.NewReader([]byte{0x00, 0x00, 0x01, 0xfa, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2a}), &frame); err != nil {
+		t.Fatal(err)
+	}
+	if unknown, ok := frame.Data.(UnknownFrame); !ok || !bytes.Equal(unknown.Payload, []byte{0x2a}) {
+		t.Errorf("expected an unknown frame got %v", frame.Data)
+	}
+
+	// Malformed ORIGIN frames, or on a stream, are ignored.
+	for _, raw := range [][]byte{
+		{0x00, 0x00, 0x03, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x61},
+		{0x00, 0x00, 0x03, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x61},
+	} {
+		frame := Frame{}
+		if err := NewFrameHandler().Decode(bytes.NewReader(raw), &frame); err != nil {
+			t.Fatal(err)
+		}
+		if origin, ok := frame.Data.(OriginFrame); !ok || origin.Origins != nil {
+			t.Errorf("expected an empty ORIGIN frame got %v", frame.Data)
+		}
+	}
+}
+
+func TestEncodeSplitsHeaderBlock(t *testing.T) {
+	encoder := NewFrameHandler()
+	encoder.SetMaxWriteFrameSize(16)
+	headerFields := NewRequestHeader("GET", "https", "example.com", "/a/rather/long/path/to/split").
+		Add("user-agent", "a user agent longer than a frame").
+		HeaderFields()
+	frame := Frame{
+		Type:     HeaderFrameType,
+		Flags:    EndStreamFlag | EndHeaderFlag | PaddedFlag,
+		StreamID: 3,
+		Data:     HeaderFrame{PaddingLength: 2, HeaderFields: headerFields},
+	}
+	buf := bytes.Buffer{}
+	if _, err := encoder.Encode(&buf, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every frame fits, and only the last one ends the header block.
+	raw := buf.Bytes()
+	for rest := raw; len(rest) > 0; {
+		length := int(rest[0])<<16 | int(rest[1])<<8 | int(rest[2])
+		last := len(rest) == frameHeaderLength+length
+		if length > 16 || (FlagType(rest[4])&EndHeaderFlag != UnsetFlag) != last {
+			t.Fatalf("unexpected frame header % x", rest[:frameHeaderLength])
+		}
+		rest = rest[frameHeaderLength+length:]
+	}
+
+	decoded := Frame{}
+	if err := NewFrameHandler().Decode(bytes.NewReader(raw), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Flags != frame.Flags || !reflect.DeepEqual(decoded.Data, frame.Data) {
+		t.Errorf("expected %v got %v", frame, decoded)
+	}
+
+	// Frames other than HEADERS and PUSH_PROMISE are not split.
+	frame = Frame{Type: DataFrameType, StreamID: 3, Data: DataFrame{Data: make([]byte, 17)}}
+	if _, err := encoder.Encode(&buf, frame); !errors.Is(err, ErrFrameSize) {
+		t.Errorf("expected %s got %v", ErrFrameSize, err)
+	}
+}
+
+func TestFlagNames(t *testing.T) {
+	frame := Frame{Type: HeaderFrameType, Flags: EndStreamFlag | EndHeaderFlag | 0x40}
+	if names := strings.Join(frame.FlagNames(), "|"); names != "END_STREAM|END_HEADERS|0x40" {
+		t.Errorf("unexpected flag names %s", names)
+	}
+	frame = Frame{Type: SettingFrameType, Flags: AckFlag}
+	if names := strings.Join(frame.FlagNames(), "|"); names != "ACK" {
+		t.Errorf("unexpected flag names %s", names)
+	}
+}
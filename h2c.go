@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrH2CUpgradeRefused = errors.New("h2c upgrade refused")
+)
+
+/*
+HTTP/2 over cleartext TCP, h2c, with prior knowledge (RFC 9113 section
+3.3): the client sends the connection preface right after connecting.
+
+	PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n
+
+The preface reads as an HTTP/1.1 request line with the PRI method, which a
+server sniffs to serve both protocols on one listener.
+
+Without prior knowledge, a client asks to switch with an HTTP/1.1 request
+(RFC 7540 section 3.2), the HTTP2-Settings field carrying the payload of
+its SETTINGS frame in base64url:
+
+	GET / HTTP/1.1
+	Host: example.com
+	Connection: Upgrade, HTTP2-Settings
+	Upgrade: h2c
+	HTTP2-Settings: <base64url encoding of HTTP/2 SETTINGS payload>
+
+A server willing to switch answers 101, then both sides send their
+connection preface and the response to the request is sent on stream 1,
+half-closed by the client.
+
+	HTTP/1.1 101 Switching Protocols
+	Connection: Upgrade
+	Upgrade: h2c
+*/
+
+// maxUpgradeBodySize bounds the body of a request the server upgrades,
+// as it has to be read before switching. Requests with larger bodies are
+// served over HTTP/1.1.
+const maxUpgradeBodySize = 64 << 10
+
+// prefaceRequestLine is the part of the client preface which tells it
+// apart from an HTTP/1.1 request.
+const prefaceRequestLine = "PRI * HTTP/2.0\r\n"
+
+// DialClientConnH2C connects to addr over cleartext h2c, with prior
+// knowledge that the server speaks HTTP/2.
+func DialClientConnH2C(ctx context.Context, network, addr string, config *ClientConnConfig) (*ClientConn, error) {
+	dialer := net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := NewClientConn(netConn, config)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// ListenAndServe listens on addr and serves h2c with prior knowledge, and
+// HTTP/1.1 to the clients which do not send the preface.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// sniffPreface reports whether conn starts with the client preface,
+// returning a connection that still reads from its first byte. It reads no
+// more than an HTTP/1.1 request line would need.
+func sniffPreface(conn net.Conn) (net.Conn, bool, error) {
+	sniffed := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	for i := 1; i <= len(prefaceRequestLine); i++ {
+		buf, err := sniffed.r.Peek(i)
+		if err != nil {
+			return nil, false, err
+		}
+		if buf[i-1] != prefaceRequestLine[i-1] {
+			return sniffed, false, nil
+		}
+	}
+	return sniffed, true, nil
+}
+
+// bufferedConn is a net.Conn read through a buffer holding the bytes
+// already sniffed.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// serveHTTP1 hands conn over to a net/http server, started on first use.
+func (s *Server) serveHTTP1(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if s.http1 == nil {
+		s.http1Conns = newConnListener()
+		s.http1 = &http.Server{Handler: http.HandlerFunc(s.serveHTTP1Request), ErrorLog: s.ErrorLog}
+		go s.http1.Serve(s.http1Conns)
+	}
+	conns := s.http1Conns
+	s.mu.Unlock()
+	conns.add(conn)
+}
+
+// connListener is a net.Listener accepting the connections added to it.
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// add queues conn to be accepted, closing it if the listener is closed.
+func (l *connListener) add(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return connListenerAddr{}
+}
+
+type connListenerAddr struct{}
+
+func (connListenerAddr) Network() string { return "h2c" }
+func (connListenerAddr) String() string  { return "h2c" }
+
+// serveHTTP1Request serves an HTTP/1.1 request, switching the connection
+// to HTTP/2 if the request asks for an h2c upgrade.
+func (s *Server) serveHTTP1Request(w http.ResponseWriter, r *http.Request) {
+	settings, ok := h2cUpgradeSettings(r)
+	if !ok || r.ContentLength < 0 || r.ContentLength > maxUpgradeBodySize {
+		s.handler().ServeHTTP(w, r)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.handler().ServeHTTP(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		s.logf("h2: h2c upgrade of %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	s.serveH2(&bufferedConn{Conn: conn, r: rw.Reader}, nil, &h2cUpgrade{req: r, body: body, settings: settings})
+}
+
+// h2cUpgradeSettings returns the settings of a request asking for an h2c
+// upgrade, false if it does not or its HTTP2-Settings are invalid.
+func h2cUpgradeSettings(r *http.Request) (map[SettingParam]uint32, bool) {
+	if !r.ProtoAtLeast(1, 1) || !headerHasToken(r.Header, "Upgrade", "h2c") ||
+		!headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Connection", "http2-settings") {
+		return nil, false
+	}
+	values := r.Header.Values("HTTP2-Settings")
+	if len(values) != 1 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil || len(payload)%6 != 0 {
+		return nil, false
+	}
+	return parseSettingPayload(payload).Params, true
+}
+
+// headerHasToken reports whether the comma-separated field name of h
+// lists token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// h2cUpgrade is an HTTP/1.1 request upgraded to h2c, with its body.
+type h2cUpgrade struct {
+	req      *http.Request
+	body     []byte
+	settings map[SettingParam]uint32
+}
+
+// serveUpgrade applies the settings of an upgrade request, as if received
+// in a SETTINGS frame, and serves the request on stream 1.
+func (sc *serverConn) serveUpgrade() error {
+	if err := sc.applySettings(sc.upgrade.settings); err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	sc.lastStreamID = 1
+	sc.mu.Unlock()
+
+	st := &serverStream{
+		sc:         sc,
+		id:         1,
+		recvWindow: serverStreamWindow,
+		recvEnd:    true,
+	}
+	st.ctx, st.cancel = context.WithCancel(sc.ctx)
+
+	req := sc.upgrade.req.Clone(st.ctx)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Close = false
+	for _, name := range []string{"Connection", "Upgrade", "Http2-Settings"} {
+		req.Header.Del(name)
+	}
+	req.Body = http.NoBody
+	req.ContentLength = int64(len(sc.upgrade.body))
+	if len(sc.upgrade.body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(sc.upgrade.body))
+	}
+	sc.startStream(st, req)
+	return nil
+}
+
+// UpgradeClientConnH2C connects to addr over cleartext HTTP/1.1 and sends
+// req asking to upgrade to h2c. Once the server switches, its response is
+// read over HTTP/2 on stream 1 and the connection is ready for more
+// requests. The request body is sent with the upgrade request, so it is
+// read in full first.
+func UpgradeClientConnH2C(ctx context.Context, network, addr string, req *ClientRequest, config *ClientConnConfig) (*ClientConn, *ClientResponse, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if closer, ok := req.Body.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.Header.Method, "http://"+req.Header.Authority+req.Header.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, hf := range req.Header.Fields {
+		httpReq.Header.Add(hf.name, hf.value)
+	}
+	settings := SettingFrame{Params: clientSettings()}
+	httpReq.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	httpReq.Header.Set("Upgrade", "h2c")
+	httpReq.Header.Set("HTTP2-Settings", base64.RawURLEncoding.EncodeToString(settings.appendPayload(nil)))
+
+	dialer := net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The HTTP/1.1 exchange is aborted once ctx is done.
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			netConn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	br := bufio.NewReader(netConn)
+	resp, err := func() (*http.Response, error) {
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+		if err := httpReq.Write(netConn); err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(br, httpReq)
+	}()
+	if err == nil && (resp.StatusCode != http.StatusSwitchingProtocols || !headerHasToken(resp.Header, "Upgrade", "h2c")) {
+		resp.Body.Close()
+		err = fmt.Errorf("%w: %s", ErrH2CUpgradeRefused, resp.Status)
+	}
+	if err != nil {
+		netConn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+
+	// The upgrade request is stream 1, half-closed once sent.
+	cc := newClientConn(&bufferedConn{Conn: netConn, r: br}, config)
+	trace := ContextClientTrace(ctx)
+	cs := &clientStream{
+		cc:         cc,
+		id:         1,
+		trace:      trace,
+		req:        req,
+		sendWindow: defaultInitialWindowSize,
+		recvWindow: clientStreamWindow,
+		sentEnd:    true,
+		respReady:  make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	cc.streams[cs.id] = cs
+	cc.nextStreamID = 3
+	cc.used = true
+	if err := cc.start(); err != nil {
+		netConn.Close()
+		return nil, nil, err
+	}
+	trace.gotConn(GotConnInfo{Conn: cc})
+	trace.wroteHeaders(WroteHeadersInfo{StreamID: cs.id})
+
+	clientResp, err := cs.awaitResponse(ctx)
+	if err != nil {
+		cc.Close()
+		return nil, nil, err
+	}
+	return cc, clientResp, nil
+}
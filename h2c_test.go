@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSniffPreface(t *testing.T) {
+	tests := []struct {
+		input string
+		h2    bool
+	}{
+		{ClientPreface, true},
+		{"GET / HTTP/1.1\r\n\r\n", false},
+		{"PUT / HTTP/1.1\r\n\r\n", false},
+		{"PRI / HTTP/1.1\r\n\r\n", false},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go io.WriteString(client, test.input)
+		sniffed, h2, err := sniffPreface(server)
+		if err != nil || h2 != test.h2 {
+			t.Errorf("%q: expected %v got %v %v", test.input, test.h2, h2, err)
+			continue
+		}
+		// The sniffed bytes are read again.
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(sniffed, buf); err != nil || string(buf) != test.input[:3] {
+			t.Errorf("%q: unexpected read %q %v", test.input, buf, err)
+		}
+		client.Close()
+	}
+}
+
+func TestServerH2C(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+	url := "http://" + listener.Addr().String() + "/"
+
+	transport := &Transport{AllowHTTP: true}
+	defer transport.CloseIdleConnections()
+	h1 := &http.Transport{}
+	defer h1.CloseIdleConnections()
+	for _, rt := range []struct {
+		transport http.RoundTripper
+		proto     string
+	}{
+		{transport, "HTTP/2.0"},
+		{h1, "HTTP/1.1"},
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		resp, err := rt.transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.Proto != rt.proto || string(body) != rt.proto {
+			t.Errorf("expected %s got %s %q %v", rt.proto, resp.Proto, body, err)
+		}
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %q %s", r.Proto, r.Method, body, r.Header.Get("Upgrade"), r.Header.Get("X-Custom"))
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	header := NewRequestHeader("POST", "http", listener.Addr().String(), "/").Add("x-custom", "value")
+	cc, resp, err := UpgradeClientConnH2C(context.Background(), "tcp", listener.Addr().String(), &ClientRequest{
+		Header: header,
+		Body:   strings.NewReader("hello"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StreamID != 1 || string(body) != `HTTP/2.0 POST hello "" value` {
+		t.Errorf("unexpected response %d %q %v", resp.StreamID, body, err)
+	}
+
+	// The connection carries the next requests.
+	resp, err = cc.RoundTrip(context.Background(), &ClientRequest{
+		Header: NewRequestHeader("GET", "http", listener.Addr().String(), "/"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = io.ReadAll(resp.Body)
+	if err != nil || resp.StreamID != 3 || string(body) != `HTTP/2.0 GET  "" ` {
+		t.Errorf("unexpected response %d %q %v", resp.StreamID, body, err)
+	}
+}
+
+func TestH2CUpgradeRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	_, _, err := UpgradeClientConnH2C(context.Background(), "tcp", addr, &ClientRequest{
+		Header: NewRequestHeader("GET", "http", addr, "/"),
+	}, nil)
+	if !errors.Is(err, ErrH2CUpgradeRefused) {
+		t.Errorf("expected %s got %v", ErrH2CUpgradeRefused, err)
+	}
+}
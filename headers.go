@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pseudo-header fields of RFC 9113 section 8.3.
+const (
+	PseudoMethod    = ":method"
+	PseudoScheme    = ":scheme"
+	PseudoAuthority = ":authority"
+	PseudoPath      = ":path"
+	PseudoStatus    = ":status"
+)
+
+var (
+	ErrMalformedHeader = errors.New("malformed header list")
+)
+
+func NewHeaderField(name, value string) HeaderField {
+	return HeaderField{name: name, value: value}
+}
+
+func (hf HeaderField) Name() string {
+	return hf.name
+}
+
+func (hf HeaderField) Value() string {
+	return hf.value
+}
+
+func (hf HeaderField) IsPseudo() bool {
+	return strings.HasPrefix(hf.name, ":")
+}
+
+func (hf HeaderField) String() string {
+	return hf.name + ": " + hf.value
+}
+
+// RequestHeader is the typed form of a request header list. The pseudo-header
+// fields are kept apart from the regular ones so they are always sent first,
+// in the order :method, :scheme, :authority, :path.
+type RequestHeader struct {
+	Method    string
+	Scheme    string
+	Authority string
+	Path      string
+
+	Fields []HeaderField
+}
+
+func NewRequestHeader(method, scheme, authority, path string) *RequestHeader {
+	return &RequestHeader{
+		Method:    method,
+		Scheme:    scheme,
+		Authority: authority,
+		Path:      path,
+	}
+}
+
+// Add appends a regular header field. Field names are lowercased as
+// required by RFC 9113 section 8.2.1.
+func (r *RequestHeader) Add(name, value string) *RequestHeader {
+	r.Fields = append(r.Fields, HeaderField{name: strings.ToLower(name), value: value})
+	return r
+}
+
+// Get returns the value of the first regular field called name.
+func (r *RequestHeader) Get(name string) string {
+	return getField(r.Fields, name)
+}
+
+// HeaderFields returns the header list to put in a HEADERS frame.
+func (r *RequestHeader) HeaderFields() []HeaderField {
+	headerFields := make([]HeaderField, 0, len(r.Fields)+4)
+	headerFields = append(headerFields, HeaderField{name: PseudoMethod, value: r.Method})
+	// CONNECT requests omit :scheme and :path (RFC 9113 section 8.5).
+	if r.Method != "CONNECT" {
+		headerFields = append(headerFields, HeaderField{name: PseudoScheme, value: r.Scheme})
+	}
+	if r.Authority != "" {
+		headerFields = append(headerFields, HeaderField{name: PseudoAuthority, value: r.Authority})
+	}
+	if r.Method != "CONNECT" {
+		headerFields = append(headerFields, HeaderField{name: PseudoPath, value: r.Path})
+	}
+	return append(headerFields, r.Fields...)
+}
+
+// ParseRequestHeader validates a received header list as a request
+// (RFC 9113 section 8.3.1) and splits it into its typed form.
+func ParseRequestHeader(headerFields []HeaderField) (*RequestHeader, error) {
+	r := &RequestHeader{}
+	seen := map[string]bool{}
+	regular := false
+	for _, hf := range headerFields {
+		if !hf.IsPseudo() {
+			if err := validateField(hf); err != nil {
+				return nil, err
+			}
+			regular = true
+			r.Fields = append(r.Fields, hf)
+			continue
+		}
+
+		if regular {
+			return nil, fmt.Errorf("%w: %s after regular fields", ErrMalformedHeader, hf.name)
+		}
+		if seen[hf.name] {
+			return nil, fmt.Errorf("%w: duplicate %s", ErrMalformedHeader, hf.name)
+		}
+		seen[hf.name] = true
+		switch hf.name {
+		case PseudoMethod:
+			r.Method = hf.value
+		case PseudoScheme:
+			r.Scheme = hf.value
+		case PseudoAuthority:
+			r.Authority = hf.value
+		case PseudoPath:
+			r.Path = hf.value
+		default:
+			return nil, fmt.Errorf("%w: unknown pseudo-header %s", ErrMalformedHeader, hf.name)
+		}
+	}
+
+	if r.Method == "" {
+		return nil, fmt.Errorf("%w: missing %s", ErrMalformedHeader, PseudoMethod)
+	}
+	if r.Method == "CONNECT" {
+		if r.Scheme != "" || r.Path != "" || r.Authority == "" {
+			return nil, fmt.Errorf("%w: invalid CONNECT request", ErrMalformedHeader)
+		}
+		return r, nil
+	}
+	if r.Scheme == "" || r.Path == "" {
+		return nil, fmt.Errorf("%w: missing %s or %s", ErrMalformedHeader, PseudoScheme, PseudoPath)
+	}
+	return r, nil
+}
+
+// ResponseHeader is the typed form of a response header list.
+type ResponseHeader struct {
+	Status int
+
+	Fields []HeaderField
+}
+
+func NewResponseHeader(status int) *ResponseHeader {
+	return &ResponseHeader{Status: status}
+}
+
+// Add appends a regular header field with a lowercased name.
+func (r *ResponseHeader) Add(name, value string) *ResponseHeader {
+	r.Fields = append(r.Fields, HeaderField{name: strings.ToLower(name), value: value})
+	return r
+}
+
+// Get returns the value of the first regular field called name.
+func (r *ResponseHeader) Get(name string) string {
+	return getField(r.Fields, name)
+}
+
+// HeaderFields returns the header list to put in a HEADERS frame.
+func (r *ResponseHeader) HeaderFields() []HeaderField {
+	headerFields := make([]HeaderField, 0, len(r.Fields)+1)
+	headerFields = append(headerFields, HeaderField{name: PseudoStatus, value: strconv.Itoa(r.Status)})
+	return append(headerFields, r.Fields...)
+}
+
+// ParseResponseHeader validates a received header list as a response
+// (RFC 9113 section 8.3.2) and splits it into its typed form.
+func ParseResponseHeader(headerFields []HeaderField) (*ResponseHeader, error) {
+	if len(headerFields) == 0 || headerFields[0].name != PseudoStatus {
+		return nil, fmt.Errorf("%w: missing %s", ErrMalformedHeader, PseudoStatus)
+	}
+	status, err := strconv.Atoi(headerFields[0].value)
+	if err != nil || status < 100 || status > 999 {
+		return nil, fmt.Errorf("%w: invalid %s %q", ErrMalformedHeader, PseudoStatus, headerFields[0].value)
+	}
+
+	r := &ResponseHeader{Status: status}
+	for _, hf := range headerFields[1:] {
+		if hf.IsPseudo() {
+			return nil, fmt.Errorf("%w: unexpected %s", ErrMalformedHeader, hf.name)
+		}
+		if err := validateField(hf); err != nil {
+			return nil, err
+		}
+		r.Fields = append(r.Fields, hf)
+	}
+	return r, nil
+}
+
+// connectionSpecificFields must not appear in HTTP/2 (RFC 9113 section 8.2.2).
+var connectionSpecificFields = map[string]bool{
+	"connection":        true,
+	"proxy-connection":  true,
+	"keep-alive":        true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+func validateField(hf HeaderField) error {
+	if hf.name == "" {
+		return fmt.Errorf("%w: empty field name", ErrMalformedHeader)
+	}
+	if strings.ToLower(hf.name) != hf.name {
+		return fmt.Errorf("%w: uppercase field name %q", ErrMalformedHeader, hf.name)
+	}
+	if connectionSpecificFields[hf.name] {
+		return fmt.Errorf("%w: connection-specific field %s", ErrMalformedHeader, hf.name)
+	}
+	if hf.name == "te" && hf.value != "trailers" {
+		return fmt.Errorf("%w: te: %s", ErrMalformedHeader, hf.value)
+	}
+	return nil
+}
+
+func getField(headerFields []HeaderField, name string) string {
+	for _, hf := range headerFields {
+		if hf.name == name {
+			return hf.value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStaticTable(t *testing.T) {
+	if len(staticTable) != 62 {
+		t.Fatalf("expected 61 entries got %d", len(staticTable)-1)
+	}
+
+	expected := map[int]HeaderField{
+		1:  {name: ":authority"},
+		2:  {name: ":method", value: "GET"},
+		7:  {name: ":scheme", value: "https"},
+		8:  {name: ":status", value: "200"},
+		16: {name: "accept-encoding", value: "gzip, deflate"},
+		19: {name: "accept"},
+		20: {name: "access-control-allow-origin"},
+		32: {name: "cookie"},
+		55: {name: "set-cookie"},
+		61: {name: "www-authenticate"},
+	}
+	for index, hf := range expected {
+		if staticTable[index] != hf {
+			t.Errorf("index %d: expected %s got %s", index, hf, staticTable[index])
+		}
+	}
+}
+
+func TestRequestHeaderFields(t *testing.T) {
+	expected := []HeaderField{
+		{name: ":method", value: "GET"},
+		{name: ":scheme", value: "https"},
+		{name: ":authority", value: "localhost"},
+		{name: ":path", value: "/"},
+		{name: "user-agent", value: "go/h2"},
+	}
+
+	headerFields := NewRequestHeader("GET", "https", "localhost", "/").
+		Add("User-Agent", "go/h2").
+		HeaderFields()
+
+	if len(headerFields) != len(expected) {
+		t.Fatalf("expected %d fields got %d", len(expected), len(headerFields))
+	}
+	for i := range expected {
+		if headerFields[i] != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], headerFields[i])
+		}
+	}
+
+	r, err := ParseRequestHeader(headerFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Method != "GET" || r.Scheme != "https" || r.Authority != "localhost" || r.Path != "/" || r.Get("user-agent") != "go/h2" {
+		t.Errorf("unexpected request header %+v", r)
+	}
+}
+
+func TestParseRequestHeaderMalformed(t *testing.T) {
+	tests := [][]HeaderField{
+		{{name: ":method", value: "GET"}, {name: ":path", value: "/"}},
+		{{name: ":method", value: "GET"}, {name: ":scheme", value: "https"}, {name: ":path", value: "/"}, {name: ":path", value: "/"}},
+		{{name: ":method", value: "GET"}, {name: "accept", value: "*/*"}, {name: ":scheme", value: "https"}, {name: ":path", value: "/"}},
+		{{name: ":method", value: "GET"}, {name: ":scheme", value: "https"}, {name: ":path", value: "/"}, {name: ":status", value: "200"}},
+		{{name: ":method", value: "GET"}, {name: ":scheme", value: "https"}, {name: ":path", value: "/"}, {name: "Accept", value: "*/*"}},
+		{{name: ":method", value: "GET"}, {name: ":scheme", value: "https"}, {name: ":path", value: "/"}, {name: "connection", value: "close"}},
+		{{name: ":method", value: "CONNECT"}, {name: ":scheme", value: "https"}, {name: ":authority", value: "localhost:443"}},
+	}
+
+	for _, headerFields := range tests {
+		if _, err := ParseRequestHeader(headerFields); !errors.Is(err, ErrMalformedHeader) {
+			t.Errorf("%v: expected %s got %v", headerFields, ErrMalformedHeader, err)
+		}
+	}
+}
+
+func TestResponseHeaderFields(t *testing.T) {
+	headerFields := NewResponseHeader(404).Add("Content-Type", "text/plain").HeaderFields()
+	if headerFields[0] != (HeaderField{name: ":status", value: "404"}) {
+		t.Errorf("unexpected status field %s", headerFields[0])
+	}
+
+	r, err := ParseResponseHeader(headerFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != 404 || r.Get("content-type") != "text/plain" {
+		t.Errorf("unexpected response header %+v", r)
+	}
+
+	if _, err := ParseResponseHeader(headerFields[1:]); !errors.Is(err, ErrMalformedHeader) {
+		t.Errorf("expected %s got %v", ErrMalformedHeader, err)
+	}
+}
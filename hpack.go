@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 var (
-	ErrDecodingNumber = errors.New("invalid byte for numeric representation")
+	ErrDecodingNumber  = errors.New("invalid byte for numeric representation")
+	ErrIntegerOverflow = errors.New("integer exceeds maximum value")
 )
 
 type HeaderField struct {
@@ -15,24 +19,26 @@ type HeaderField struct {
 	value string
 }
 
+// staticTable is the predefined table of RFC 7541 Appendix A. Index 0 is
+// unused so that the slice index matches the HPACK index.
 var staticTable = []HeaderField{
 	{name: "", value: ""},
-	{name: ":authority:", value: ""},
-	{name: ":method:", value: "GET"},
-	{name: ":method:", value: "POST"},
-	{name: ":path:", value: "/"},
-	{name: ":path:", value: "/index.html"},
-	{name: ":scheme:", value: "http"},
-	{name: ":scheme:", value: "https"},
-	{name: ":status:", value: "200"},
-	{name: ":status:", value: "204"},
-	{name: ":status:", value: "206"},
-	{name: ":status:", value: "304"},
-	{name: ":status:", value: "400"},
-	{name: ":status:", value: "404"},
-	{name: ":status:", value: "500"},
+	{name: ":authority", value: ""},
+	{name: ":method", value: "GET"},
+	{name: ":method", value: "POST"},
+	{name: ":path", value: "/"},
+	{name: ":path", value: "/index.html"},
+	{name: ":scheme", value: "http"},
+	{name: ":scheme", value: "https"},
+	{name: ":status", value: "200"},
+	{name: ":status", value: "204"},
+	{name: ":status", value: "206"},
+	{name: ":status", value: "304"},
+	{name: ":status", value: "400"},
+	{name: ":status", value: "404"},
+	{name: ":status", value: "500"},
 	{name: "accept-charset", value: ""},
-	{name: "accept-encoding", value: ""},
+	{name: "accept-encoding", value: "gzip, deflate"},
 	{name: "accept-language", value: ""},
 	{name: "accept-ranges", value: ""},
 	{name: "accept", value: ""},
@@ -80,319 +86,716 @@ var staticTable = []HeaderField{
 	{name: "www-authenticate", value: ""},
 }
 
-func pow(base uint64, to uint8) uint64 {
-	var (
-		i      uint8  = 0
-		result uint64 = 1
-	)
-	for ; i < to; i++ {
-		result *= base
-	}
-
-	return result
-}
-
-func decodeInteger(b []byte, prefix uint8) (uint64, error) {
-	prefixValue := pow(2, prefix) - 1
+const (
+	// maxIntegerOctets is the number of continuation octets needed to
+	// encode any 64-bit integer, anything longer is over-long.
+	maxIntegerOctets = 10
+	// maxHPackInteger bounds every integer in a header block. Indexes,
+	// string lengths and table sizes all have to fit in 32 bits.
+	maxHPackInteger = 1<<32 - 1
+)
 
-	if uint64(b[0]) < prefixValue {
-		return uint64(b[0]), nil
+// decodeInteger decodes a prefix-coded integer (RFC 7541 section 5.1) from
+// the start of b. Only the low prefix bits of b[0] belong to the integer.
+// It returns the value and the number of octets consumed, and fails if the
+// value is larger than max.
+func decodeInteger(b []byte, prefix uint8, max uint64) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, fmt.Errorf("%w: reading integer", ErrTruncated)
 	}
-	if len(b) < 2 {
-		return 0, ErrDecodingNumber
+	r := bytes.NewReader(b[1:])
+	n, err := readInteger(r, b[0], prefix, max)
+	if err != nil {
+		return 0, 0, err
 	}
+	return n, len(b) - r.Len(), nil
+}
 
-	var (
-		n        uint64
-		m        uint8
-		nextByte uint64
-		i        = uint8(1)
-	)
-	for {
-		nextByte = uint64(b[i])
-		n += (nextByte & 127) * (1 << m)
+// readInteger is decodeInteger for a first octet b which has already been
+// read, continuation octets are consumed from r.
+func readInteger(r io.ByteReader, b byte, prefix uint8, max uint64) (uint64, error) {
+	mask := uint64(1)<<prefix - 1
+	n := uint64(b) & mask
+	if n == mask {
+		for i := 0; ; i++ {
+			if i == maxIntegerOctets {
+				return 0, fmt.Errorf("%w: more than %d continuation octets", ErrDecodingNumber, maxIntegerOctets)
+			}
+			c, err := r.ReadByte()
+			if err != nil {
+				return 0, truncated(err, "integer")
+			}
 
-		if ((nextByte & 128) >> 7) == 0 {
-			break
+			shift := uint(7 * i)
+			v := uint64(c & 0x7f)
+			if v<<shift>>shift != v || n+v<<shift < n {
+				return 0, fmt.Errorf("%w: overflows 64 bits", ErrIntegerOverflow)
+			}
+			n += v << shift
+			if c&0x80 == 0 {
+				break
+			}
 		}
-		m += 7
-		i++
 	}
 
-	return (n + prefixValue), nil
+	if n > max {
+		return 0, fmt.Errorf("%w: %d > %d", ErrIntegerOverflow, n, max)
+	}
+	return n, nil
 }
 
+// encodeInteger encodes n with the given prefix length. The bits above the
+// prefix in the first octet are left zero for the caller to fill in.
 func encodeInteger(n uint64, prefix uint8) []byte {
-	prefixValue := pow(2, prefix) - 1
+	return appendInteger(nil, n, prefix)
+}
 
-	if n < prefixValue {
-		return []byte{uint8(n)}
+func appendInteger(dst []byte, n uint64, prefix uint8) []byte {
+	mask := uint64(1)<<prefix - 1
+	if n < mask {
+		return append(dst, byte(n))
 	}
 
-	bytes := []byte{uint8(prefixValue)}
-	n = n - prefixValue
-	for n >= 128 {
-		bytes = append(bytes, uint8((n%128)+128))
-		n = n / 128
+	dst = append(dst, byte(mask))
+	n -= mask
+	for n >= 0x80 {
+		dst = append(dst, byte(n&0x7f)|0x80)
+		n >>= 7
 	}
-	bytes = append(bytes, uint8(n))
-	return bytes
+	return append(dst, byte(n))
 }
 
-func encodeStringLiteral(s string, huffmanEncoded bool) []byte {
-	if huffmanEncoded {
-		encoded := HuffmanEncode(s)
-		length := encodeInteger(uint64(len(encoded)), 7)
-		length[0] |= 128
-		return append(length, encoded...)
+type huffmanMode uint8
+
+const (
+	// huffmanShorter Huffman encodes a string only when it gets shorter.
+	huffmanShorter huffmanMode = iota
+	huffmanAlways
+	huffmanNever
+)
+
+func appendStringLiteral(dst []byte, s string, mode huffmanMode) []byte {
+	return appendString(dst, 0, 7, s, mode)
+}
+
+// appendString appends a string literal whose length has a prefix of the
+// given size. The Huffman flag is the bit right above the prefix, flags
+// holds the bits above it. HPACK always uses a 7-bit prefix, QPACK does not.
+func appendString(dst []byte, flags byte, prefix uint8, s string, mode huffmanMode) []byte {
+	start := len(dst)
+	length := HuffmanEncodedLen(s)
+	if mode == huffmanNever || (mode == huffmanShorter && length >= len(s)) {
+		dst = appendInteger(dst, uint64(len(s)), prefix)
+		dst[start] |= flags
+		return append(dst, s...)
 	}
 
-	length := encodeInteger(uint64(len(s)), 7)
-	length[0] &= 0x7F
-	return append(length, []byte(s)...)
+	dst = appendInteger(dst, uint64(length), prefix)
+	dst[start] |= flags | 1<<prefix
+	return AppendHuffman(dst, s)
 }
 
-func decodeStringLiteral(b []byte, huffmanEncoded bool) (string, error) {
-	if huffmanEncoded {
-		return HuffmanDecode(b), nil
+// decodeString is appendString's counterpart for a string at the start of
+// b. It returns the string and the number of octets consumed.
+func decodeString(b []byte, prefix uint8, maxLength int) (string, int, error) {
+	length, n, err := decodeInteger(b, prefix, maxHPackInteger)
+	if err != nil {
+		return "", 0, err
+	}
+	if maxLength > 0 && length > uint64(maxLength) {
+		return "", 0, fmt.Errorf("%w: %d > %d", ErrStringTooLong, length, maxLength)
+	}
+	if uint64(len(b)-n) < length {
+		return "", 0, fmt.Errorf("%w: reading string literal of length %d", ErrTruncated, length)
 	}
-	return string(b), nil
+
+	raw := b[n : n+int(length)]
+	if b[0]&(1<<prefix) == 0 {
+		return string(raw), n + int(length), nil
+	}
+	decoded, err := HuffmanDecode(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	if maxLength > 0 && len(decoded) > maxLength {
+		return "", 0, fmt.Errorf("%w: Huffman decoded to %d > %d", ErrStringTooLong, len(decoded), maxLength)
+	}
+	return decoded, n + int(length), nil
 }
 
 type HPackEncoder interface {
 	Encode(writer io.Writer, headerFields []HeaderField) (int, error)
+	SetMaxDynamicTableSize(n uint32)
 }
 
 type hPackEncoder struct {
-	dynamicTable []HeaderField
+	table dynamicTable
+	// maxTableSizeLimit caps our dynamic table whatever size the peer's
+	// SETTINGS_HEADER_TABLE_SIZE allows.
+	maxTableSizeLimit uint32
+	// tableSizeUpdate is set when a Dynamic Table Size Update has to be
+	// sent at the beginning of the next header block. minTableSize is the
+	// smallest size the table went through since the last block.
+	tableSizeUpdate bool
+	minTableSize    uint32
+
+	huffman huffmanMode
+	// indexAll adds every field not marked sensitive to the dynamic
+	// table, the way the RFC 7541 Appendix C examples are encoded.
+	indexAll bool
 }
 
 func NewHPackEncoder() HPackEncoder {
 	return &hPackEncoder{
-		dynamicTable: []HeaderField{},
+		table:             dynamicTable{maxSize: defaultDynamicTableSize},
+		maxTableSizeLimit: defaultDynamicTableSize,
+		huffman:           huffmanShorter,
+	}
+}
+
+// SetMaxDynamicTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE.
+func (h *hPackEncoder) SetMaxDynamicTableSize(n uint32) {
+	n = min32(n, h.maxTableSizeLimit)
+	if n == h.table.maxSize {
+		return
+	}
+	if !h.tableSizeUpdate || n < h.minTableSize {
+		h.minTableSize = n
 	}
+	h.tableSizeUpdate = true
+	h.table.setMaxSize(n)
 }
 
+type indexingMode uint8
+
+const (
+	incrementalIndexing indexingMode = iota
+	withoutIndexing
+	neverIndexed
+)
+
 type headerFieldWithEncodingParams struct {
-	headerField      HeaderField
-	isHuffmanEncoded bool
-	indexed          bool
-	newName          bool
-}
-
-func (h *hPackEncoder) encodeHeaderField(hf headerFieldWithEncodingParams) []byte {
-	indexedHeaderField := 0
-	indexedHeaderName := 0
-	for index, item := range staticTable {
-		if hf.headerField.name == item.name {
-			if hf.headerField.value == item.value {
-				indexedHeaderField = index
-				break
-			}
-			if indexedHeaderName != 0 {
-				break
-			}
-			indexedHeaderName = index
+	headerField HeaderField
+	indexing    indexingMode
+}
+
+// search looks the field up in the static table and then in the dynamic
+// table. It returns the index of an exact match if there is one, otherwise
+// the index of the first entry with the same name, or 0.
+func (h *hPackEncoder) search(hf HeaderField) (index int, nameOnly bool) {
+	for i := 1; i < len(staticTable); i++ {
+		if staticTable[i].name != hf.name {
+			continue
+		}
+		if staticTable[i].value == hf.value {
+			return i, false
+		}
+		if index == 0 {
+			index = i
 		}
 	}
-	// Indexed Header Field Representation
-	if indexedHeaderField != 0 {
-		bytes := encodeInteger(uint64(indexedHeaderField), 7)
-		bytes[0] |= 0x80
-		return bytes
+	for i := 1; i <= h.table.len(); i++ {
+		entry, _ := h.table.get(i)
+		if entry.name != hf.name {
+			continue
+		}
+		if entry.value == hf.value {
+			return len(staticTable) - 1 + i, false
+		}
+		if index == 0 {
+			index = len(staticTable) - 1 + i
+		}
 	}
+	return index, index != 0
+}
 
-	// Literal Header Field with Incremental Indexing -- Indexed name
-	if indexedHeaderName != 0 && hf.indexed && !hf.newName {
-		bytes := encodeInteger(uint64(indexedHeaderName), 6)
-		bytes[0] |= 0x40
+func (h *hPackEncoder) encodeHeaderField(dst []byte, hf headerFieldWithEncodingParams) []byte {
+	index, nameOnly := h.search(hf.headerField)
 
-		return append(bytes, encodeStringLiteral(hf.headerField.value, hf.isHuffmanEncoded)...)
+	// Indexed Header Field Representation
+	if index != 0 && !nameOnly && hf.indexing != neverIndexed {
+		start := len(dst)
+		dst = appendInteger(dst, uint64(index), 7)
+		dst[start] |= 0x80
+		return dst
 	}
-	// Literal Header Field with Incremental Indexing -- New Name
-	if indexedHeaderName != 0 && hf.indexed && hf.newName {
-		bytes := []byte{0x40}
 
-		bytes = append(bytes, encodeStringLiteral(hf.headerField.name, hf.isHuffmanEncoded)...)
-		return append(bytes, encodeStringLiteral(hf.headerField.value, hf.isHuffmanEncoded)...)
+	start := len(dst)
+	switch hf.indexing {
+	case incrementalIndexing:
+		// Literal Header Field with Incremental Indexing
+		dst = appendInteger(dst, uint64(index), 6)
+		dst[start] |= 0x40
+		h.table.add(hf.headerField)
+	case withoutIndexing:
+		// Literal Header Field without Indexing
+		dst = appendInteger(dst, uint64(index), 4)
+	case neverIndexed:
+		// Literal Header Field Never Indexed
+		dst = appendInteger(dst, uint64(index), 4)
+		dst[start] |= 0x10
 	}
 
-	// Literal Header Field without Indexing -- Indexed name
-	if indexedHeaderName != 0 && !hf.indexed {
-		bytes := encodeInteger(uint64(indexedHeaderName), 4)
-		bytes[0] &= 0x0f
-		return append(bytes, encodeStringLiteral(hf.headerField.value, hf.isHuffmanEncoded)...)
+	// An index of 0 means the name follows as a literal.
+	if index == 0 {
+		dst = appendStringLiteral(dst, hf.headerField.name, h.huffman)
 	}
+	return appendStringLiteral(dst, hf.headerField.value, h.huffman)
+}
 
-	fmt.Printf("%s: %s\n", hf.headerField.name, hf.headerField.value)
-	panic("not implemented yet")
+// fieldIndexing is the indexing strategy shared by the HPACK and QPACK
+// encoders.
+func fieldIndexing(hf HeaderField) indexingMode {
+	switch hf.name {
+	case "authorization", "proxy-authorization":
+		// Credentials must never end up in a table an intermediary or
+		// a compression oracle could probe (RFC 7541 section 7.1.3).
+		return neverIndexed
+	case "cookie":
+		// Short cookies are easy to guess.
+		if len(hf.value) < 20 {
+			return neverIndexed
+		}
+	case ":path", "age", "content-length", "etag", "if-modified-since",
+		"if-none-match", "location", "set-cookie":
+		// Fields whose values hardly ever repeat only waste table space.
+		return withoutIndexing
+	}
+	return incrementalIndexing
 }
 
 func (h *hPackEncoder) getParamsForHeaderField(headerField HeaderField) headerFieldWithEncodingParams {
-	// Just a place holder to implement actual function later.
 	hfWithParams := headerFieldWithEncodingParams{
-		headerField:      headerField,
-		isHuffmanEncoded: true,
-		indexed:          false,
-		newName:          false,
+		headerField: headerField,
+		indexing:    fieldIndexing(headerField),
 	}
-	if headerField.value == "localhost" || headerField.name == "user-agent" || headerField.name == "accept" {
-		hfWithParams.indexed = true
+
+	if h.indexAll && hfWithParams.indexing != neverIndexed {
+		hfWithParams.indexing = incrementalIndexing
 	}
-	if headerField.value == "*/*" {
-		hfWithParams.isHuffmanEncoded = false
+	if !h.indexAll && headerField.size() > h.table.maxSize {
+		hfWithParams.indexing = withoutIndexing
 	}
 	return hfWithParams
 }
 
 func (h *hPackEncoder) Encode(writer io.Writer, headerFields []HeaderField) (int, error) {
 	// takes an ordered header list and encode it
-	total_bytes := 0
-	for _, headerField := range headerFields {
-		n, err := writer.Write(h.encodeHeaderField(h.getParamsForHeaderField(headerField)))
-		if err != nil {
-			return total_bytes, err
+	block := []byte{}
+	if h.tableSizeUpdate {
+		// Dynamic Table Size Update
+		if h.minTableSize < h.table.maxSize {
+			start := len(block)
+			block = appendInteger(block, uint64(h.minTableSize), 5)
+			block[start] |= 0x20
 		}
-		total_bytes += n
+		start := len(block)
+		block = appendInteger(block, uint64(h.table.maxSize), 5)
+		block[start] |= 0x20
+		h.tableSizeUpdate = false
 	}
 
-	return total_bytes, nil
+	for _, headerField := range headerFields {
+		block = h.encodeHeaderField(block, h.getParamsForHeaderField(headerField))
+	}
+	return writer.Write(block)
 }
 
 type HPackDecoder interface {
 	Decode(reader io.Reader, headerFields *[]HeaderField) error
+	SetMaxStringLength(n int)
+	SetMaxHeaderListSize(n uint32)
+}
+
+/*
+The dynamic table consists of a list of header fields maintained in
+first-in, first-out order. The first and newest entry in a dynamic
+table is at the lowest index, and the oldest entry of a dynamic table
+is at the highest index.
+
+	<----------  Index Address Space ---------->
+	<-- Static  Table -->  <-- Dynamic Table -->
+	+---+-----------+---+  +---+-----------+---+
+	| 1 |    ...    | s |  |s+1|    ...    |s+k|
+	+---+-----------+---+  +---+-----------+---+
+	                       ^                   |
+	                       |                   V
+	                Insertion Point      Dropping Point
+
+	Figure 2: Index Address Space
+*/
+type dynamicTable struct {
+	// entries is kept oldest first, so the newest entry is the last one.
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+	// observe, if set, is called for every entry inserted or evicted,
+	// with its index at that time.
+	observe func(inserted bool, index int, hf HeaderField)
+}
+
+// size returns the size of an entry as defined in RFC 7541 section 4.1.
+func (hf HeaderField) size() uint32 {
+	return uint32(len(hf.name) + len(hf.value) + 32)
+}
+
+func (t *dynamicTable) len() int {
+	return len(t.entries)
+}
+
+// get returns the entry at i, where 1 is the newest entry.
+func (t *dynamicTable) get(i int) (HeaderField, bool) {
+	if i < 1 || i > len(t.entries) {
+		return HeaderField{}, false
+	}
+	return t.entries[len(t.entries)-i], true
+}
+
+func (t *dynamicTable) add(hf HeaderField) {
+	// An entry larger than the maximum size empties the table
+	// and is not added (RFC 7541 section 4.4).
+	t.evict(t.maxSize - min32(hf.size(), t.maxSize))
+	if hf.size() > t.maxSize {
+		return
+	}
+	t.entries = append(t.entries, hf)
+	t.size += hf.size()
+	if t.observe != nil {
+		t.observe(true, len(staticTable), hf)
+	}
 }
 
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict(n)
+}
+
+// evict drops the oldest entries until the table size is at most n.
+func (t *dynamicTable) evict(n uint32) {
+	i := 0
+	for ; t.size > n && i < len(t.entries); i++ {
+		t.size -= t.entries[i].size()
+		if t.observe != nil {
+			t.observe(false, len(staticTable)+len(t.entries)-1-i, t.entries[i])
+		}
+	}
+	if i > 0 {
+		t.entries = append(t.entries[:0], t.entries[i:]...)
+	}
+}
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+const (
+	defaultDynamicTableSize = 4096
+	defaultMaxStringLength  = 16 << 10
+	// SETTINGS_MAX_HEADER_LIST_SIZE is unlimited by default, but we never
+	// accept more than net/http does for HTTP/1.x.
+	defaultMaxHeaderListSize = 1 << 20
+)
+
+var (
+	ErrTruncated       = errors.New("truncated header block")
+	ErrInvalidIndex    = errors.New("invalid header table index")
+	ErrStringTooLong   = errors.New("string literal exceeds maximum length")
+	ErrTableSizeUpdate = errors.New("invalid dynamic table size update")
+	// ErrHeaderListTooLarge is returned once the decoded header list
+	// exceeds SETTINGS_MAX_HEADER_LIST_SIZE. Unlike the other decoding
+	// errors it leaves the decoder usable: the whole block has been
+	// processed, so the connection only needs to reject the stream
+	// (431 or RST_STREAM) instead of failing with COMPRESSION_ERROR.
+	ErrHeaderListTooLarge = errors.New("header list size exceeds limit")
+)
+
 type hPackDecoder struct {
-	dynamicTable []HeaderField
-	table        []HeaderField
+	table dynamicTable
+	// maxTableSize is the upper bound for dynamic table size updates,
+	// i.e. the SETTINGS_HEADER_TABLE_SIZE we advertised.
+	maxTableSize      uint32
+	maxStringLength   int
+	maxHeaderListSize uint32
+	// inspect, if set, is called for every representation decoded.
+	inspect func(HPackRepresentation)
+}
+
+// HPackRepresentationType is the kind of a representation in a header
+// block (RFC 7541 section 6).
+type HPackRepresentationType uint8
+
+const (
+	IndexedRepresentation HPackRepresentationType = iota
+	IncrementalIndexingRepresentation
+	WithoutIndexingRepresentation
+	NeverIndexedRepresentation
+	TableSizeUpdateRepresentation
+)
+
+func (t HPackRepresentationType) String() string {
+	switch t {
+	case IndexedRepresentation:
+		return "indexed"
+	case IncrementalIndexingRepresentation:
+		return "literal with incremental indexing"
+	case WithoutIndexingRepresentation:
+		return "literal without indexing"
+	case NeverIndexedRepresentation:
+		return "literal never indexed"
+	case TableSizeUpdateRepresentation:
+		return "dynamic table size update"
+	}
+	return fmt.Sprintf("HPackRepresentationType(%d)", uint8(t))
+}
+
+// HPackRepresentation describes how a header field, or a dynamic table size
+// update, was coded.
+type HPackRepresentation struct {
+	Type HPackRepresentationType
+	// Index is the index of the field or of its name, 0 for a literal
+	// name. For a size update it is the new maximum size.
+	Index        uint64
+	NameHuffman  bool
+	ValueHuffman bool
+	HeaderField  HeaderField
 }
 
 func NewHPackDecoder() HPackDecoder {
 	return &hPackDecoder{
-		dynamicTable: []HeaderField{},
-		table:        staticTable,
+		table:             dynamicTable{maxSize: defaultDynamicTableSize},
+		maxTableSize:      defaultDynamicTableSize,
+		maxStringLength:   defaultMaxStringLength,
+		maxHeaderListSize: defaultMaxHeaderListSize,
 	}
 }
 
-func (h *hPackDecoder) Decode(reader io.Reader, headerFields *[]HeaderField) error {
-	var (
-		n     int = 0
-		err   error
-		value string
-		field string
-	)
+// SetMaxStringLength bounds the length of every name and value literal.
+func (h *hPackDecoder) SetMaxStringLength(n int) {
+	h.maxStringLength = n
+}
 
-	for {
-		bytes := [100]byte{}
-		n, err = reader.Read(bytes[:1])
+// SetMaxHeaderListSize bounds the size of a decoded header list, counted as
+// in RFC 9113 section 6.5.2: the length of every name and value plus 32
+// octets per field. Zero means unlimited.
+func (h *hPackDecoder) SetMaxHeaderListSize(n uint32) {
+	h.maxHeaderListSize = n
+}
+
+// field returns the header field at index of the combined address space.
+func (h *hPackDecoder) field(index uint64) (HeaderField, error) {
+	if index == 0 {
+		return HeaderField{}, fmt.Errorf("%w: %d", ErrInvalidIndex, index)
+	}
+	if index < uint64(len(staticTable)) {
+		return staticTable[index], nil
+	}
+	if index-uint64(len(staticTable)) >= uint64(h.table.len()) {
+		return HeaderField{}, fmt.Errorf("%w: %d", ErrInvalidIndex, index)
+	}
+	hf, _ := h.table.get(int(index) - len(staticTable) + 1)
+	return hf, nil
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// truncated turns an EOF in the middle of a representation into ErrTruncated.
+func truncated(err error, what string) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: reading %s", ErrTruncated, what)
+	}
+	return err
+}
+
+// readString decodes a string literal (RFC 7541 section 5.2).
+// It also tells whether the literal was Huffman encoded.
+func (h *hPackDecoder) readString(r byteReader) (string, bool, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", false, truncated(err, "string length")
+	}
+	huffmanEncoded := b&0x80 != 0
+	length, err := readInteger(r, b, 7, maxHPackInteger)
+	if err != nil {
+		return "", huffmanEncoded, err
+	}
+	if h.maxStringLength > 0 && length > uint64(h.maxStringLength) {
+		return "", huffmanEncoded, fmt.Errorf("%w: %d > %d", ErrStringTooLong, length, h.maxStringLength)
+	}
+
+	what := fmt.Sprintf("string literal of length %d", length)
+	// The length comes from the peer: the buffer is only pre-sized up to
+	// what is left in r, and otherwise grows as octets arrive.
+	sb := strings.Builder{}
+	sb.Grow(literalCapacity(r, length))
+	lr := &literalReader{r: r, n: length}
+	if huffmanEncoded {
+		// Decode while reading, so that an expanding string is
+		// rejected as soon as it exceeds the limit.
+		if _, err := io.Copy(&sb, NewHuffmanReader(lr, h.maxStringLength)); err != nil {
+			return "", true, truncated(err, what)
+		}
+		return sb.String(), true, nil
+	}
+	if _, err := io.Copy(&sb, lr); err != nil {
+		return "", false, truncated(err, what)
+	}
+	return sb.String(), false, nil
+}
+
+// literalCapacity is the size a string literal of the given length is
+// pre-allocated with: never more than the octets left in r when r can tell,
+// and a small guess otherwise.
+func literalCapacity(r byteReader, length uint64) int {
+	available := uint64(64)
+	if l, ok := r.(interface{ Len() int }); ok {
+		available = uint64(l.Len())
+	}
+	if length < available {
+		return int(length)
+	}
+	return int(available)
+}
+
+// literalReader reads exactly the n octets of a string literal from r.
+type literalReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (l *literalReader) Read(p []byte) (int, error) {
+	if l.n == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= uint64(n)
+	if err == io.EOF {
+		if l.n > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// readLiteral decodes the remainder of a literal header field whose first
+// octet b carries a name index of the given prefix length.
+func (h *hPackDecoder) readLiteral(r byteReader, b byte, prefix uint8, rep *HPackRepresentation) error {
+	index, err := readInteger(r, b, prefix, maxHPackInteger)
+	if err != nil {
+		return err
+	}
+
+	rep.Index = index
+	if index == 0 {
+		if rep.HeaderField.name, rep.NameHuffman, err = h.readString(r); err != nil {
+			return err
+		}
+	} else {
+		indexed, err := h.field(index)
 		if err != nil {
-			if n == 0 {
-				break
-			}
 			return err
 		}
+		rep.HeaderField.name = indexed.name
+	}
 
-		if bytes[0] >= 0x80 {
-			// Indexed Header Field Representation
-			bytes[0] -= 0x80
-			index, err := decodeInteger(bytes[:1], 7)
-			if err != nil {
-				return err
-			}
-
-			*headerFields = append(*headerFields, h.table[index])
-		} else if bytes[0] >= 0x40 {
-			// Literal Header Field with Incremental Indexing -- Indexed name
-			bytes[0] -= 0x40
-			index, err := decodeInteger(bytes[:1], 6)
-			if err != nil {
-				return err
-			}
+	rep.HeaderField.value, rep.ValueHuffman, err = h.readString(r)
+	return err
+}
 
-			// Decode value
-			_, err = reader.Read(bytes[:1])
-			if err != nil {
-				return err
-			}
+func (h *hPackDecoder) Decode(reader io.Reader, headerFields *[]HeaderField) error {
+	r, ok := reader.(byteReader)
+	if !ok {
+		r = bufio.NewReader(reader)
+	}
 
-			huffmanEncoded := bytes[0] > 0x80
-			if huffmanEncoded {
-				bytes[0] -= 0x80
-			}
+	var listSize uint64
+	emit := func(rep HPackRepresentation) {
+		if h.inspect != nil {
+			h.inspect(rep)
+		}
+		hf := rep.HeaderField
+		// Once the limit is exceeded the rest of the block is still
+		// decoded to keep the dynamic table in sync, only the fields
+		// are dropped, so a peer referencing a large entry thousands
+		// of times cannot make us allocate.
+		listSize += uint64(hf.size())
+		if h.maxHeaderListSize == 0 || listSize <= uint64(h.maxHeaderListSize) {
+			*headerFields = append(*headerFields, hf)
+		}
+	}
 
-			length, err := decodeInteger(bytes[:1], 7)
-			if err != nil {
-				return err
+	// Table size updates are only allowed before the first header field.
+	first := true
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			if h.maxHeaderListSize != 0 && listSize > uint64(h.maxHeaderListSize) {
+				return fmt.Errorf("%w: %d > %d", ErrHeaderListTooLarge, listSize, h.maxHeaderListSize)
 			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-			n, err = reader.Read(bytes[:length])
+		switch {
+		case b&0x80 != 0:
+			// Indexed Header Field Representation
+			index, err := readInteger(r, b, 7, maxHPackInteger)
 			if err != nil {
 				return err
 			}
-			value, err = decodeStringLiteral(bytes[:n], huffmanEncoded)
+			hf, err := h.field(index)
 			if err != nil {
 				return err
 			}
-			newHeader := HeaderField{name: h.table[index].name, value: value}
-			*headerFields = append(*headerFields, newHeader)
-			h.table = append(h.table, newHeader)
-		} else if bytes[0] == 0 {
-			// Literal Header Field without Indexing -- New Name
-
-			// Read the header field
-			_, err = reader.Read(bytes[:1])
-			if err != nil {
+			emit(HPackRepresentation{Type: IndexedRepresentation, Index: index, HeaderField: hf})
+		case b&0xc0 == 0x40:
+			// Literal Header Field with Incremental Indexing
+			rep := HPackRepresentation{Type: IncrementalIndexingRepresentation}
+			if err := h.readLiteral(r, b, 6, &rep); err != nil {
 				return err
 			}
-
-			huffmanEncoded := bytes[0] > 0x80
-			if huffmanEncoded {
-				bytes[0] -= 0x80
-			}
-			length, err := decodeInteger(bytes[:1], 6)
-			if err != nil {
-				return err
+			h.table.add(rep.HeaderField)
+			emit(rep)
+		case b&0xe0 == 0x20:
+			// Dynamic Table Size Update
+			if !first {
+				return fmt.Errorf("%w: not at the beginning of a header block", ErrTableSizeUpdate)
 			}
-
-			n, err = reader.Read(bytes[:length])
+			size, err := readInteger(r, b, 5, maxHPackInteger)
 			if err != nil {
 				return err
 			}
-			field, err = decodeStringLiteral(bytes[:n], huffmanEncoded)
-			if err != nil {
-				return err
+			if size > uint64(h.maxTableSize) {
+				return fmt.Errorf("%w: %d exceeds %d", ErrTableSizeUpdate, size, h.maxTableSize)
 			}
-			// Read the header value
-			_, err = reader.Read(bytes[:1])
-			if err != nil {
-				return err
+			h.table.setMaxSize(uint32(size))
+			if h.inspect != nil {
+				h.inspect(HPackRepresentation{Type: TableSizeUpdateRepresentation, Index: size})
 			}
-
-			huffmanEncoded = bytes[0] > 0x80
-			if huffmanEncoded {
-				bytes[0] -= 0x80
+			continue
+		default:
+			// Literal Header Field without Indexing and
+			// Literal Header Field Never Indexed
+			rep := HPackRepresentation{Type: WithoutIndexingRepresentation}
+			if b&0xf0 == 0x10 {
+				rep.Type = NeverIndexedRepresentation
 			}
-			length, err = decodeInteger(bytes[:1], 6)
-			if err != nil {
-				return err
-			}
-
-			n, err = reader.Read(bytes[:length])
-			if err != nil {
+			if err := h.readLiteral(r, b, 4, &rep); err != nil {
 				return err
 			}
-			value, err = decodeStringLiteral(bytes[:n], huffmanEncoded)
-			if err != nil {
-				return err
-			}
-
-			*headerFields = append(*headerFields, HeaderField{name: field, value: value})
-		}
-
-		if n == 0 {
-			break
+			emit(rep)
 		}
+		first = false
 	}
-	return nil
 }
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hpackBlock is one header block of an RFC 7541 Appendix C example, along
+// with the expected dynamic table afterwards, newest entry first.
+type hpackBlock struct {
+	wire    string
+	headers []HeaderField
+	table   []HeaderField
+	size    uint32
+}
+
+type hpackExample struct {
+	name      string
+	tableSize uint32
+	huffman   huffmanMode
+	blocks    []hpackBlock
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+var (
+	requestHeaders1 = []HeaderField{
+		{name: ":method", value: "GET"},
+		{name: ":scheme", value: "http"},
+		{name: ":path", value: "/"},
+		{name: ":authority", value: "www.example.com"},
+	}
+	requestHeaders2 = []HeaderField{
+		{name: ":method", value: "GET"},
+		{name: ":scheme", value: "http"},
+		{name: ":path", value: "/"},
+		{name: ":authority", value: "www.example.com"},
+		{name: "cache-control", value: "no-cache"},
+	}
+	requestHeaders3 = []HeaderField{
+		{name: ":method", value: "GET"},
+		{name: ":scheme", value: "https"},
+		{name: ":path", value: "/index.html"},
+		{name: ":authority", value: "www.example.com"},
+		{name: "custom-key", value: "custom-value"},
+	}
+	requestTable1 = []HeaderField{
+		{name: ":authority", value: "www.example.com"},
+	}
+	requestTable2 = []HeaderField{
+		{name: "cache-control", value: "no-cache"},
+		{name: ":authority", value: "www.example.com"},
+	}
+	requestTable3 = []HeaderField{
+		{name: "custom-key", value: "custom-value"},
+		{name: "cache-control", value: "no-cache"},
+		{name: ":authority", value: "www.example.com"},
+	}
+
+	responseHeaders1 = []HeaderField{
+		{name: ":status", value: "302"},
+		{name: "cache-control", value: "private"},
+		{name: "date", value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{name: "location", value: "https://www.example.com"},
+	}
+	responseHeaders2 = []HeaderField{
+		{name: ":status", value: "307"},
+		{name: "cache-control", value: "private"},
+		{name: "date", value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{name: "location", value: "https://www.example.com"},
+	}
+	responseHeaders3 = []HeaderField{
+		{name: ":status", value: "200"},
+		{name: "cache-control", value: "private"},
+		{name: "date", value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+		{name: "location", value: "https://www.example.com"},
+		{name: "content-encoding", value: "gzip"},
+		{name: "set-cookie", value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	}
+	responseTable1 = []HeaderField{
+		{name: "location", value: "https://www.example.com"},
+		{name: "date", value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{name: "cache-control", value: "private"},
+		{name: ":status", value: "302"},
+	}
+	responseTable2 = []HeaderField{
+		{name: ":status", value: "307"},
+		{name: "location", value: "https://www.example.com"},
+		{name: "date", value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{name: "cache-control", value: "private"},
+	}
+	responseTable3 = []HeaderField{
+		{name: "set-cookie", value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+		{name: "content-encoding", value: "gzip"},
+		{name: "date", value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+	}
+)
+
+var rfc7541Examples = []hpackExample{
+	{
+		name:      "C.3 Request Examples without Huffman Coding",
+		tableSize: 4096,
+		huffman:   huffmanNever,
+		blocks: []hpackBlock{
+			{
+				wire:    "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+				headers: requestHeaders1, table: requestTable1, size: 57,
+			},
+			{
+				wire:    "8286 84be 5808 6e6f 2d63 6163 6865",
+				headers: requestHeaders2, table: requestTable2, size: 110,
+			},
+			{
+				wire:    "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+				headers: requestHeaders3, table: requestTable3, size: 164,
+			},
+		},
+	},
+	{
+		name:      "C.4 Request Examples with Huffman Coding",
+		tableSize: 4096,
+		huffman:   huffmanAlways,
+		blocks: []hpackBlock{
+			{
+				wire:    "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+				headers: requestHeaders1, table: requestTable1, size: 57,
+			},
+			{
+				wire:    "8286 84be 5886 a8eb 1064 9cbf",
+				headers: requestHeaders2, table: requestTable2, size: 110,
+			},
+			{
+				wire:    "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+				headers: requestHeaders3, table: requestTable3, size: 164,
+			},
+		},
+	},
+	{
+		name:      "C.5 Response Examples without Huffman Coding",
+		tableSize: 256,
+		huffman:   huffmanNever,
+		blocks: []hpackBlock{
+			{
+				wire: `4803 3330 3258 0770 7269 7661 7465 611d
+					4d6f 6e2c 2032 3120 4f63 7420 3230 3133
+					2032 303a 3133 3a32 3120 474d 546e 1768
+					7474 7073 3a2f 2f77 7777 2e65 7861 6d70
+					6c65 2e63 6f6d`,
+				headers: responseHeaders1, table: responseTable1, size: 222,
+			},
+			{
+				wire:    "4803 3330 37c1 c0bf",
+				headers: responseHeaders2, table: responseTable2, size: 222,
+			},
+			{
+				wire: `88c1 611d 4d6f 6e2c 2032 3120 4f63 7420
+					3230 3133 2032 303a 3133 3a32 3220 474d
+					54c0 5a04 677a 6970 7738 666f 6f3d 4153
+					444a 4b48 514b 425a 584f 5157 454f 5049
+					5541 5851 5745 4f49 553b 206d 6178 2d61
+					6765 3d33 3630 303b 2076 6572 7369 6f6e
+					3d31`,
+				headers: responseHeaders3, table: responseTable3, size: 215,
+			},
+		},
+	},
+	{
+		name:      "C.6 Response Examples with Huffman Coding",
+		tableSize: 256,
+		huffman:   huffmanAlways,
+		blocks: []hpackBlock{
+			{
+				wire: `4882 6402 5885 aec3 771a 4b61 96d0 7abe
+					9410 54d4 44a8 2005 9504 0b81 66e0 82a6
+					2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8
+					e9ae 82ae 43d3`,
+				headers: responseHeaders1, table: responseTable1, size: 222,
+			},
+			{
+				wire:    "4883 640e ffc1 c0bf",
+				headers: responseHeaders2, table: responseTable2, size: 222,
+			},
+			{
+				wire: `88c1 6196 d07a be94 1054 d444 a820 0595
+					040b 8166 e084 a62d 1bff c05a 839b d9ab
+					77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b
+					3960 d5af 2708 7f36 72c1 ab27 0fb5 291f
+					9587 3160 65c0 03ed 4ee5 b106 3d50 07`,
+				headers: responseHeaders3, table: responseTable3, size: 215,
+			},
+		},
+	},
+}
+
+func checkDynamicTable(t *testing.T, table *dynamicTable, expected []HeaderField, size uint32) {
+	t.Helper()
+	if table.len() != len(expected) {
+		t.Fatalf("expected %d dynamic table entries got %d", len(expected), table.len())
+	}
+	for i, hf := range expected {
+		if entry, _ := table.get(i + 1); entry != hf {
+			t.Errorf("dynamic table entry %d: expected %s got %s", i+1, hf, entry)
+		}
+	}
+	if table.size != size {
+		t.Errorf("expected dynamic table size %d got %d", size, table.size)
+	}
+}
+
+func checkHeaderFields(t *testing.T, expected, headers []HeaderField) {
+	t.Helper()
+	if len(headers) != len(expected) {
+		t.Fatalf("expected %d headers got %d: %v", len(expected), len(headers), headers)
+	}
+	for i := range expected {
+		if headers[i] != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], headers[i])
+		}
+	}
+}
+
+func TestRFC7541Decoding(t *testing.T) {
+	for _, example := range rfc7541Examples {
+		t.Run(example.name, func(t *testing.T) {
+			decoder := NewHPackDecoder().(*hPackDecoder)
+			decoder.table.setMaxSize(example.tableSize)
+
+			for _, block := range example.blocks {
+				headers := []HeaderField{}
+				if err := decoder.Decode(bytes.NewReader(mustDecodeHex(t, block.wire)), &headers); err != nil {
+					t.Fatal(err)
+				}
+				checkHeaderFields(t, block.headers, headers)
+				checkDynamicTable(t, &decoder.table, block.table, block.size)
+			}
+		})
+	}
+}
+
+func TestRFC7541FieldRepresentations(t *testing.T) {
+	tests := []struct {
+		name  string
+		wire  string
+		hf    HeaderField
+		table []HeaderField
+		size  uint32
+	}{
+		{
+			name: "C.2.1 Literal Header Field with Indexing",
+			wire: "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572",
+			hf:   HeaderField{name: "custom-key", value: "custom-header"},
+			table: []HeaderField{
+				{name: "custom-key", value: "custom-header"},
+			},
+			size: 55,
+		},
+		{
+			name: "C.2.2 Literal Header Field without Indexing",
+			wire: "040c 2f73 616d 706c 652f 7061 7468",
+			hf:   HeaderField{name: ":path", value: "/sample/path"},
+		},
+		{
+			name: "C.2.3 Literal Header Field Never Indexed",
+			wire: "1008 7061 7373 776f 7264 0673 6563 7265 74",
+			hf:   HeaderField{name: "password", value: "secret"},
+		},
+		{
+			name: "C.2.4 Indexed Header Field",
+			wire: "82",
+			hf:   HeaderField{name: ":method", value: "GET"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := NewHPackDecoder().(*hPackDecoder)
+			headers := []HeaderField{}
+			if err := decoder.Decode(bytes.NewReader(mustDecodeHex(t, test.wire)), &headers); err != nil {
+				t.Fatal(err)
+			}
+			checkHeaderFields(t, []HeaderField{test.hf}, headers)
+			checkDynamicTable(t, &decoder.table, test.table, test.size)
+		})
+	}
+}
+
+func TestRFC7541Encoding(t *testing.T) {
+	for _, example := range rfc7541Examples {
+		t.Run(example.name, func(t *testing.T) {
+			encoder := NewHPackEncoder().(*hPackEncoder)
+			encoder.table.setMaxSize(example.tableSize)
+			encoder.huffman = example.huffman
+			encoder.indexAll = true
+
+			for _, block := range example.blocks {
+				buf := bytes.Buffer{}
+				if _, err := encoder.Encode(&buf, block.headers); err != nil {
+					t.Fatal(err)
+				}
+				expected := mustDecodeHex(t, block.wire)
+				if !bytes.Equal(expected, buf.Bytes()) {
+					t.Errorf("\r\nexp %s\r\ngot %s", bytesRepresentation(expected), bytesRepresentation(buf.Bytes()))
+				}
+				checkDynamicTable(t, &encoder.table, block.table, block.size)
+			}
+		})
+	}
+}
+
+func TestTableSizeUpdate(t *testing.T) {
+	encoder := NewHPackEncoder()
+	decoder := NewHPackDecoder().(*hPackDecoder)
+
+	encoder.SetMaxDynamicTableSize(0)
+	encoder.SetMaxDynamicTableSize(256)
+	buf := bytes.Buffer{}
+	if _, err := encoder.Encode(&buf, requestHeaders3); err != nil {
+		t.Fatal(err)
+	}
+	// Both the smallest and the final size are signalled.
+	if !bytes.HasPrefix(buf.Bytes(), []byte{0x20, 0x3f, 0xe1, 0x01}) {
+		t.Errorf("expected table size updates got %s", bytesRepresentation(buf.Bytes()))
+	}
+
+	headers := []HeaderField{}
+	if err := decoder.Decode(&buf, &headers); err != nil {
+		t.Fatal(err)
+	}
+	checkHeaderFields(t, requestHeaders3, headers)
+	if decoder.table.maxSize != 256 {
+		t.Errorf("expected dynamic table size 256 got %d", decoder.table.maxSize)
+	}
+
+	// A size update after the first field is a decoding error.
+	headers = []HeaderField{}
+	err := decoder.Decode(bytes.NewReader([]byte{0x82, 0x20}), &headers)
+	if err == nil {
+		t.Error("expected an error for a misplaced table size update")
+	}
+}
+
+/*
+hpackStory is a file of the hpack-test-case corpus
+(https://github.com/http2jp/hpack-test-case). Every story is a sequence
+of header blocks sharing one decoding context.
+*/
+type hpackStory struct {
+	Description string `json:"description"`
+	Cases       []struct {
+		Seqno           int                 `json:"seqno"`
+		HeaderTableSize uint32              `json:"header_table_size"`
+		Wire            string              `json:"wire"`
+		Headers         []map[string]string `json:"headers"`
+	} `json:"cases"`
+}
+
+func (s *hpackStory) headers(i int) []HeaderField {
+	headers := []HeaderField{}
+	for _, field := range s.Cases[i].Headers {
+		for name, value := range field {
+			headers = append(headers, HeaderField{name: name, value: value})
+		}
+	}
+	return headers
+}
+
+// TestHPackStories decodes every story found in testdata/hpack-test-case,
+// and checks that our encoder round trips the same header lists. More
+// corpora can be added as testdata/hpack-test-case/<name>/story_*.json.
+func TestHPackStories(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "hpack-test-case", "*", "story_*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no stories found")
+	}
+
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			story := hpackStory{}
+			if err := json.Unmarshal(raw, &story); err != nil {
+				t.Fatal(err)
+			}
+
+			decoder := NewHPackDecoder().(*hPackDecoder)
+			encoder := NewHPackEncoder()
+			roundTrip := NewHPackDecoder()
+			for i, c := range story.Cases {
+				if c.HeaderTableSize != 0 && i == 0 {
+					decoder.table.setMaxSize(c.HeaderTableSize)
+				}
+				expected := story.headers(i)
+
+				if c.Wire != "" {
+					headers := []HeaderField{}
+					if err := decoder.Decode(bytes.NewReader(mustDecodeHex(t, c.Wire)), &headers); err != nil {
+						t.Fatalf("seqno %d: %s", c.Seqno, err)
+					}
+					checkHeaderFields(t, expected, headers)
+				}
+
+				buf := bytes.Buffer{}
+				if _, err := encoder.Encode(&buf, expected); err != nil {
+					t.Fatalf("seqno %d: %s", c.Seqno, err)
+				}
+				headers := []HeaderField{}
+				if err := roundTrip.Decode(&buf, &headers); err != nil {
+					t.Fatalf("seqno %d: %s", c.Seqno, err)
+				}
+				checkHeaderFields(t, expected, headers)
+			}
+		})
+	}
+}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func bytesRepresentation(b []byte) string {
@@ -17,16 +23,110 @@ func bytesRepresentation(b []byte) string {
 func TestNumericRepresentation(t *testing.T) {
 	prefix := uint8(5)
 	for n := uint64(0); n < 100_000; n++ {
-		n2, err := decodeInteger(encodeInteger(n, prefix), prefix)
+		encoded := encodeInteger(n, prefix)
+		n2, consumed, err := decodeInteger(encoded, prefix, math.MaxUint64)
 		if err != nil {
 			t.Errorf("decoding error: %s", err)
 		}
 		if n2 != n {
 			t.Errorf("Excepted %d got %d", n, n2)
 		}
+		if consumed != len(encoded) {
+			t.Errorf("expected %d bytes consumed got %d", len(encoded), consumed)
+		}
+	}
+}
+
+func TestNumericRepresentationLimits(t *testing.T) {
+	tests := []struct {
+		raw      []byte
+		prefix   uint8
+		max      uint64
+		expected uint64
+		consumed int
+		err      error
+	}{
+		// RFC 7541 C.1.1 - C.1.3, with trailing octets left untouched
+		{raw: []byte{0x0a, 0xff}, prefix: 5, max: math.MaxUint64, expected: 10, consumed: 1},
+		{raw: []byte{0x1f, 0x9a, 0x0a, 0xff}, prefix: 5, max: math.MaxUint64, expected: 1337, consumed: 3},
+		{raw: []byte{0x2a}, prefix: 8, max: math.MaxUint64, expected: 42, consumed: 1},
+		{
+			raw:    []byte{0xff, 0x80, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+			prefix: 8, max: math.MaxUint64, expected: math.MaxUint64, consumed: 11,
+		},
+		{raw: []byte{}, prefix: 5, max: math.MaxUint64, err: ErrTruncated},
+		{raw: []byte{0x1f}, prefix: 5, max: math.MaxUint64, err: ErrTruncated},
+		{raw: []byte{0x1f, 0x9a}, prefix: 5, max: math.MaxUint64, err: ErrTruncated},
+		{raw: []byte{0x1f, 0x9a, 0x0a}, prefix: 5, max: 1000, err: ErrIntegerOverflow},
+		{
+			raw:    []byte{0xff, 0x81, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+			prefix: 8, max: math.MaxUint64, err: ErrIntegerOverflow,
+		},
+		{
+			raw:    []byte{0xff, 0x80, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02},
+			prefix: 8, max: math.MaxUint64, err: ErrIntegerOverflow,
+		},
+		{
+			raw:    []byte{0x1f, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x00},
+			prefix: 5, max: math.MaxUint64, err: ErrDecodingNumber,
+		},
+	}
+
+	for _, test := range tests {
+		n, consumed, err := decodeInteger(test.raw, test.prefix, test.max)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: expected %s got %v", bytesRepresentation(test.raw), test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %s", bytesRepresentation(test.raw), err)
+			continue
+		}
+		if n != test.expected || consumed != test.consumed {
+			t.Errorf("%s: expected %d (%d bytes) got %d (%d bytes)", bytesRepresentation(test.raw), test.expected, test.consumed, n, consumed)
+		}
 	}
 }
 
+func FuzzDecodeInteger(f *testing.F) {
+	f.Add([]byte{0x1f, 0x9a, 0x0a}, uint8(5))
+	f.Add([]byte{0xff, 0x80, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, uint8(8))
+	f.Fuzz(func(t *testing.T, raw []byte, prefix uint8) {
+		prefix = prefix%8 + 1
+		n, consumed, err := decodeInteger(raw, prefix, math.MaxUint64)
+		if err != nil {
+			return
+		}
+		if consumed < 1 || consumed > len(raw) || consumed > maxIntegerOctets+1 {
+			t.Fatalf("invalid number of consumed bytes %d for %s", consumed, bytesRepresentation(raw))
+		}
+		// Re-encoding yields the shortest representation, which is
+		// never longer than the one we decoded.
+		encoded := encodeInteger(n, prefix)
+		if len(encoded) > consumed {
+			t.Fatalf("%d re-encoded to %s, longer than %s", n, bytesRepresentation(encoded), bytesRepresentation(raw[:consumed]))
+		}
+	})
+}
+
+func FuzzIntegerRoundTrip(f *testing.F) {
+	f.Add(uint64(1337), uint8(5))
+	f.Add(uint64(math.MaxUint64), uint8(1))
+	f.Fuzz(func(t *testing.T, n uint64, prefix uint8) {
+		prefix = prefix%8 + 1
+		encoded := encodeInteger(n, prefix)
+		n2, consumed, err := decodeInteger(encoded, prefix, math.MaxUint64)
+		if err != nil {
+			t.Fatalf("decoding %d: %s", n, err)
+		}
+		if n2 != n || consumed != len(encoded) {
+			t.Fatalf("expected %d (%d bytes) got %d (%d bytes)", n, len(encoded), n2, consumed)
+		}
+	})
+}
+
 func TestHeaderFieldEncoding(t *testing.T) {
 	expected := []byte{
 		0x82, 0x04, 0x84, 0x61,
@@ -40,10 +140,10 @@ func TestHeaderFieldEncoding(t *testing.T) {
 	}
 
 	headerFields := []HeaderField{
-		{name: ":method:", value: "GET"},
-		{name: ":path:", value: "/test"},
-		{name: ":scheme:", value: "https"},
-		{name: ":authority:", value: "localhost"},
+		{name: ":method", value: "GET"},
+		{name: ":path", value: "/test"},
+		{name: ":scheme", value: "https"},
+		{name: ":authority", value: "localhost"},
 		{name: "user-agent", value: "curl/7.85.0"},
 		{name: "accept", value: "*/*"},
 	}
@@ -61,7 +161,7 @@ func TestHeaderFieldEncoding(t *testing.T) {
 }
 func TestHeaderFieldDecoding(t *testing.T) {
 	expectedHeaders := []HeaderField{
-		{name: ":status:", value: "200"},
+		{name: ":status", value: "200"},
 		{name: "server", value: "nginx/1.24.0"},
 		{name: "date", value: "Fri, 23 May 2025 16:12:32 GMT"},
 		{name: "content-type", value: "text/html"},
@@ -104,3 +204,172 @@ func TestHeaderFieldDecoding(t *testing.T) {
 		}
 	}
 }
+
+func TestHeaderFieldDecodingLongValue(t *testing.T) {
+	value := strings.Repeat("a", 300)
+
+	// Literal Header Field without Indexing -- Indexed name (cookie),
+	// the 300 octet length needs two continuation octets.
+	raw := []byte{0x0f, 0x11, 0x7f, 0xad, 0x01}
+	raw = append(raw, value...)
+
+	headers := []HeaderField{}
+	decoder := NewHPackDecoder()
+	if err := decoder.Decode(bytes.NewReader(raw), &headers); err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	if len(headers) != 1 {
+		t.Fatalf("expected 1 header got %d", len(headers))
+	}
+	if headers[0].name != "cookie" || headers[0].value != value {
+		t.Errorf("unexpected header %s: %s", headers[0].name, headers[0].value)
+	}
+}
+
+func TestHeaderFieldDecodingDynamicTable(t *testing.T) {
+	decoder := NewHPackDecoder()
+
+	// custom-key: custom-header with incremental indexing, then index 62.
+	raw := []byte{
+		0x40, 0x0a, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x2d, 0x6b, 0x65, 0x79,
+		0x0d, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x2d, 0x68, 0x65, 0x61, 0x64,
+		0x65, 0x72, 0xbe,
+	}
+	headers := []HeaderField{}
+	if err := decoder.Decode(bytes.NewReader(raw), &headers); err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	if len(headers) != 2 {
+		t.Fatalf("expected 2 headers got %d", len(headers))
+	}
+	for _, hf := range headers {
+		if hf.name != "custom-key" || hf.value != "custom-header" {
+			t.Errorf("unexpected header %s: %s", hf.name, hf.value)
+		}
+	}
+
+	headers = []HeaderField{}
+	if err := decoder.Decode(bytes.NewReader([]byte{0xbf}), &headers); !errors.Is(err, ErrInvalidIndex) {
+		t.Errorf("expected %s got %v", ErrInvalidIndex, err)
+	}
+}
+
+func TestHeaderFieldDecodingTruncated(t *testing.T) {
+	tests := [][]byte{
+		{0xff},                   // integer without its continuation octets
+		{0xff, 0x80},             // unterminated continuation
+		{0x04},                   // missing value
+		{0x04, 0x85, 0x61},       // value shorter than its length
+		{0x40, 0x0a, 0x63, 0x75}, // name shorter than its length
+	}
+
+	for _, raw := range tests {
+		headers := []HeaderField{}
+		decoder := NewHPackDecoder()
+		if err := decoder.Decode(bytes.NewReader(raw), &headers); !errors.Is(err, ErrTruncated) {
+			t.Errorf("%s: expected %s got %v", bytesRepresentation(raw), ErrTruncated, err)
+		}
+	}
+}
+
+func TestHeaderFieldDecodingMaxStringLength(t *testing.T) {
+	raw := []byte{0x04, 0x05}
+	raw = append(raw, "/path"...)
+
+	decoder := NewHPackDecoder()
+	decoder.SetMaxStringLength(4)
+	headers := []HeaderField{}
+	if err := decoder.Decode(bytes.NewReader(raw), &headers); !errors.Is(err, ErrStringTooLong) {
+		t.Errorf("expected %s got %v", ErrStringTooLong, err)
+	}
+}
+
+func TestHeaderFieldDecodingHugeStringLength(t *testing.T) {
+	// :path with a 4 GiB value declared in a 7 octet header block.
+	for _, huffman := range []byte{0x00, 0x80} {
+		raw := append([]byte{0x04}, encodeInteger(maxHPackInteger, 7)...)
+		raw[1] |= huffman
+		raw = append(raw, 'a')
+
+		readers := map[string]io.Reader{
+			"bytes.Reader": bytes.NewReader(raw),
+			"io.Reader":    iotest.OneByteReader(bytes.NewReader(raw)),
+		}
+		for name, r := range readers {
+			decoder := NewHPackDecoder()
+			decoder.SetMaxStringLength(0)
+			headers := []HeaderField{}
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			err := decoder.Decode(r, &headers)
+			runtime.ReadMemStats(&after)
+
+			if !errors.Is(err, ErrTruncated) {
+				t.Errorf("%s %s: expected %s got %v", name, bytesRepresentation(raw), ErrTruncated, err)
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+				t.Errorf("%s %s: allocated %d bytes", name, bytesRepresentation(raw), allocated)
+			}
+		}
+	}
+}
+
+func TestHeaderFieldDecodingMaxHeaderListSize(t *testing.T) {
+	decoder := NewHPackDecoder()
+	decoder.SetMaxHeaderListSize(1000)
+
+	// Insert a 100 octet value into the dynamic table and reference it
+	// over and over again.
+	raw := []byte{0x60, 0x64}
+	raw = append(raw, strings.Repeat("a", 100)...)
+	for i := 0; i < 1000; i++ {
+		raw = append(raw, 0xbe)
+	}
+	// A field after the limit still updates the dynamic table.
+	raw = append(raw, 0x40, 0x01, 'x', 0x01, 'y')
+
+	headers := []HeaderField{}
+	if err := decoder.Decode(bytes.NewReader(raw), &headers); !errors.Is(err, ErrHeaderListTooLarge) {
+		t.Fatalf("expected %s got %v", ErrHeaderListTooLarge, err)
+	}
+	if len(headers) > 1000/(100+len("cookie")+32) {
+		t.Errorf("expected decoding to stop at the limit, got %d headers", len(headers))
+	}
+
+	// The decoder is still usable and in sync.
+	headers = []HeaderField{}
+	if err := decoder.Decode(bytes.NewReader([]byte{0xbe, 0xbf}), &headers); err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	if len(headers) != 2 || headers[0].name != "x" || headers[1].name != "cookie" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
+
+func TestHeaderFieldDecodingHuffmanExpansion(t *testing.T) {
+	// "0000000000" is 50 bits, so 7 octets expand to 10.
+	encoded := HuffmanEncode("0000000000")
+	raw := append([]byte{0x04, 0x80 | byte(len(encoded))}, encoded...)
+
+	decoder := NewHPackDecoder()
+	decoder.SetMaxStringLength(8)
+	headers := []HeaderField{}
+	if err := decoder.Decode(bytes.NewReader(raw), &headers); !errors.Is(err, ErrStringTooLong) {
+		t.Errorf("expected %s got %v", ErrStringTooLong, err)
+	}
+}
+
+func TestHeaderFieldDecodingInvalidHuffman(t *testing.T) {
+	// :path with a Huffman encoded value made of EOS
+	raw := []byte{0x04, 0x84, 0xff, 0xff, 0xff, 0xff}
+
+	decoder := NewHPackDecoder()
+	headers := []HeaderField{}
+	if err := decoder.Decode(bytes.NewReader(raw), &headers); !errors.Is(err, ErrHuffmanEOS) {
+		t.Errorf("expected %s got %v", ErrHuffmanEOS, err)
+	}
+	if len(headers) != 0 {
+		t.Errorf("expected no headers got %v", headers)
+	}
+}
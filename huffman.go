@@ -1,234 +1,484 @@
 package main
 
-import "strconv"
-
-// TODO: Implementation is so fucking stupid. Write a better one
-
-var huffmanCodes = map[rune]string{
-	'-':  "010110",
-	' ':  "010100",
-	',':  "11111010",
-	'/':  "011000",
-	'0':  "00000",
-	'1':  "00001",
-	'2':  "00010",
-	'3':  "011001",
-	'4':  "011010",
-	'5':  "011011",
-	'6':  "011100",
-	'7':  "011101",
-	'8':  "011110",
-	'9':  "011111",
-	':':  "1011100",
-	';':  "11111011",
-	'<':  "111111111111100",
-	'=':  "100000",
-	'>':  "111111111011",
-	'?':  "1111111100",
-	'@':  "1111111111010",
-	'A':  "100001",
-	'B':  "1011101",
-	'C':  "1011110",
-	'D':  "1011111",
-	'E':  "1100000",
-	'F':  "1100001",
-	'G':  "1100010",
-	'H':  "1100011",
-	'I':  "1100100",
-	'J':  "1100101",
-	'K':  "1100110",
-	'L':  "1100111",
-	'M':  "1101000",
-	'N':  "1101001",
-	'O':  "1101010",
-	'P':  "1101011",
-	'Q':  "1101100",
-	'R':  "1101101",
-	'S':  "1101110",
-	'T':  "1101111",
-	'U':  "1110000",
-	'V':  "1110001",
-	'W':  "1110010",
-	'X':  "11111100",
-	'Y':  "1110011",
-	'Z':  "11111101",
-	'[':  "1111111111011",
-	'\\': "1111111111111110|000",
-	']':  "1111111111100",
-	'^':  "11111111111100",
-	'_':  "100010",
-	'`':  "11111111|1111101",
-	'a':  "00011",
-	'b':  "100011",
-	'c':  "00100",
-	'd':  "100100",
-	'e':  "00101",
-	'f':  "100101",
-	'g':  "100110",
-	'h':  "100111",
-	'i':  "00110",
-	'.':  "010111",
-	'j':  "1110100",
-	'k':  "1110101",
-	'l':  "101000",
-	'm':  "101001",
-	'n':  "101010",
-	'o':  "00111",
-	'p':  "101011",
-	'q':  "1110110",
-	'r':  "101100",
-	's':  "01000",
-	't':  "01001",
-	'u':  "101101",
-	'v':  "1110111",
-	'w':  "1111000",
-	'x':  "1111001",
-	'y':  "1111010",
-	'z':  "1111011",
-	'{':  "111111111111110",
-	'|':  "11111111100",
-	'}':  "11111111111101",
-	'~':  "1111111111101",
-	'"':  "1111111001",
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidHuffman is wrapped by all Huffman decoding errors, which
+	// a connection must treat as a COMPRESSION_ERROR.
+	ErrInvalidHuffman = errors.New("invalid Huffman encoded string")
+
+	ErrHuffmanInvalidCode = fmt.Errorf("%w: incomplete code", ErrInvalidHuffman)
+	ErrHuffmanPadding     = fmt.Errorf("%w: padding longer than 7 bits", ErrInvalidHuffman)
+	ErrHuffmanEOS         = fmt.Errorf("%w: EOS in string", ErrInvalidHuffman)
+)
+
+// huffmanCodes is the Huffman code of RFC 7541 Appendix B for every octet,
+// right aligned in code.
+var huffmanCodes = [256]struct {
+	code   uint32
+	length uint8
+}{
+	0x00: {0x1ff8, 13},
+	0x01: {0x7fffd8, 23},
+	0x02: {0xfffffe2, 28},
+	0x03: {0xfffffe3, 28},
+	0x04: {0xfffffe4, 28},
+	0x05: {0xfffffe5, 28},
+	0x06: {0xfffffe6, 28},
+	0x07: {0xfffffe7, 28},
+	0x08: {0xfffffe8, 28},
+	0x09: {0xffffea, 24},
+	0x0a: {0x3ffffffc, 30},
+	0x0b: {0xfffffe9, 28},
+	0x0c: {0xfffffea, 28},
+	0x0d: {0x3ffffffd, 30},
+	0x0e: {0xfffffeb, 28},
+	0x0f: {0xfffffec, 28},
+	0x10: {0xfffffed, 28},
+	0x11: {0xfffffee, 28},
+	0x12: {0xfffffef, 28},
+	0x13: {0xffffff0, 28},
+	0x14: {0xffffff1, 28},
+	0x15: {0xffffff2, 28},
+	0x16: {0x3ffffffe, 30},
+	0x17: {0xffffff3, 28},
+	0x18: {0xffffff4, 28},
+	0x19: {0xffffff5, 28},
+	0x1a: {0xffffff6, 28},
+	0x1b: {0xffffff7, 28},
+	0x1c: {0xffffff8, 28},
+	0x1d: {0xffffff9, 28},
+	0x1e: {0xffffffa, 28},
+	0x1f: {0xffffffb, 28},
+	' ':  {0x14, 6},
+	'!':  {0x3f8, 10},
+	'"':  {0x3f9, 10},
+	'#':  {0xffa, 12},
+	'$':  {0x1ff9, 13},
+	'%':  {0x15, 6},
+	'&':  {0xf8, 8},
+	'\'': {0x7fa, 11},
+	'(':  {0x3fa, 10},
+	')':  {0x3fb, 10},
+	'*':  {0xf9, 8},
+	'+':  {0x7fb, 11},
+	',':  {0xfa, 8},
+	'-':  {0x16, 6},
+	'.':  {0x17, 6},
+	'/':  {0x18, 6},
+	'0':  {0x0, 5},
+	'1':  {0x1, 5},
+	'2':  {0x2, 5},
+	'3':  {0x19, 6},
+	'4':  {0x1a, 6},
+	'5':  {0x1b, 6},
+	'6':  {0x1c, 6},
+	'7':  {0x1d, 6},
+	'8':  {0x1e, 6},
+	'9':  {0x1f, 6},
+	':':  {0x5c, 7},
+	';':  {0xfb, 8},
+	'<':  {0x7ffc, 15},
+	'=':  {0x20, 6},
+	'>':  {0xffb, 12},
+	'?':  {0x3fc, 10},
+	'@':  {0x1ffa, 13},
+	'A':  {0x21, 6},
+	'B':  {0x5d, 7},
+	'C':  {0x5e, 7},
+	'D':  {0x5f, 7},
+	'E':  {0x60, 7},
+	'F':  {0x61, 7},
+	'G':  {0x62, 7},
+	'H':  {0x63, 7},
+	'I':  {0x64, 7},
+	'J':  {0x65, 7},
+	'K':  {0x66, 7},
+	'L':  {0x67, 7},
+	'M':  {0x68, 7},
+	'N':  {0x69, 7},
+	'O':  {0x6a, 7},
+	'P':  {0x6b, 7},
+	'Q':  {0x6c, 7},
+	'R':  {0x6d, 7},
+	'S':  {0x6e, 7},
+	'T':  {0x6f, 7},
+	'U':  {0x70, 7},
+	'V':  {0x71, 7},
+	'W':  {0x72, 7},
+	'X':  {0xfc, 8},
+	'Y':  {0x73, 7},
+	'Z':  {0xfd, 8},
+	'[':  {0x1ffb, 13},
+	'\\': {0x7fff0, 19},
+	']':  {0x1ffc, 13},
+	'^':  {0x3ffc, 14},
+	'_':  {0x22, 6},
+	'`':  {0x7ffd, 15},
+	'a':  {0x3, 5},
+	'b':  {0x23, 6},
+	'c':  {0x4, 5},
+	'd':  {0x24, 6},
+	'e':  {0x5, 5},
+	'f':  {0x25, 6},
+	'g':  {0x26, 6},
+	'h':  {0x27, 6},
+	'i':  {0x6, 5},
+	'j':  {0x74, 7},
+	'k':  {0x75, 7},
+	'l':  {0x28, 6},
+	'm':  {0x29, 6},
+	'n':  {0x2a, 6},
+	'o':  {0x7, 5},
+	'p':  {0x2b, 6},
+	'q':  {0x76, 7},
+	'r':  {0x2c, 6},
+	's':  {0x8, 5},
+	't':  {0x9, 5},
+	'u':  {0x2d, 6},
+	'v':  {0x77, 7},
+	'w':  {0x78, 7},
+	'x':  {0x79, 7},
+	'y':  {0x7a, 7},
+	'z':  {0x7b, 7},
+	'{':  {0x7ffe, 15},
+	'|':  {0x7fc, 11},
+	'}':  {0x3ffd, 14},
+	'~':  {0x1ffd, 13},
+	0x7f: {0xffffffc, 28},
+	0x80: {0xfffe6, 20},
+	0x81: {0x3fffd2, 22},
+	0x82: {0xfffe7, 20},
+	0x83: {0xfffe8, 20},
+	0x84: {0x3fffd3, 22},
+	0x85: {0x3fffd4, 22},
+	0x86: {0x3fffd5, 22},
+	0x87: {0x7fffd9, 23},
+	0x88: {0x3fffd6, 22},
+	0x89: {0x7fffda, 23},
+	0x8a: {0x7fffdb, 23},
+	0x8b: {0x7fffdc, 23},
+	0x8c: {0x7fffdd, 23},
+	0x8d: {0x7fffde, 23},
+	0x8e: {0xffffeb, 24},
+	0x8f: {0x7fffdf, 23},
+	0x90: {0xffffec, 24},
+	0x91: {0xffffed, 24},
+	0x92: {0x3fffd7, 22},
+	0x93: {0x7fffe0, 23},
+	0x94: {0xffffee, 24},
+	0x95: {0x7fffe1, 23},
+	0x96: {0x7fffe2, 23},
+	0x97: {0x7fffe3, 23},
+	0x98: {0x7fffe4, 23},
+	0x99: {0x1fffdc, 21},
+	0x9a: {0x3fffd8, 22},
+	0x9b: {0x7fffe5, 23},
+	0x9c: {0x3fffd9, 22},
+	0x9d: {0x7fffe6, 23},
+	0x9e: {0x7fffe7, 23},
+	0x9f: {0xffffef, 24},
+	0xa0: {0x3fffda, 22},
+	0xa1: {0x1fffdd, 21},
+	0xa2: {0xfffe9, 20},
+	0xa3: {0x3fffdb, 22},
+	0xa4: {0x3fffdc, 22},
+	0xa5: {0x7fffe8, 23},
+	0xa6: {0x7fffe9, 23},
+	0xa7: {0x1fffde, 21},
+	0xa8: {0x7fffea, 23},
+	0xa9: {0x3fffdd, 22},
+	0xaa: {0x3fffde, 22},
+	0xab: {0xfffff0, 24},
+	0xac: {0x1fffdf, 21},
+	0xad: {0x3fffdf, 22},
+	0xae: {0x7fffeb, 23},
+	0xaf: {0x7fffec, 23},
+	0xb0: {0x1fffe0, 21},
+	0xb1: {0x1fffe1, 21},
+	0xb2: {0x3fffe0, 22},
+	0xb3: {0x1fffe2, 21},
+	0xb4: {0x7fffed, 23},
+	0xb5: {0x3fffe1, 22},
+	0xb6: {0x7fffee, 23},
+	0xb7: {0x7fffef, 23},
+	0xb8: {0xfffea, 20},
+	0xb9: {0x3fffe2, 22},
+	0xba: {0x3fffe3, 22},
+	0xbb: {0x3fffe4, 22},
+	0xbc: {0x7ffff0, 23},
+	0xbd: {0x3fffe5, 22},
+	0xbe: {0x3fffe6, 22},
+	0xbf: {0x7ffff1, 23},
+	0xc0: {0x3ffffe0, 26},
+	0xc1: {0x3ffffe1, 26},
+	0xc2: {0xfffeb, 20},
+	0xc3: {0x7fff1, 19},
+	0xc4: {0x3fffe7, 22},
+	0xc5: {0x7ffff2, 23},
+	0xc6: {0x3fffe8, 22},
+	0xc7: {0x1ffffec, 25},
+	0xc8: {0x3ffffe2, 26},
+	0xc9: {0x3ffffe3, 26},
+	0xca: {0x3ffffe4, 26},
+	0xcb: {0x7ffffde, 27},
+	0xcc: {0x7ffffdf, 27},
+	0xcd: {0x3ffffe5, 26},
+	0xce: {0xfffff1, 24},
+	0xcf: {0x1ffffed, 25},
+	0xd0: {0x7fff2, 19},
+	0xd1: {0x1fffe3, 21},
+	0xd2: {0x3ffffe6, 26},
+	0xd3: {0x7ffffe0, 27},
+	0xd4: {0x7ffffe1, 27},
+	0xd5: {0x3ffffe7, 26},
+	0xd6: {0x7ffffe2, 27},
+	0xd7: {0xfffff2, 24},
+	0xd8: {0x1fffe4, 21},
+	0xd9: {0x1fffe5, 21},
+	0xda: {0x3ffffe8, 26},
+	0xdb: {0x3ffffe9, 26},
+	0xdc: {0xffffffd, 28},
+	0xdd: {0x7ffffe3, 27},
+	0xde: {0x7ffffe4, 27},
+	0xdf: {0x7ffffe5, 27},
+	0xe0: {0xfffec, 20},
+	0xe1: {0xfffff3, 24},
+	0xe2: {0xfffed, 20},
+	0xe3: {0x1fffe6, 21},
+	0xe4: {0x3fffe9, 22},
+	0xe5: {0x1fffe7, 21},
+	0xe6: {0x1fffe8, 21},
+	0xe7: {0x7ffff3, 23},
+	0xe8: {0x3fffea, 22},
+	0xe9: {0x3fffeb, 22},
+	0xea: {0x1ffffee, 25},
+	0xeb: {0x1ffffef, 25},
+	0xec: {0xfffff4, 24},
+	0xed: {0xfffff5, 24},
+	0xee: {0x3ffffea, 26},
+	0xef: {0x7ffff4, 23},
+	0xf0: {0x3ffffeb, 26},
+	0xf1: {0x7ffffe6, 27},
+	0xf2: {0x3ffffec, 26},
+	0xf3: {0x3ffffed, 26},
+	0xf4: {0x7ffffe7, 27},
+	0xf5: {0x7ffffe8, 27},
+	0xf6: {0x7ffffe9, 27},
+	0xf7: {0x7ffffea, 27},
+	0xf8: {0x7ffffeb, 27},
+	0xf9: {0xffffffe, 28},
+	0xfa: {0x7ffffec, 27},
+	0xfb: {0x7ffffed, 27},
+	0xfc: {0x7ffffee, 27},
+	0xfd: {0x7ffffef, 27},
+	0xfe: {0x7fffff0, 27},
+	0xff: {0x3ffffee, 26},
 }
 
-func HuffmanEncode(s string) []byte {
-	seq := ""
-	for _, char := range s {
-		binStr, found := huffmanCodes[char]
-		if !found {
-			binStr = strconv.FormatInt(int64(char), 2)
-		}
-		seq += binStr
+// huffmanEOS is the code of the end-of-string symbol (256). It is never
+// emitted, but its most significant bits are used as padding.
+const (
+	huffmanEOS       = 0x3fffffff
+	huffmanEOSLength = 30
+)
+
+// HuffmanEncodedLen returns the length of the Huffman encoding of s, so that
+// callers can decide whether Huffman coding is worth it without encoding.
+func HuffmanEncodedLen(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		n += int(huffmanCodes[s[i]].length)
+	}
+	return (n + 7) / 8
+}
+
+// huffmanEncoder packs codes into octets. It is the state shared by
+// AppendHuffman and HuffmanWriter.
+type huffmanEncoder struct {
+	bits uint64 // pending bits, right aligned
+	n    uint   // number of pending bits
+}
+
+func (e *huffmanEncoder) appendByte(dst []byte, c byte) []byte {
+	code := huffmanCodes[c]
+	e.bits = e.bits<<code.length | uint64(code.code)
+	e.n += uint(code.length)
+	for e.n >= 8 {
+		e.n -= 8
+		dst = append(dst, byte(e.bits>>e.n))
 	}
+	return dst
+}
+
+// finish pads the pending bits to an octet boundary with the most
+// significant bits of EOS.
+func (e *huffmanEncoder) finish(dst []byte) []byte {
+	if e.n > 0 {
+		dst = append(dst, byte(e.bits<<(8-e.n))|byte(0xff>>e.n))
+	}
+	*e = huffmanEncoder{}
+	return dst
+}
+
+// AppendHuffman appends the Huffman encoding of s to dst.
+func AppendHuffman(dst []byte, s string) []byte {
+	e := huffmanEncoder{}
+	for i := 0; i < len(s); i++ {
+		dst = e.appendByte(dst, s[i])
+	}
+	return e.finish(dst)
+}
+
+func HuffmanEncode(s string) []byte {
+	return AppendHuffman(make([]byte, 0, HuffmanEncodedLen(s)), s)
+}
 
-	paddingLength := (8 - (len(seq) % 8)) % 8
-	padding := ""
-	for i := 0; i < paddingLength; i++ {
-		padding += "1"
+/*
+The decoder is a state machine consuming four bits at a time. Its states
+are the internal nodes of the Huffman tree, 256 of them since the tree has
+257 leaves, so a state fits in an octet. Every code is at least 5 bits
+long, so one nibble emits at most one symbol.
+*/
+type huffmanTransition struct {
+	next  uint8
+	sym   byte
+	flags uint8
+}
+
+const (
+	// huffmanEmit is set when the transition decodes sym.
+	huffmanEmit uint8 = 1 << iota
+	// huffmanFail is set when the transition reaches EOS.
+	huffmanFail
+)
+
+var (
+	huffmanDecodeTable [256][16]huffmanTransition
+	// huffmanAccepting marks the states a string may end in: the root, or
+	// at most 7 bits down the all-ones path of EOS.
+	huffmanAccepting [256]bool
+	// huffmanAllOnes marks every state on the all-ones path of EOS, to
+	// tell overlong padding from an incomplete code.
+	huffmanAllOnes [256]bool
+)
+
+func init() {
+	type node struct {
+		children [2]int // indexes into nodes, -1 if none
+		sym      int    // the leaf symbol, 256 for EOS, -1 for internal nodes
+		state    int    // the state of an internal node
 	}
-	seq += padding
-
-	b := []byte{}
-	for i := 0; i < len(seq); i += 8 {
-		var n uint64 = 0
-		for j := 0; j < 8; j++ {
-			if seq[i+j] == '1' {
-				n += pow(2, uint8(7-j))
+
+	nodes := []node{{children: [2]int{-1, -1}, sym: -1}}
+	insert := func(sym int, code uint32, length uint8) {
+		cur := 0
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if nodes[cur].children[bit] == -1 {
+				nodes = append(nodes, node{children: [2]int{-1, -1}, sym: -1})
+				nodes[cur].children[bit] = len(nodes) - 1
 			}
+			cur = nodes[cur].children[bit]
 		}
+		nodes[cur].sym = sym
+	}
+	for sym, code := range huffmanCodes {
+		insert(sym, code.code, code.length)
+	}
+	insert(256, huffmanEOS, huffmanEOSLength)
 
-		b = append(b, uint8(n))
+	// Number the internal nodes, the root being state 0.
+	internal := []int{}
+	for i := range nodes {
+		if nodes[i].sym == -1 {
+			nodes[i].state = len(internal)
+			internal = append(internal, i)
+		}
 	}
 
-	return b
+	// Walk the all-ones path to find the accepting states.
+	for cur, depth := 0, 0; nodes[cur].sym == -1; depth++ {
+		huffmanAllOnes[nodes[cur].state] = true
+		huffmanAccepting[nodes[cur].state] = depth <= 7
+		cur = nodes[cur].children[1]
+	}
+
+	for _, start := range internal {
+		for nibble := 0; nibble < 16; nibble++ {
+			t := huffmanTransition{}
+			cur := start
+			for i := 3; i >= 0; i-- {
+				cur = nodes[cur].children[(nibble>>uint(i))&1]
+				if sym := nodes[cur].sym; sym == 256 {
+					t.flags |= huffmanFail
+					break
+				} else if sym >= 0 {
+					t.flags |= huffmanEmit
+					t.sym = byte(sym)
+					cur = 0
+				}
+			}
+			t.next = uint8(nodes[cur].state)
+			huffmanDecodeTable[nodes[start].state][nibble] = t
+		}
+	}
 }
 
-var huffmanDecodeCodes = map[string]rune{
-	"010100":               ' ',
-	"11111010":             ',',
-	"011000":               '/',
-	"00000":                '0',
-	"00001":                '1',
-	"00010":                '2',
-	"011001":               '3',
-	"011010":               '4',
-	"011011":               '5',
-	"011100":               '6',
-	"011101":               '7',
-	"011110":               '8',
-	"011111":               '9',
-	"1011100":              ':',
-	"11111011":             ';',
-	"111111111111100":      '<',
-	"100000":               '=',
-	"111111111011":         '>',
-	"1111111100":           '?',
-	"1111111111010":        '@',
-	"100001":               'A',
-	"1011101":              'B',
-	"1011110":              'C',
-	"1011111":              'D',
-	"1100000":              'E',
-	"1100001":              'F',
-	"1100010":              'G',
-	"1100011":              'H',
-	"1100100":              'I',
-	"1100101":              'J',
-	"1100110":              'K',
-	"1100111":              'L',
-	"1101000":              'M',
-	"1101001":              'N',
-	"1101010":              'O',
-	"1101011":              'P',
-	"1101100":              'Q',
-	"1101101":              'R',
-	"1101110":              'S',
-	"1101111":              'T',
-	"1110000":              'U',
-	"1110001":              'V',
-	"1110010":              'W',
-	"11111100":             'X',
-	"1110011":              'Y',
-	"11111101":             'Z',
-	"1111111111011":        '[',
-	"1111111111111110|000": '\\',
-	"1111111111100":        ']',
-	"11111111111100":       '^',
-	"100010":               '_',
-	"11111111|1111101":     '`',
-	"00011":                'a',
-	"100011":               'b',
-	"00100":                'c',
-	"100100":               'd',
-	"00101":                'e',
-	"100101":               'f',
-	"100110":               'g',
-	"100111":               'h',
-	"00110":                'i',
-	"010111":               '.',
-	"1110100":              'j',
-	"1110101":              'k',
-	"101000":               'l',
-	"101001":               'm',
-	"101010":               'n',
-	"00111":                'o',
-	"101011":               'p',
-	"1110110":              'q',
-	"101100":               'r',
-	"01000":                's',
-	"01001":                't',
-	"101101":               'u',
-	"1110111":              'v',
-	"1111000":              'w',
-	"1111001":              'x',
-	"1111010":              'y',
-	"1111011":              'z',
-	"111111111111110":      '{',
-	"11111111100":          '|',
-	"11111111111101":       '}',
-	"1111111111101":        '~',
-	"1111111001":           '"',
-	"010110":               '-',
+// huffmanDecoder runs the state machine over successive chunks of one
+// string. It is the state shared by appendHuffmanDecode and HuffmanReader.
+type huffmanDecoder struct {
+	state uint8
 }
 
-func HuffmanDecode(b []byte) string {
-	binaryRepr := ""
+func (d *huffmanDecoder) decode(dst []byte, b []byte) ([]byte, error) {
 	for _, c := range b {
-		for i := 7; i >= 0; i-- {
-			binaryRepr += string(((c >> i) & 0x1) + 48) // 48 = '0'
+		for _, nibble := range [2]byte{c >> 4, c & 0x0f} {
+			t := huffmanDecodeTable[d.state][nibble]
+			if t.flags&huffmanFail != 0 {
+				return dst, ErrHuffmanEOS
+			}
+			if t.flags&huffmanEmit != 0 {
+				dst = append(dst, t.sym)
+			}
+			d.state = t.next
 		}
 	}
+	return dst, nil
+}
 
-	tmp := ""
-	decodedStr := ""
-	for _, c := range binaryRepr {
-		tmp += string(c)
-		if char, found := huffmanDecodeCodes[tmp]; found {
-			decodedStr += string(char)
-			tmp = ""
+// finish checks the string ends on a valid padding.
+func (d *huffmanDecoder) finish() error {
+	if !huffmanAccepting[d.state] {
+		if huffmanAllOnes[d.state] {
+			return ErrHuffmanPadding
 		}
+		return ErrHuffmanInvalidCode
 	}
+	return nil
+}
 
-	return decodedStr
+// appendHuffmanDecode appends the decoding of b to dst. It fails with
+// ErrHuffmanEOS on EOS in the string, with ErrHuffmanPadding on padding
+// longer than 7 bits and with ErrHuffmanInvalidCode when the string ends
+// with bits that are not the most significant bits of EOS (RFC 7541
+// section 5.2). On failure the octets decoded so far are returned.
+func appendHuffmanDecode(dst []byte, b []byte) ([]byte, error) {
+	d := huffmanDecoder{}
+	dst, err := d.decode(dst, b)
+	if err != nil {
+		return dst, err
+	}
+	return dst, d.finish()
+}
+
+func HuffmanDecode(b []byte) (string, error) {
+	decoded, err := appendHuffmanDecode(make([]byte, 0, len(b)*8/5), b)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// huffmanChunkSize bounds how much a HuffmanWriter or HuffmanReader buffers,
+// whatever the size of the string going through it.
+const huffmanChunkSize = 512
+
+// HuffmanWriter Huffman encodes everything written to it into w. The
+// padding is only written by Close, which does not close w.
+type HuffmanWriter struct {
+	w   io.Writer
+	enc huffmanEncoder
+	buf []byte
+}
+
+func NewHuffmanWriter(w io.Writer) *HuffmanWriter {
+	return &HuffmanWriter{w: w}
+}
+
+func (hw *HuffmanWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > huffmanChunkSize {
+			chunk = chunk[:huffmanChunkSize]
+		}
+
+		hw.buf = hw.buf[:0]
+		for _, c := range chunk {
+			hw.buf = hw.enc.appendByte(hw.buf, c)
+		}
+		if _, err := hw.w.Write(hw.buf); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close writes the padding of the last octet.
+func (hw *HuffmanWriter) Close() error {
+	buf := hw.enc.finish(hw.buf[:0])
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := hw.w.Write(buf)
+	return err
+}
+
+// HuffmanReader decodes the Huffman encoded string read from r. It returns
+// io.EOF once r is exhausted and the padding checked, and ErrStringTooLong
+// as soon as more than maxLength octets are decoded, if maxLength is not 0.
+type HuffmanReader struct {
+	r         io.Reader
+	dec       huffmanDecoder
+	maxLength int
+
+	in      [huffmanChunkSize]byte
+	buf     []byte
+	out     []byte // the part of buf not read yet
+	decoded int
+	err     error
+}
+
+func NewHuffmanReader(r io.Reader, maxLength int) *HuffmanReader {
+	return &HuffmanReader{r: r, maxLength: maxLength}
+}
+
+func (hr *HuffmanReader) Read(p []byte) (int, error) {
+	for len(hr.out) == 0 {
+		if hr.err != nil {
+			return 0, hr.err
+		}
+		hr.fill()
+	}
+
+	n := copy(p, hr.out)
+	hr.out = hr.out[n:]
+	return n, nil
+}
+
+// WriteTo lets io.Copy decode straight into w without an extra buffer.
+func (hr *HuffmanReader) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	for {
+		if len(hr.out) > 0 {
+			n, err := w.Write(hr.out)
+			written += int64(n)
+			hr.out = hr.out[n:]
+			if err != nil {
+				return written, err
+			}
+		}
+		if hr.err == io.EOF {
+			return written, nil
+		}
+		if hr.err != nil {
+			return written, hr.err
+		}
+		hr.fill()
+	}
+}
+
+// fill decodes the next chunk of r into out.
+func (hr *HuffmanReader) fill() {
+	n, err := hr.r.Read(hr.in[:])
+
+	out, decodeErr := hr.dec.decode(hr.buf[:0], hr.in[:n])
+	hr.buf = out
+	hr.out = out
+	hr.decoded += len(out)
+	switch {
+	case decodeErr != nil:
+		hr.err = decodeErr
+	case hr.maxLength > 0 && hr.decoded > hr.maxLength:
+		hr.out = nil
+		hr.err = fmt.Errorf("%w: Huffman decoded to more than %d", ErrStringTooLong, hr.maxLength)
+	case err == io.EOF:
+		hr.err = hr.dec.finish()
+		if hr.err == nil {
+			hr.err = io.EOF
+		}
+	case err != nil:
+		hr.err = err
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHuffmanWriter(t *testing.T) {
+	s := strings.Repeat("Mon, 21 Oct 2013 20:13:21 GMT; ", 200)
+
+	buf := bytes.Buffer{}
+	hw := NewHuffmanWriter(&buf)
+	// Odd sized writes so that codes straddle the writes.
+	for i := 0; i < len(s); i += 7 {
+		end := i + 7
+		if end > len(s) {
+			end = len(s)
+		}
+		if _, err := hw.Write([]byte(s[i:end])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(HuffmanEncode(s), buf.Bytes()) {
+		t.Error("streamed encoding differs from HuffmanEncode")
+	}
+}
+
+func TestHuffmanReader(t *testing.T) {
+	s := strings.Repeat("foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; ", 100)
+	encoded := HuffmanEncode(s)
+
+	decoded, err := io.ReadAll(NewHuffmanReader(iotest.OneByteReader(bytes.NewReader(encoded)), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != s {
+		t.Error("streamed decoding differs from the input")
+	}
+
+	if err := iotest.TestReader(NewHuffmanReader(bytes.NewReader(encoded), 0), []byte(s)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHuffmanReaderMaxLength(t *testing.T) {
+	encoded := HuffmanEncode(strings.Repeat("0", 10_000))
+
+	hr := NewHuffmanReader(bytes.NewReader(encoded), 1000)
+	if _, err := io.Copy(io.Discard, hr); !errors.Is(err, ErrStringTooLong) {
+		t.Errorf("expected %s got %v", ErrStringTooLong, err)
+	}
+}
+
+func TestHuffmanReaderInvalid(t *testing.T) {
+	hr := NewHuffmanReader(bytes.NewReader([]byte{0x1f, 0xff}), 0)
+	if _, err := io.ReadAll(hr); !errors.Is(err, ErrHuffmanPadding) {
+		t.Errorf("expected %s got %v", ErrHuffmanPadding, err)
+	}
+}
+
+func TestHeaderFieldDecodingLongHuffmanValue(t *testing.T) {
+	value := strings.Repeat("session=0123456789abcdef; ", 400)
+	encoded := HuffmanEncode(value)
+
+	// Literal Header Field without Indexing -- Indexed name (cookie)
+	raw := []byte{0x0f, 0x11}
+	length := encodeInteger(uint64(len(encoded)), 7)
+	length[0] |= 0x80
+	raw = append(append(raw, length...), encoded...)
+
+	headers := []HeaderField{}
+	if err := NewHPackDecoder().Decode(bytes.NewReader(raw), &headers); err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 1 || headers[0].value != value {
+		t.Error("unexpected decoded value")
+	}
+
+	// The same value cut short is reported as truncated.
+	headers = []HeaderField{}
+	err := NewHPackDecoder().Decode(bytes.NewReader(raw[:len(raw)-10]), &headers)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected %s got %v", ErrTruncated, err)
+	}
+}
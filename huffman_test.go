@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -18,9 +19,178 @@ func TestHuffmanDecode(t *testing.T) {
 	rawEncoded := []byte{170, 99, 85, 229, 128, 174, 38, 151, 7}
 	expectedDecoded := "nginx/1.24.0"
 
-	decoded := HuffmanDecode(rawEncoded)
+	decoded, err := HuffmanDecode(rawEncoded)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if expectedDecoded != decoded {
 		t.Errorf("expected %s got %s", expectedDecoded, decoded)
 	}
 }
+
+func TestHuffmanAllOctets(t *testing.T) {
+	s := make([]byte, 256)
+	for i := range s {
+		s[i] = byte(i)
+	}
+
+	decoded, err := appendHuffmanDecode(nil, HuffmanEncode(string(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s, decoded) {
+		t.Errorf("expected %v got %v", s, decoded)
+	}
+}
+
+func TestHuffmanDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{name: "EOS", raw: []byte{0xff, 0xff, 0xff, 0xff}, err: ErrHuffmanEOS},
+		{name: "EOS after a symbol", raw: []byte{0x1f, 0xff, 0xff, 0xff, 0xfc}, err: ErrHuffmanEOS},
+		{name: "padding too long", raw: []byte{0x1f, 0xff}, err: ErrHuffmanPadding},
+		{name: "padding not EOS", raw: []byte{0x18}, err: ErrHuffmanInvalidCode},
+		{name: "incomplete code", raw: []byte{0xfe}, err: ErrHuffmanInvalidCode},
+	}
+
+	for _, test := range tests {
+		if _, err := HuffmanDecode(test.raw); !errors.Is(err, test.err) || !errors.Is(err, ErrInvalidHuffman) {
+			t.Errorf("%s: expected %s got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestHuffmanEncodedLen(t *testing.T) {
+	for _, s := range []string{"", "a", "nginx/1.24.0", "\x00\xff", "custom-value"} {
+		if n := HuffmanEncodedLen(s); n != len(HuffmanEncode(s)) {
+			t.Errorf("%q: expected %d got %d", s, len(HuffmanEncode(s)), n)
+		}
+	}
+}
+
+func TestHuffmanAllocations(t *testing.T) {
+	s := "Mon, 21 Oct 2013 20:13:21 GMT"
+	encoded := HuffmanEncode(s)
+	dst := make([]byte, 0, 64)
+
+	if n := testing.AllocsPerRun(100, func() { AppendHuffman(dst[:0], s) }); n != 0 {
+		t.Errorf("AppendHuffman allocated %.0f times", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { appendHuffmanDecode(dst[:0], encoded) }); n != 0 {
+		t.Errorf("appendHuffmanDecode allocated %.0f times", n)
+	}
+}
+
+/*
+The bit string implementation below is the one the table driven codec
+replaced. It is only kept to benchmark against.
+*/
+var huffmanBitStrings = func() map[byte]string {
+	bitStrings := map[byte]string{}
+	for c, code := range huffmanCodes {
+		s := ""
+		for i := int(code.length) - 1; i >= 0; i-- {
+			s += string(byte((code.code>>uint(i))&1) + '0')
+		}
+		bitStrings[byte(c)] = s
+	}
+	return bitStrings
+}()
+
+var huffmanBitStringsDecode = func() map[string]byte {
+	decode := map[string]byte{}
+	for c, s := range huffmanBitStrings {
+		decode[s] = c
+	}
+	return decode
+}()
+
+func huffmanEncodeBitString(s string) []byte {
+	seq := ""
+	for i := 0; i < len(s); i++ {
+		seq += huffmanBitStrings[s[i]]
+	}
+	for len(seq)%8 != 0 {
+		seq += "1"
+	}
+
+	b := []byte{}
+	for i := 0; i < len(seq); i += 8 {
+		var n uint8
+		for j := 0; j < 8; j++ {
+			if seq[i+j] == '1' {
+				n |= 1 << (7 - j)
+			}
+		}
+		b = append(b, n)
+	}
+	return b
+}
+
+func huffmanDecodeBitString(b []byte) string {
+	binaryRepr := ""
+	for _, c := range b {
+		for i := 7; i >= 0; i-- {
+			binaryRepr += string(((c >> i) & 0x1) + '0')
+		}
+	}
+
+	tmp := ""
+	decoded := ""
+	for _, c := range binaryRepr {
+		tmp += string(c)
+		if char, found := huffmanBitStringsDecode[tmp]; found {
+			decoded += string(char)
+			tmp = ""
+		}
+	}
+	return decoded
+}
+
+const huffmanBenchmarkString = "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"
+
+func TestHuffmanBitStringReference(t *testing.T) {
+	encoded := HuffmanEncode(huffmanBenchmarkString)
+	if !bytes.Equal(encoded, huffmanEncodeBitString(huffmanBenchmarkString)) {
+		t.Error("encoders disagree")
+	}
+	if huffmanDecodeBitString(encoded) != huffmanBenchmarkString {
+		t.Error("decoders disagree")
+	}
+}
+
+func BenchmarkHuffmanEncode(b *testing.B) {
+	dst := make([]byte, 0, 64)
+	b.SetBytes(int64(len(huffmanBenchmarkString)))
+	for i := 0; i < b.N; i++ {
+		dst = AppendHuffman(dst[:0], huffmanBenchmarkString)
+	}
+}
+
+func BenchmarkHuffmanEncodeBitString(b *testing.B) {
+	b.SetBytes(int64(len(huffmanBenchmarkString)))
+	for i := 0; i < b.N; i++ {
+		huffmanEncodeBitString(huffmanBenchmarkString)
+	}
+}
+
+func BenchmarkHuffmanDecode(b *testing.B) {
+	encoded := HuffmanEncode(huffmanBenchmarkString)
+	dst := make([]byte, 0, 64)
+	b.SetBytes(int64(len(huffmanBenchmarkString)))
+	for i := 0; i < b.N; i++ {
+		dst, _ = appendHuffmanDecode(dst[:0], encoded)
+	}
+}
+
+func BenchmarkHuffmanDecodeBitString(b *testing.B) {
+	encoded := HuffmanEncode(huffmanBenchmarkString)
+	b.SetBytes(int64(len(huffmanBenchmarkString)))
+	for i := 0; i < b.N; i++ {
+		huffmanDecodeBitString(encoded)
+	}
+}
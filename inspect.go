@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+The inspect command decodes captured HPACK header blocks:
+
+	h2 inspect [-binary] [-table-size n] [file ...]
+
+Every non-empty line of the input is a hex encoded header block (whitespace
+and lines starting with '#' are ignored). With -binary every file is one
+raw header block instead. The blocks share one decoding context, as they
+would on a connection, and each one is printed representation by
+representation, followed by the dynamic table it leaves behind.
+*/
+func runInspect(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	binary := flags.Bool("binary", false, "read every file as one raw header block instead of hex lines")
+	tableSize := flags.Uint("table-size", defaultDynamicTableSize, "SETTINGS_HEADER_TABLE_SIZE the blocks were encoded for")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	blocks, err := readInspectBlocks(flags.Args(), stdin, *binary)
+	if err != nil {
+		return err
+	}
+
+	decoder := &hPackDecoder{
+		table:           dynamicTable{maxSize: uint32(*tableSize)},
+		maxTableSize:    uint32(*tableSize),
+		maxStringLength: defaultMaxStringLength,
+	}
+	for i, block := range blocks {
+		fmt.Fprintf(stdout, "block %d: %d octets\n", i+1, len(block))
+		w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		decoder.inspect = func(rep HPackRepresentation) {
+			printRepresentation(w, rep)
+		}
+		err := decoder.Decode(strings.NewReader(string(block)), &[]HeaderField{})
+		w.Flush()
+		if err != nil {
+			return fmt.Errorf("block %d: %w", i+1, err)
+		}
+		printDynamicTable(stdout, &decoder.table)
+	}
+	return nil
+}
+
+// readInspectBlocks reads the header blocks from the files, or from stdin
+// if there are none.
+func readInspectBlocks(paths []string, stdin io.Reader, binary bool) ([][]byte, error) {
+	readers := []io.Reader{stdin}
+	if len(paths) > 0 {
+		readers = readers[:0]
+		for _, path := range paths {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			readers = append(readers, f)
+		}
+	}
+
+	blocks := [][]byte{}
+	for _, r := range readers {
+		if binary {
+			block, err := io.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+			continue
+		}
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := strings.Join(strings.Fields(scanner.Text()), "")
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			block, err := hex.DecodeString(line)
+			if err != nil {
+				return nil, fmt.Errorf("block %d: %w", len(blocks)+1, err)
+			}
+			blocks = append(blocks, block)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+func printRepresentation(w io.Writer, rep HPackRepresentation) {
+	if rep.Type == TableSizeUpdateRepresentation {
+		fmt.Fprintf(w, "  %s\t%d\n", rep.Type, rep.Index)
+		return
+	}
+
+	index := "-"
+	if rep.Index != 0 {
+		index = fmt.Sprint(rep.Index)
+	}
+	huffman := ""
+	switch {
+	case rep.NameHuffman && rep.ValueHuffman:
+		huffman = " [huffman name+value]"
+	case rep.NameHuffman:
+		huffman = " [huffman name]"
+	case rep.ValueHuffman:
+		huffman = " [huffman value]"
+	}
+	fmt.Fprintf(w, "  %s\t%s\t%s%s\n", rep.Type, index, rep.HeaderField, huffman)
+}
+
+// printDynamicTable lists the entries newest first, with the index they
+// are referenced by.
+func printDynamicTable(w io.Writer, table *dynamicTable) {
+	fmt.Fprintf(w, "dynamic table: %d entries, %d/%d octets\n", table.len(), table.size, table.maxSize)
+	for i := 1; i <= table.len(); i++ {
+		hf, _ := table.get(i)
+		fmt.Fprintf(w, "  [%3d] (s = %3d) %s\n", len(staticTable)-1+i, hf.size(), hf)
+	}
+}
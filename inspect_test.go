@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	input := `# RFC 7541 C.4.1 and C.4.2
+8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff
+
+828684be5886a8eb10649cbf
+# size update, then a never indexed field with a literal name
+3f 11 10 0870617373776f7264 06736563726574
+`
+	expected := `block 1: 17 octets
+  indexed                            2  :method: GET
+  indexed                            6  :scheme: http
+  indexed                            4  :path: /
+  literal with incremental indexing  1  :authority: www.example.com [huffman value]
+dynamic table: 1 entries, 57/4096 octets
+  [ 62] (s =  57) :authority: www.example.com
+block 2: 12 octets
+  indexed                            2   :method: GET
+  indexed                            6   :scheme: http
+  indexed                            4   :path: /
+  indexed                            62  :authority: www.example.com
+  literal with incremental indexing  24  cache-control: no-cache [huffman value]
+dynamic table: 2 entries, 110/4096 octets
+  [ 62] (s =  53) cache-control: no-cache
+  [ 63] (s =  57) :authority: www.example.com
+block 3: 19 octets
+  dynamic table size update  48
+  literal never indexed      -  password: secret
+dynamic table: 0 entries, 0/48 octets
+`
+	out := bytes.Buffer{}
+	if err := runInspect(nil, strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestInspectBinary(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "1.bin"), filepath.Join(dir, "2.bin")}
+	// The second block references the entry added by the first one.
+	if err := os.WriteFile(paths[0], mustDecodeHex(t, "400a637573746f6d2d6b65790d637573746f6d2d686561646572"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(paths[1], mustDecodeHex(t, "be"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.Buffer{}
+	if err := runInspect(append([]string{"-binary"}, paths...), nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "block 2: 1 octets\n  indexed  62  custom-key: custom-header\n") {
+		t.Errorf("expected the dynamic table to be kept across blocks, got:\n%s", out.String())
+	}
+}
+
+func TestInspectErrors(t *testing.T) {
+	out := bytes.Buffer{}
+	err := runInspect([]string{"-table-size", "0"}, strings.NewReader("82\n3fe11f\n"), &out)
+	if !errors.Is(err, ErrTableSizeUpdate) {
+		t.Errorf("expected %s got %v", ErrTableSizeUpdate, err)
+	}
+	if !strings.HasPrefix(out.String(), "block 1: 1 octets\n  indexed  2  :method: GET\n") {
+		t.Errorf("expected the first block to be printed, got:\n%s", out.String())
+	}
+
+	if err := runInspect(nil, strings.NewReader("8g\n"), &out); err == nil {
+		t.Error("expected an error for invalid hex")
+	}
+}
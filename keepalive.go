@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrPingTimeout = errors.New("ping timeout")
+)
+
+// defaultPingTimeout bounds the wait for the ACK of a keepalive PING.
+const defaultPingTimeout = 15 * time.Second
+
+/*
+Connections through NATs and load balancers may be dropped without either
+end being told. A client connection configured with a ReadIdleTimeout
+sends a PING once the server has been silent for that long, and a server
+that does not acknowledge it within PingTimeout is presumed gone: the
+connection is closed with ErrPingTimeout, and leaves the pool.
+
+A MaxConnectionAge rotates connections instead: once that old, the
+connection takes no new request, and is closed after its last stream.
+*/
+
+// startKeepalive starts the health check and age timers, before the read
+// loop.
+func (cc *ClientConn) startKeepalive() {
+	if cc.readIdleTimeout > 0 {
+		cc.readIdleTimer = time.AfterFunc(cc.readIdleTimeout, cc.healthCheck)
+	}
+	if cc.maxAge > 0 {
+		cc.ageTimer = time.AfterFunc(cc.maxAge, cc.drain)
+	}
+}
+
+// stopKeepalive stops the timers of startKeepalive.
+func (cc *ClientConn) stopKeepalive() {
+	if cc.readIdleTimer != nil {
+		cc.readIdleTimer.Stop()
+	}
+	if cc.ageTimer != nil {
+		cc.ageTimer.Stop()
+	}
+}
+
+// healthCheck pings the server after ReadIdleTimeout without frames,
+// closing the connection unless the ACK arrives within PingTimeout.
+func (cc *ClientConn) healthCheck() {
+	timeout := cc.pingTimeout
+	if timeout == 0 {
+		timeout = defaultPingTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := cc.Ping(ctx); isContextError(err) {
+		cc.closeWithError(fmt.Errorf("%w: %w: no PING ACK within %s", ErrClientConnClosed, ErrPingTimeout, timeout))
+	}
+}
+
+// Ping sends a PING and waits for its ACK, or until ctx is done.
+func (cc *ClientConn) Ping(ctx context.Context) error {
+	var data [8]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return err
+	}
+	ack := make(chan struct{})
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return cc.err
+	}
+	if cc.pings == nil {
+		cc.pings = map[[8]byte]chan struct{}{}
+	}
+	cc.pings[data] = ack
+	cc.mu.Unlock()
+	defer func() {
+		cc.mu.Lock()
+		delete(cc.pings, data)
+		cc.mu.Unlock()
+	}()
+
+	if err := cc.conn.WriteFrame(Frame{Type: PingFrameType, Data: PingFrame{Data: data}}); err != nil {
+		return err
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-cc.readerDone:
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		return cc.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handlePingAck wakes up the Ping waiting for payload.
+func (cc *ClientConn) handlePingAck(payload PingFrame) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if ack := cc.pings[payload.Data]; ack != nil {
+		close(ack)
+		delete(cc.pings, payload.Data)
+	}
+}
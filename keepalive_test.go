@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newKeepaliveClientConn is newTestClientConn with config.
+func newKeepaliveClientConn(t *testing.T, config *ClientConnConfig) (*ClientConn, *testServer) {
+	clientConn, serverConn := net.Pipe()
+	s := newTestServer(t, serverConn)
+	cc, err := NewClientConn(clientConn, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	s.write(Frame{Type: SettingFrameType, Data: SettingFrame{}})
+	return cc, s
+}
+
+func TestClientConnPing(t *testing.T) {
+	cc, s := newTestClientConn(t, nil)
+	errs := make(chan error, 1)
+	go func() { errs <- cc.Ping(context.Background()) }()
+
+	ping := s.next(PingFrameType)
+	if ping.Flags&AckFlag != UnsetFlag {
+		t.Fatalf("unexpected PING %v", ping)
+	}
+	// An ACK of other data is not the one awaited.
+	s.write(Frame{Type: PingFrameType, Flags: AckFlag, Data: PingFrame{Data: [8]byte{1}}})
+	select {
+	case err := <-errs:
+		t.Fatalf("Ping returned %v before its ACK", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.write(Frame{Type: PingFrameType, Flags: AckFlag, Data: ping.Data})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientConnReadIdleTimeout(t *testing.T) {
+	cc, s := newKeepaliveClientConn(t, &ClientConnConfig{ReadIdleTimeout: 20 * time.Millisecond, PingTimeout: 50 * time.Millisecond})
+
+	// A server answering the PINGs keeps the connection.
+	for i := 0; i < 2; i++ {
+		ping := s.next(PingFrameType)
+		s.write(Frame{Type: PingFrameType, Flags: AckFlag, Data: ping.Data})
+	}
+	if !cc.canTakeNewRequest() {
+		t.Fatal("connection closed despite PING ACKs")
+	}
+
+	// A silent one does not.
+	s.next(PingFrameType)
+	for deadline := time.Now().Add(5 * time.Second); cc.canTakeNewRequest(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still open without PING ACK")
+		}
+	}
+	_, err := cc.RoundTrip(context.Background(), &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/")})
+	if !errors.Is(err, ErrPingTimeout) || !errors.Is(err, ErrClientConnClosed) {
+		t.Errorf("expected %s got %v", ErrPingTimeout, err)
+	}
+}
+
+func TestClientConnMaxConnectionAge(t *testing.T) {
+	cc, s := newKeepaliveClientConn(t, &ClientConnConfig{MaxConnectionAge: 50 * time.Millisecond})
+	if !cc.reserveStream() {
+		t.Fatal("no stream available")
+	}
+	errs := make(chan error, 1)
+	go func() {
+		resp, err := cc.roundTrip(context.Background(), &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/")}, true)
+		if err == nil {
+			_, err = resp.Body.Read(make([]byte, 1))
+		}
+		errs <- err
+	}()
+	frame := s.next(HeaderFrameType)
+
+	for deadline := time.Now().Add(5 * time.Second); cc.canTakeNewRequest(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still taking requests past its age")
+		}
+	}
+	// The stream in flight completes before the connection is closed.
+	s.writeHeaders(frame.StreamID, EndStreamFlag, []HeaderField{{name: ":status", value: "200"}})
+	if err := <-errs; err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	select {
+	case <-cc.readerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after its last stream")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"os"
+	"sync"
+)
+
+// keyLogFiles keeps the key log files open, by path, so that every
+// configuration shares one handle.
+var keyLogFiles struct {
+	sync.Mutex
+	files map[string]io.Writer
+}
+
+// ConfigureKeyLog makes config write the TLS secrets of its connections to
+// the file named by SSLKEYLOGFILE, in the NSS key log format Wireshark uses
+// to decrypt captures. It applies to client and server configurations
+// alike, and does nothing if the variable is not set. The file stays open
+// for the life of the process.
+func ConfigureKeyLog(config *tls.Config) error {
+	path := os.Getenv("SSLKEYLOGFILE")
+	if path == "" {
+		return nil
+	}
+
+	keyLogFiles.Lock()
+	defer keyLogFiles.Unlock()
+	if w, ok := keyLogFiles.files[path]; ok {
+		config.KeyLogWriter = w
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if keyLogFiles.files == nil {
+		keyLogFiles.files = map[string]io.Writer{}
+	}
+	keyLogFiles.files[path] = f
+	config.KeyLogWriter = f
+	return nil
+}
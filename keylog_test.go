@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a self-signed certificate for hosts, along
+// with a pool trusting it.
+func newTestCertificate(t *testing.T, hosts ...string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestConfigureKeyLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.log")
+	t.Setenv("SSLKEYLOGFILE", path)
+
+	cert, pool := newTestCertificate(t, "example.com")
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientConfig := &tls.Config{RootCAs: pool, ServerName: "example.com"}
+	for _, config := range []*tls.Config{serverConfig, clientConfig} {
+		if err := ConfigureKeyLog(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if serverConfig.KeyLogWriter == nil || serverConfig.KeyLogWriter != clientConfig.KeyLogWriter {
+		t.Fatal("expected both configurations to share the key log")
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tls.Server(serverConn, serverConfig).Handshake()
+	}()
+	if err := tls.Client(clientConn, clientConfig).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both ends log the TLS 1.3 secrets of the connection.
+	if n := strings.Count(string(keys), "CLIENT_HANDSHAKE_TRAFFIC_SECRET "); n != 2 {
+		t.Errorf("expected 2 client handshake secrets got %d:\n%s", n, keys)
+	}
+}
+
+func TestConfigureKeyLogUnset(t *testing.T) {
+	t.Setenv("SSLKEYLOGFILE", "")
+	config := &tls.Config{}
+	if err := ConfigureKeyLog(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.KeyLogWriter != nil {
+		t.Error("expected no key log without SSLKEYLOGFILE")
+	}
+}
@@ -1,117 +1,160 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 )
 
 func main() {
-	serverAddr := "127.0.0.1:443"
-
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"h2", "http/1.1"},
+	// Installed as h2dump, the binary only dumps frames.
+	if filepath.Base(os.Args[0]) == "h2dump" {
+		if err := runDump(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-
-	conn, err := net.Dial("tcp", serverAddr)
-	if err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dump":
+			if err := runDump(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "inspect":
+			if err := runInspect(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "serve":
+			if err := runServe(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
 	}
-	defer conn.Close()
-
-	tlsConn := tls.Client(conn, tlsConfig)
-
-	if err := tlsConn.Handshake(); err != nil {
-		log.Fatalf("TLS handshake failed: %v", err)
-	}
-
-	fmt.Println("TLS connection established successfully")
+	demo(os.Args[1:])
+}
 
-	handler := NewFrameHandler()
+// demo sends a request to a server and prints the response.
+func demo(args []string) {
+	flags := flag.NewFlagSet("h2", flag.ExitOnError)
+	serverAddr := flags.String("addr", "127.0.0.1:443", "server address")
+	trace := flags.String("trace", "", "log frames to stderr, as text or json")
+	qlog := flags.String("qlog", "", "write the connection events to this file, as JSON lines")
+	h2c := flags.Bool("h2c", false, "connect over cleartext h2c with prior knowledge")
+	caFile := flags.String("ca", "", "verify the server certificate against the PEM certificates of this file")
+	insecure := flags.Bool("insecure", false, "skip the verification of the server certificate")
+	count := flags.Int("n", 1, "number of requests to send")
+	flags.Parse(args)
 
-	settingFrame := Frame{
-		Type:     SettingFrameType,
-		StreamID: 0,
-		Flags:    UnsetFlag,
-		Data: any(SettingFrame{
-			Params: map[SettingParam]uint32{
-				SettingsMaxConcurrentStreams: 100,
-				SettingsInitialWindowSize:    33554432,
-				SettingsEnablePush:           0,
-			},
-		}),
+	tlsConfig := SecureClientTLSConfig()
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificate in %s", *caFile)
+		}
 	}
-	headerFrame := Frame{
-		Type:     HeaderFrameType,
-		StreamID: 1,
-		Flags:    EndStreamFlag | EndHeaderFlag,
-		Data: any(HeaderFrame{
-			HeaderFields: []HeaderField{
-				{name: ":method:", value: "GET"},
-				{name: ":path:", value: "/"},
-				{name: ":scheme:", value: "https"},
-				{name: ":authority:", value: "localhost"},
-				{name: "user-agent", value: "go/h2"},
-				{name: "accept", value: "*/*"},
-			},
-		}),
+	tlsConfig.InsecureSkipVerify = *insecure
+	if err := ConfigureKeyLog(tlsConfig); err != nil {
+		log.Fatalf("Failed to open SSLKEYLOGFILE: %v", err)
 	}
 
-	ackSettingFrame := Frame{
-		Type:     SettingFrameType,
-		StreamID: 0,
-		Flags:    AckFlag,
-		Data: any(SettingFrame{
-			Params: map[SettingParam]uint32{},
-		}),
+	config := &ClientConnConfig{}
+	if *trace != "" {
+		format, err := ParseTraceFormat(*trace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.FrameTracer = NewFrameTracer(os.Stderr, format)
 	}
-
-	// Send Magic
-	_, err = tlsConn.Write([]byte("\x50\x52\x49\x20\x2a\x20\x48\x54\x54\x50\x2f\x32\x2e\x30\x0d\x0a\x0d\x0a\x53\x4d\x0d\x0a\x0d\x0a"))
-	if err != nil {
-		log.Fatalf("Failed to send request: %v", err)
+	if *qlog != "" {
+		f, err := os.Create(*qlog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		config.EventSink = NewJSONEventWriter(f, "client")
 	}
 
-	_, err = handler.Encode(tlsConn, settingFrame)
-	if err != nil {
-		log.Fatalf("Failed to send request: %v", err)
+	ctx := WithClientTrace(context.Background(), &ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				fmt.Println("TLS connection established successfully")
+			}
+		},
+	})
+	transport := &Transport{
+		TLSClientConfig: tlsConfig,
+		ConnConfig:      config,
+		AllowHTTP:       *h2c,
 	}
-
-	_, err = handler.Encode(tlsConn, headerFrame)
-	if err != nil {
-		log.Fatalf("Failed to send request: %v", err)
+	defer transport.CloseIdleConnections()
+	scheme := "https"
+	if *h2c {
+		scheme = "http"
 	}
+	// The requests share the pooled connections.
+	for i := 0; i < *count; i++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", scheme+"://"+*serverAddr+"/", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Host = "localhost"
+		req.Header.Set("Accept", "*/*")
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			log.Fatalf("Failed to send request: %v", err)
+		}
 
-	_, err = handler.Encode(tlsConn, ackSettingFrame)
-	if err != nil {
-		log.Fatalf("Failed to send request: %v", err)
+		// Servers which do not negotiate h2 are answered over HTTP/1.1.
+		fmt.Println(resp.Proto, resp.Status)
+		if err := resp.Header.Write(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println()
+		_, err = io.Copy(os.Stdout, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
+}
 
-	frame := Frame{}
-	if err := handler.Decode(tlsConn, &frame); err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println(frame)
-	frame = Frame{}
-	if err := handler.Decode(tlsConn, &frame); err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println(frame)
-	frame = Frame{}
-	if err := handler.Decode(tlsConn, &frame); err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println(frame)
-	frame = Frame{}
-	if err := handler.Decode(tlsConn, &frame); err != nil {
-		log.Fatal(err)
+// runServe serves the files of a directory over HTTP/2.
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("h2 serve", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:443", "address to listen on")
+	certFile := flags.String("cert", "cert.pem", "certificate file")
+	keyFile := flags.String("key", "key.pem", "private key file")
+	root := flags.String("root", ".", "directory to serve")
+	trace := flags.String("trace", "", "log frames to stderr, as text or json")
+	h2c := flags.Bool("h2c", false, "serve cleartext h2c and HTTP/1.1 instead of TLS")
+	flags.Parse(args)
+
+	srv := &Server{Handler: http.FileServer(http.Dir(*root))}
+	if *trace != "" {
+		format, err := ParseTraceFormat(*trace)
+		if err != nil {
+			return err
+		}
+		srv.FrameTracer = NewFrameTracer(os.Stderr, format)
 	}
-	fmt.Println(frame)
-	frame = Frame{}
-	if err := handler.Decode(tlsConn, &frame); err != nil {
-		log.Fatal(err)
+	if *h2c {
+		log.Printf("Serving %s on http://%s", *root, *addr)
+		return srv.ListenAndServe(*addr)
 	}
-	fmt.Println(frame)
+	log.Printf("Serving %s on https://%s", *root, *addr)
+	return srv.ListenAndServeTLS(*addr, *certFile, *keyFile)
 }
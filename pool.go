@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// clientConnPool holds the client connections of a Transport, by
+// authority. A request takes a stream on the first connection with one
+// available under MAX_CONCURRENT_STREAMS, and a new connection is dialed
+// once all are busy. Concurrent requests wait for the same dial rather
+// than each dialing its own connection.
+//
+// Before dialing, a request may take a connection to another authority
+// whose certificate covers its host, when the host resolves to the address
+// of the connection or the server listed its origin in an ORIGIN frame.
+// The connection is then pooled under both authorities.
+type clientConnPool struct {
+	// dial connects to the authority of key.
+	dial func(ctx context.Context, key string) (*ClientConn, error)
+	// lookupIP resolves the hosts to coalesce, net.DefaultResolver if nil.
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+
+	mu      sync.Mutex
+	conns   map[string][]*ClientConn
+	dialing map[string]*dialCall
+}
+
+// dialCall is a dial in progress, whose result is shared by the requests
+// waiting for it.
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+// get returns a connection to key other than avoid, which may be nil,
+// with a stream reserved for the request, to be sent with roundTrip.
+func (p *clientConnPool) get(ctx context.Context, key string, avoid *ClientConn) (*ClientConn, error) {
+	var addrs []string
+	resolved := false
+	for {
+		p.mu.Lock()
+		cc := p.reserve(key, avoid)
+		if cc == nil && p.dialing[key] == nil {
+			cc = p.coalesce(key, addrs, avoid)
+			if cc == nil && !resolved && p.mayCoalesce(key) {
+				p.mu.Unlock()
+				addrs = p.resolve(ctx, key)
+				resolved = true
+				continue
+			}
+		}
+		if cc != nil {
+			p.mu.Unlock()
+			return cc, nil
+		}
+		call := p.dialing[key]
+		if call == nil {
+			call = &dialCall{done: make(chan struct{})}
+			if p.dialing == nil {
+				p.dialing = map[string]*dialCall{}
+			}
+			p.dialing[key] = call
+			go p.dialFor(call, ctx, key)
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// A dial canceled by the request which started it is retried for
+		// the others.
+		if call.err != nil && (ctx.Err() != nil || !isContextError(call.err)) {
+			return nil, call.err
+		}
+	}
+}
+
+// reserve returns a connection to key other than avoid with a stream
+// reserved, with p.mu held. The connections which will not take any new
+// request are dropped from the pool: those that received GOAWAY or
+// reached their maximum age are left to drain, and those which failed a
+// health check are closed.
+func (p *clientConnPool) reserve(key string, avoid *ClientConn) *ClientConn {
+	conns := p.conns[key][:0]
+	var reserved *ClientConn
+	for _, cc := range p.conns[key] {
+		if !cc.canTakeNewRequest() {
+			continue
+		}
+		conns = append(conns, cc)
+		if reserved == nil && cc != avoid && cc.reserveStream() {
+			reserved = cc
+		}
+	}
+	if len(conns) == 0 {
+		delete(p.conns, key)
+	} else {
+		p.conns[key] = conns
+	}
+	return reserved
+}
+
+// coalesce returns a connection to another authority, other than avoid,
+// which can take the requests to key, with a stream reserved, and p.mu
+// held. addrs are the addresses key resolves to, nil if not resolved yet.
+func (p *clientConnPool) coalesce(key string, addrs []string, avoid *ClientConn) *ClientConn {
+	origin, host, ok := keyOrigin(key)
+	if !ok {
+		return nil
+	}
+	for other, conns := range p.conns {
+		if other == key {
+			continue
+		}
+		for _, cc := range conns {
+			if cc != avoid && cc.canTakeNewRequest() && cc.canCoalesce(origin, host, addrs) && cc.reserveStream() {
+				p.conns[key] = append(p.conns[key], cc)
+				return cc
+			}
+		}
+	}
+	return nil
+}
+
+// mayCoalesce reports whether key could be coalesced with a connection to
+// another authority once resolved, with p.mu held.
+func (p *clientConnPool) mayCoalesce(key string) bool {
+	if _, _, ok := keyOrigin(key); !ok {
+		return false
+	}
+	for other := range p.conns {
+		if other != key && strings.HasPrefix(other, "https://") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the addresses the authority of key resolves to, nil if
+// it does not.
+func (p *clientConnPool) resolve(ctx context.Context, key string) []string {
+	_, addr, _ := strings.Cut(key, "://")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	lookupIP := p.lookupIP
+	if lookupIP == nil {
+		lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		}
+	}
+	ips, err := lookupIP(ctx, host)
+	if err != nil {
+		return nil
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs
+}
+
+// misdirected forgets cc for key, after the server answered a request to
+// key with 421 Misdirected Request, and no longer coalesces key with it. A
+// connection left pooled for no authority is drained.
+func (p *clientConnPool) misdirected(key string, cc *ClientConn) {
+	if origin, _, ok := keyOrigin(key); ok {
+		cc.setMisdirected(origin)
+	}
+	p.mu.Lock()
+	conns := []*ClientConn{}
+	for _, pooled := range p.conns[key] {
+		if pooled != cc {
+			conns = append(conns, pooled)
+		}
+	}
+	if len(conns) == 0 {
+		delete(p.conns, key)
+	} else {
+		p.conns[key] = conns
+	}
+	pooled := false
+	for _, conns := range p.conns {
+		for _, other := range conns {
+			pooled = pooled || other == cc
+		}
+	}
+	p.mu.Unlock()
+	if !pooled {
+		cc.drain()
+	}
+}
+
+// dialFor dials key for call, adding the connection to the pool once its
+// MAX_CONCURRENT_STREAMS is known.
+func (p *clientConnPool) dialFor(call *dialCall, ctx context.Context, key string) {
+	cc, err := p.dial(ctx, key)
+	if err == nil {
+		if err = cc.waitSettings(ctx); err != nil {
+			cc.Close()
+		}
+	}
+	p.mu.Lock()
+	delete(p.dialing, key)
+	if err == nil {
+		if p.conns == nil {
+			p.conns = map[string][]*ClientConn{}
+		}
+		p.conns[key] = append(p.conns[key], cc)
+	}
+	call.err = err
+	p.mu.Unlock()
+	close(call.done)
+}
+
+// closeIdle closes the connections without streams.
+func (p *clientConnPool) closeIdle() {
+	p.mu.Lock()
+	idle := map[*ClientConn]bool{}
+	for key, conns := range p.conns {
+		busy := conns[:0]
+		for _, cc := range conns {
+			if idle[cc] || cc.idle() {
+				idle[cc] = true
+			} else {
+				busy = append(busy, cc)
+			}
+		}
+		if len(busy) == 0 {
+			delete(p.conns, key)
+		} else {
+			p.conns[key] = busy
+		}
+	}
+	p.mu.Unlock()
+
+	for cc := range idle {
+		cc.Close()
+	}
+}
+
+// keyOrigin returns the ASCII serialization of the origin of an https
+// key, without the default port, and its host. Only https connections
+// are coalesced.
+func keyOrigin(key string) (origin, host string, ok bool) {
+	addr, ok := strings.CutPrefix(key, "https://")
+	if !ok {
+		return "", "", false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", false
+	}
+	host = strings.ToLower(host)
+	if port == "443" {
+		if strings.Contains(host, ":") {
+			return "https://[" + host + "]", host, true
+		}
+		return "https://" + host, host, true
+	}
+	return "https://" + net.JoinHostPort(host, port), host, true
+}
+
+// isContextError reports whether err comes from a canceled or expired
+// context.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// newTestH2CServer serves srv over h2c, returning the base URL and the
+// listener counting connections.
+func newTestH2CServer(t *testing.T, srv *Server) (string, *countingListener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: listener}
+	go srv.Serve(counting)
+	t.Cleanup(func() { srv.Close() })
+	return "http://" + listener.Addr().String(), counting
+}
+
+// getConcurrently sends n GET requests to url at once.
+func getConcurrently(t *testing.T, transport *Transport, url string, n int) <-chan error {
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			req, _ := http.NewRequest("GET", url, nil)
+			resp, err := transport.RoundTrip(req)
+			if err == nil {
+				_, err = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			errs <- err
+		}()
+	}
+	return errs
+}
+
+func TestPoolMaxConcurrentStreams(t *testing.T) {
+	entered := make(chan struct{}, 10)
+	release := make(chan struct{})
+	url, listener := newTestH2CServer(t, &Server{
+		MaxConcurrentStreams: 2,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entered <- struct{}{}
+			<-release
+		}),
+	})
+	transport := &Transport{AllowHTTP: true}
+	defer transport.CloseIdleConnections()
+
+	errs := getConcurrently(t, transport, url, 5)
+	for i := 0; i < 5; i++ {
+		select {
+		case <-entered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d requests served", i)
+		}
+	}
+	if n := listener.accepted.Load(); n != 3 {
+		t.Errorf("expected 3 connections got %d", n)
+	}
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPoolDialsOnce(t *testing.T) {
+	url, listener := newTestH2CServer(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+	transport := &Transport{AllowHTTP: true}
+	defer transport.CloseIdleConnections()
+
+	errs := getConcurrently(t, transport, url, 20)
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := listener.accepted.Load(); n != 1 {
+		t.Errorf("expected a single connection got %d", n)
+	}
+}
+
+func TestPoolDrainsGoAway(t *testing.T) {
+	var mu sync.Mutex
+	var servers []*testServer
+	pool := &clientConnPool{dial: func(ctx context.Context, key string) (*ClientConn, error) {
+		cc, s := newTestClientConn(t, nil)
+		mu.Lock()
+		servers = append(servers, s)
+		mu.Unlock()
+		return cc, nil
+	}}
+
+	first, err := pool.get(context.Background(), "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go first.roundTrip(context.Background(), &ClientRequest{Header: NewRequestHeader("GET", "https", "example.com", "/")}, true)
+	mu.Lock()
+	s := servers[0]
+	mu.Unlock()
+	s.next(HeaderFrameType)
+
+	// Stream 1 is left to complete on the draining connection.
+	s.write(Frame{Type: GoAwayFrameType, Data: GoAwayFrame{LastStreamID: 1, ErrorCode: NoError}})
+	for deadline := time.Now().Add(5 * time.Second); first.canTakeNewRequest(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("GOAWAY not received")
+		}
+	}
+
+	second, err := pool.get(context.Background(), "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Error("expected a new connection after GOAWAY")
+	}
+	if conns := pool.conns["example.com:443"]; len(conns) != 1 || conns[0] != second {
+		t.Errorf("expected the draining connection to leave the pool got %v", conns)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	url, listener := newTestH2CServer(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})})
+	transport := &Transport{AllowHTTP: true, IdleConnTimeout: 20 * time.Millisecond}
+	defer transport.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		if err := <-getConcurrently(t, transport, url, 1); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// The idle connection was closed, and another dialed.
+	if n := listener.accepted.Load(); n != 2 {
+		t.Errorf("expected 2 connections got %d", n)
+	}
+}
+
+// newTestTLSListener listens over TLS with a certificate for hosts,
+// returning the listener counting connections, its port and a client
+// configuration trusting it.
+func newTestTLSListener(t *testing.T, hosts ...string) (*countingListener, string, *tls.Config) {
+	cert, pool := newTestCertificate(t, hosts...)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return &countingListener{Listener: listener}, port, &tls.Config{RootCAs: pool}
+}
+
+// lookupTable resolves the hosts it lists, and no other.
+func lookupTable(table map[string]string) func(ctx context.Context, host string) ([]net.IP, error) {
+	return func(ctx context.Context, host string) ([]net.IP, error) {
+		if addr, ok := table[host]; ok {
+			return []net.IP{net.ParseIP(addr)}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+}
+
+// getHost sends a GET request to url, returning the host the handler saw.
+func getHost(t *testing.T, transport *Transport, url string) string {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestPoolCoalesce(t *testing.T) {
+	listener, port, tlsConfig := newTestTLSListener(t, "127.0.0.1", "localhost", "a.example.test")
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+	transport := &Transport{TLSClientConfig: tlsConfig}
+	transport.pool.lookupIP = lookupTable(map[string]string{"a.example.test": "127.0.0.1", "localhost": "192.0.2.1"})
+	defer transport.CloseIdleConnections()
+
+	getHost(t, transport, "https://127.0.0.1:"+port)
+	// a.example.test resolves to the address of the connection, which its
+	// certificate covers.
+	if host := getHost(t, transport, "https://a.example.test:"+port); host != "a.example.test:"+port {
+		t.Errorf("unexpected host %q", host)
+	}
+	if n := listener.accepted.Load(); n != 1 {
+		t.Errorf("expected a single connection got %d", n)
+	}
+	// localhost does not, as far as the pool knows.
+	getHost(t, transport, "https://localhost:"+port)
+	if n := listener.accepted.Load(); n != 2 {
+		t.Errorf("expected 2 connections got %d", n)
+	}
+}
+
+func TestPoolCoalesceOrigin(t *testing.T) {
+	listener, port, tlsConfig := newTestTLSListener(t, "127.0.0.1", "a.example.test", "b.example.test")
+	srv := &Server{
+		Origins: []string{"https://a.example.test:" + port},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Host)
+		}),
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+	transport := &Transport{TLSClientConfig: tlsConfig}
+	transport.pool.lookupIP = lookupTable(map[string]string{"b.example.test": "127.0.0.1"})
+	defer transport.CloseIdleConnections()
+
+	getHost(t, transport, "https://127.0.0.1:"+port)
+	// The ORIGIN frame was read before the first response.
+	if host := getHost(t, transport, "https://a.example.test:"+port); host != "a.example.test:"+port {
+		t.Errorf("unexpected host %q", host)
+	}
+	if n := listener.accepted.Load(); n != 1 {
+		t.Errorf("expected a single connection got %d", n)
+	}
+	// Once the server sent an ORIGIN set, other origins are not coalesced.
+	transport.pool.mu.Lock()
+	cc := transport.pool.coalesce("https://b.example.test:"+port, []string{"127.0.0.1:" + port}, nil)
+	transport.pool.mu.Unlock()
+	if cc != nil {
+		t.Error("expected b.example.test not to be coalesced")
+	}
+}
+
+func TestTransportMisdirectedRequest(t *testing.T) {
+	listener, port, tlsConfig := newTestTLSListener(t, "127.0.0.1", "localhost")
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the connections dialed for localhost serve it.
+		if strings.HasPrefix(r.Host, "localhost:") && r.TLS.ServerName != "localhost" {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		io.Copy(w, r.Body)
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+	transport := &Transport{TLSClientConfig: tlsConfig}
+	transport.pool.lookupIP = lookupTable(map[string]string{"localhost": "127.0.0.1"})
+	defer transport.CloseIdleConnections()
+
+	getHost(t, transport, "https://127.0.0.1:"+port)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "https://localhost:"+port, bytes.NewReader([]byte("payload")))
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "payload" {
+			t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+		}
+	}
+	// The first request was retried on a connection for localhost, which
+	// the second reused.
+	if n := listener.accepted.Load(); n != 2 {
+		t.Errorf("expected 2 connections got %d", n)
+	}
+}
@@ -0,0 +1,962 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+QPACK (RFC 9204) is the HTTP/3 counterpart of HPACK. Field sections are
+still coded with prefix integers and Huffman strings, but since QUIC
+streams are not ordered with respect to each other, dynamic table updates
+travel on a dedicated encoder stream, and the decoder acknowledges them on
+a decoder stream. A field section referencing entries that have not
+arrived yet is blocked until they do.
+*/
+
+var (
+	ErrQPackDecompressionFailed = errors.New("QPACK decompression failed")
+	ErrQPackEncoderStream       = errors.New("QPACK encoder stream error")
+	ErrQPackDecoderStream       = errors.New("QPACK decoder stream error")
+	// ErrQPackBlocked is not a failure: the field section has been kept
+	// and is returned by ReadEncoderStream once its entries arrived.
+	ErrQPackBlocked = errors.New("QPACK field section blocked")
+)
+
+// maxQPackInteger bounds every integer in QPACK, stream IDs being 62 bits.
+const maxQPackInteger = 1<<62 - 1
+
+// qpackStaticTable is the predefined table of RFC 9204 Appendix A. Unlike
+// HPACK's it starts at index 0.
+var qpackStaticTable = [...]HeaderField{
+	{name: ":authority", value: ""},
+	{name: ":path", value: "/"},
+	{name: "age", value: "0"},
+	{name: "content-disposition", value: ""},
+	{name: "content-length", value: "0"},
+	{name: "cookie", value: ""},
+	{name: "date", value: ""},
+	{name: "etag", value: ""},
+	{name: "if-modified-since", value: ""},
+	{name: "if-none-match", value: ""},
+	{name: "last-modified", value: ""},
+	{name: "link", value: ""},
+	{name: "location", value: ""},
+	{name: "referer", value: ""},
+	{name: "set-cookie", value: ""},
+	{name: ":method", value: "CONNECT"},
+	{name: ":method", value: "DELETE"},
+	{name: ":method", value: "GET"},
+	{name: ":method", value: "HEAD"},
+	{name: ":method", value: "OPTIONS"},
+	{name: ":method", value: "POST"},
+	{name: ":method", value: "PUT"},
+	{name: ":scheme", value: "http"},
+	{name: ":scheme", value: "https"},
+	{name: ":status", value: "103"},
+	{name: ":status", value: "200"},
+	{name: ":status", value: "304"},
+	{name: ":status", value: "404"},
+	{name: ":status", value: "503"},
+	{name: "accept", value: "*/*"},
+	{name: "accept", value: "application/dns-message"},
+	{name: "accept-encoding", value: "gzip, deflate, br"},
+	{name: "accept-ranges", value: "bytes"},
+	{name: "access-control-allow-headers", value: "cache-control"},
+	{name: "access-control-allow-headers", value: "content-type"},
+	{name: "access-control-allow-origin", value: "*"},
+	{name: "cache-control", value: "max-age=0"},
+	{name: "cache-control", value: "max-age=2592000"},
+	{name: "cache-control", value: "max-age=604800"},
+	{name: "cache-control", value: "no-cache"},
+	{name: "cache-control", value: "no-store"},
+	{name: "cache-control", value: "public, max-age=31536000"},
+	{name: "content-encoding", value: "br"},
+	{name: "content-encoding", value: "gzip"},
+	{name: "content-type", value: "application/dns-message"},
+	{name: "content-type", value: "application/javascript"},
+	{name: "content-type", value: "application/json"},
+	{name: "content-type", value: "application/x-www-form-urlencoded"},
+	{name: "content-type", value: "image/gif"},
+	{name: "content-type", value: "image/jpeg"},
+	{name: "content-type", value: "image/png"},
+	{name: "content-type", value: "text/css"},
+	{name: "content-type", value: "text/html; charset=utf-8"},
+	{name: "content-type", value: "text/plain"},
+	{name: "content-type", value: "text/plain;charset=utf-8"},
+	{name: "range", value: "bytes=0-"},
+	{name: "strict-transport-security", value: "max-age=31536000"},
+	{name: "strict-transport-security", value: "max-age=31536000; includesubdomains"},
+	{name: "strict-transport-security", value: "max-age=31536000; includesubdomains; preload"},
+	{name: "vary", value: "accept-encoding"},
+	{name: "vary", value: "origin"},
+	{name: "x-content-type-options", value: "nosniff"},
+	{name: "x-xss-protection", value: "1; mode=block"},
+	{name: ":status", value: "100"},
+	{name: ":status", value: "204"},
+	{name: ":status", value: "206"},
+	{name: ":status", value: "302"},
+	{name: ":status", value: "400"},
+	{name: ":status", value: "403"},
+	{name: ":status", value: "421"},
+	{name: ":status", value: "425"},
+	{name: ":status", value: "500"},
+	{name: "accept-language", value: ""},
+	{name: "access-control-allow-credentials", value: "FALSE"},
+	{name: "access-control-allow-credentials", value: "TRUE"},
+	{name: "access-control-allow-headers", value: "*"},
+	{name: "access-control-allow-methods", value: "get"},
+	{name: "access-control-allow-methods", value: "get, post, options"},
+	{name: "access-control-allow-methods", value: "options"},
+	{name: "access-control-expose-headers", value: "content-length"},
+	{name: "access-control-request-headers", value: "content-type"},
+	{name: "access-control-request-method", value: "get"},
+	{name: "access-control-request-method", value: "post"},
+	{name: "alt-svc", value: "clear"},
+	{name: "authorization", value: ""},
+	{name: "content-security-policy", value: "script-src 'none'; object-src 'none'; base-uri 'none'"},
+	{name: "early-data", value: "1"},
+	{name: "expect-ct", value: ""},
+	{name: "forwarded", value: ""},
+	{name: "if-range", value: ""},
+	{name: "origin", value: ""},
+	{name: "purpose", value: "prefetch"},
+	{name: "server", value: ""},
+	{name: "timing-allow-origin", value: "*"},
+	{name: "upgrade-insecure-requests", value: "1"},
+	{name: "user-agent", value: ""},
+	{name: "x-forwarded-for", value: ""},
+	{name: "x-frame-options", value: "deny"},
+	{name: "x-frame-options", value: "sameorigin"},
+}
+
+/*
+The dynamic table is addressed with absolute indexes: the first entry ever
+inserted is 0, whatever has been evicted since.
+
+	   +-----+---------------+-------+
+	   | n-1 |      ...      |   d   |  Absolute Index
+	   + - - +---------------+ - - - +
+	   |  0  |      ...      | n-d-1 |  Relative Index
+	   +-----+---------------+-------+
+	   ^                             |
+	   |                             V
+	Insertion Point               Draining Point
+
+	n = count of entries inserted
+	d = count of entries dropped
+
+	Figure 3: Example Dynamic Table Indexing - Encoder Stream
+*/
+type qpackTable struct {
+	// entries is kept oldest first, entries[0] has absolute index dropped.
+	entries  []HeaderField
+	dropped  uint64
+	size     uint64
+	capacity uint64
+}
+
+func (t *qpackTable) insertCount() uint64 {
+	return t.dropped + uint64(len(t.entries))
+}
+
+func (t *qpackTable) get(abs uint64) (HeaderField, bool) {
+	if abs < t.dropped || abs >= t.insertCount() {
+		return HeaderField{}, false
+	}
+	return t.entries[abs-t.dropped], true
+}
+
+// fit returns how many of the oldest entries have to be evicted to make
+// room for size octets, or false if the entry is larger than the capacity.
+func (t *qpackTable) fit(size uint64) (int, bool) {
+	if size > t.capacity {
+		return 0, false
+	}
+	n, used := 0, t.size
+	for used+size > t.capacity {
+		used -= uint64(t.entries[n].size())
+		n++
+	}
+	return n, true
+}
+
+func (t *qpackTable) insert(hf HeaderField) bool {
+	n, ok := t.fit(uint64(hf.size()))
+	if !ok {
+		return false
+	}
+	t.evict(n)
+	t.entries = append(t.entries, hf)
+	t.size += uint64(hf.size())
+	return true
+}
+
+// evict drops the n oldest entries.
+func (t *qpackTable) evict(n int) {
+	for _, hf := range t.entries[:n] {
+		t.size -= uint64(hf.size())
+	}
+	t.entries = append(t.entries[:0], t.entries[n:]...)
+	t.dropped += uint64(n)
+}
+
+// oversize returns how many of the oldest entries exceed capacity.
+func (t *qpackTable) oversize(capacity uint64) int {
+	n, size := 0, t.size
+	for size > capacity {
+		size -= uint64(t.entries[n].size())
+		n++
+	}
+	return n
+}
+
+// encodeRequiredInsertCount reduces the Required Insert Count of a field
+// section modulo twice the maximum number of entries (RFC 9204 section
+// 4.5.1.1).
+func encodeRequiredInsertCount(requiredInsertCount, maxEntries uint64) uint64 {
+	if requiredInsertCount == 0 {
+		return 0
+	}
+	return requiredInsertCount%(2*maxEntries) + 1
+}
+
+func decodeRequiredInsertCount(encoded, maxEntries, totalInserts uint64) (uint64, error) {
+	if encoded == 0 {
+		return 0, nil
+	}
+	fullRange := 2 * maxEntries
+	if encoded > fullRange {
+		return 0, fmt.Errorf("%w: invalid Required Insert Count %d", ErrQPackDecompressionFailed, encoded)
+	}
+
+	maxValue := totalInserts + maxEntries
+	maxWrapped := maxValue / fullRange * fullRange
+	requiredInsertCount := maxWrapped + encoded - 1
+	if requiredInsertCount > maxValue {
+		if requiredInsertCount <= fullRange {
+			return 0, fmt.Errorf("%w: invalid Required Insert Count %d", ErrQPackDecompressionFailed, encoded)
+		}
+		requiredInsertCount -= fullRange
+	}
+	if requiredInsertCount == 0 {
+		return 0, fmt.Errorf("%w: invalid Required Insert Count %d", ErrQPackDecompressionFailed, encoded)
+	}
+	return requiredInsertCount, nil
+}
+
+// QPackFieldSection is a decoded field section of a request stream.
+type QPackFieldSection struct {
+	StreamID     uint64
+	HeaderFields []HeaderField
+}
+
+type qpackBlockedSection struct {
+	streamID            uint64
+	requiredInsertCount uint64
+	base                uint64
+	lines               []byte
+}
+
+type QPackDecoder struct {
+	table qpackTable
+	// maxTableCapacity and maxBlockedStreams are the values of our
+	// SETTINGS_QPACK_MAX_TABLE_CAPACITY and SETTINGS_QPACK_BLOCKED_STREAMS.
+	maxTableCapacity  uint64
+	maxBlockedStreams int
+	maxStringLength   int
+
+	// encoderStream holds the start of an instruction not fully received.
+	encoderStream []byte
+	// decoderStream holds the instructions not sent yet.
+	decoderStream []byte
+	// acknowledged is the insert count the encoder knows we reached.
+	acknowledged uint64
+	blocked      []qpackBlockedSection
+	// err is set once the encoder stream or a blocked field section
+	// failed. Both are connection errors, after which the decoder is not
+	// used again.
+	err error
+}
+
+func NewQPackDecoder(maxTableCapacity uint64, maxBlockedStreams int) *QPackDecoder {
+	return &QPackDecoder{
+		maxTableCapacity:  maxTableCapacity,
+		maxBlockedStreams: maxBlockedStreams,
+		maxStringLength:   defaultMaxStringLength,
+	}
+}
+
+// DecodeFieldSection decodes the field section received on a request
+// stream. If it references entries that have not arrived yet it is kept
+// and ErrQPackBlocked is returned.
+func (d *QPackDecoder) DecodeFieldSection(streamID uint64, section []byte) ([]HeaderField, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	encoded, n, err := decodeInteger(section, 8, maxQPackInteger)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrQPackDecompressionFailed, err)
+	}
+	requiredInsertCount, err := decodeRequiredInsertCount(encoded, d.maxTableCapacity/32, d.table.insertCount())
+	if err != nil {
+		return nil, err
+	}
+	if n == len(section) {
+		return nil, fmt.Errorf("%w: %v", ErrQPackDecompressionFailed, ErrTruncated)
+	}
+	sign := section[n]&0x80 != 0
+	deltaBase, m, err := decodeInteger(section[n:], 7, maxQPackInteger)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrQPackDecompressionFailed, err)
+	}
+	base := requiredInsertCount + deltaBase
+	if sign {
+		if deltaBase >= requiredInsertCount {
+			return nil, fmt.Errorf("%w: negative Base", ErrQPackDecompressionFailed)
+		}
+		base = requiredInsertCount - deltaBase - 1
+	}
+
+	blocked := qpackBlockedSection{
+		streamID:            streamID,
+		requiredInsertCount: requiredInsertCount,
+		base:                base,
+		lines:               section[n+m:],
+	}
+	if requiredInsertCount > d.table.insertCount() {
+		if len(d.blocked) >= d.maxBlockedStreams {
+			return nil, fmt.Errorf("%w: more than %d blocked streams", ErrQPackDecompressionFailed, d.maxBlockedStreams)
+		}
+		blocked.lines = append([]byte(nil), blocked.lines...)
+		d.blocked = append(d.blocked, blocked)
+		return nil, ErrQPackBlocked
+	}
+	return d.decodeFieldLines(blocked)
+}
+
+func (d *QPackDecoder) dynamicField(abs uint64, section qpackBlockedSection) (HeaderField, error) {
+	if abs >= section.requiredInsertCount {
+		return HeaderField{}, fmt.Errorf("%w: reference to %d beyond the Required Insert Count", ErrQPackDecompressionFailed, abs)
+	}
+	hf, ok := d.table.get(abs)
+	if !ok {
+		return HeaderField{}, fmt.Errorf("%w: reference to evicted entry %d", ErrQPackDecompressionFailed, abs)
+	}
+	return hf, nil
+}
+
+func (d *QPackDecoder) staticField(index uint64) (HeaderField, error) {
+	if index >= uint64(len(qpackStaticTable)) {
+		return HeaderField{}, fmt.Errorf("%w: invalid static index %d", ErrQPackDecompressionFailed, index)
+	}
+	return qpackStaticTable[index], nil
+}
+
+func (d *QPackDecoder) decodeFieldLines(section qpackBlockedSection) ([]HeaderField, error) {
+	var (
+		headerFields = []HeaderField{}
+		b            = section.lines
+		maxRef       = uint64(0)
+		referenced   = false
+	)
+	// relative turns a relative or post-base index into an absolute one.
+	relative := func(index uint64, postBase bool) (uint64, error) {
+		abs := section.base + index
+		if !postBase {
+			if index >= section.base {
+				return 0, fmt.Errorf("%w: relative index %d below Base %d", ErrQPackDecompressionFailed, index, section.base)
+			}
+			abs = section.base - 1 - index
+		}
+		if !referenced || abs > maxRef {
+			maxRef = abs
+		}
+		referenced = true
+		return abs, nil
+	}
+
+	for len(b) > 0 {
+		var (
+			hf    HeaderField
+			index uint64
+			n     int
+			err   error
+		)
+		switch {
+		case b[0]&0x80 != 0:
+			// Indexed Field Line
+			if index, n, err = decodeInteger(b, 6, maxQPackInteger); err != nil {
+				break
+			}
+			if b[0]&0x40 != 0 {
+				hf, err = d.staticField(index)
+				break
+			}
+			if index, err = relative(index, false); err == nil {
+				hf, err = d.dynamicField(index, section)
+			}
+		case b[0]&0xc0 == 0x40:
+			// Literal Field Line with Name Reference
+			if index, n, err = decodeInteger(b, 4, maxQPackInteger); err != nil {
+				break
+			}
+			if b[0]&0x10 != 0 {
+				hf, err = d.staticField(index)
+			} else if index, err = relative(index, false); err == nil {
+				hf, err = d.dynamicField(index, section)
+			}
+			if err == nil {
+				var m int
+				hf.value, m, err = decodeString(b[n:], 7, d.maxStringLength)
+				n += m
+			}
+		case b[0]&0xe0 == 0x20:
+			// Literal Field Line with Literal Name
+			if hf.name, n, err = decodeString(b, 3, d.maxStringLength); err == nil {
+				var m int
+				hf.value, m, err = decodeString(b[n:], 7, d.maxStringLength)
+				n += m
+			}
+		case b[0]&0xf0 == 0x10:
+			// Indexed Field Line with Post-Base Index
+			if index, n, err = decodeInteger(b, 4, maxQPackInteger); err != nil {
+				break
+			}
+			if index, err = relative(index, true); err == nil {
+				hf, err = d.dynamicField(index, section)
+			}
+		default:
+			// Literal Field Line with Post-Base Name Reference
+			if index, n, err = decodeInteger(b, 3, maxQPackInteger); err != nil {
+				break
+			}
+			if index, err = relative(index, true); err == nil {
+				hf, err = d.dynamicField(index, section)
+			}
+			if err == nil {
+				var m int
+				hf.value, m, err = decodeString(b[n:], 7, d.maxStringLength)
+				n += m
+			}
+		}
+		if err != nil {
+			if errors.Is(err, ErrQPackDecompressionFailed) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: %v", ErrQPackDecompressionFailed, err)
+		}
+
+		headerFields = append(headerFields, hf)
+		b = b[n:]
+	}
+
+	// The Required Insert Count has to be exactly what the section needs.
+	if section.requiredInsertCount != 0 && (!referenced || maxRef+1 != section.requiredInsertCount) {
+		return nil, fmt.Errorf("%w: Required Insert Count %d not matching the references", ErrQPackDecompressionFailed, section.requiredInsertCount)
+	}
+
+	if section.requiredInsertCount != 0 {
+		// Section Acknowledgment
+		start := len(d.decoderStream)
+		d.decoderStream = appendInteger(d.decoderStream, section.streamID, 7)
+		d.decoderStream[start] |= 0x80
+		if section.requiredInsertCount > d.acknowledged {
+			d.acknowledged = section.requiredInsertCount
+		}
+	}
+	return headerFields, nil
+}
+
+// ReadEncoderStream processes data received on the encoder stream, which
+// may end in the middle of an instruction. It returns the field sections
+// the new entries unblocked.
+func (d *QPackDecoder) ReadEncoderStream(b []byte) ([]QPackFieldSection, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.encoderStream = append(d.encoderStream, b...)
+	consumed := 0
+	for consumed < len(d.encoderStream) {
+		n, err := d.readEncoderInstruction(d.encoderStream[consumed:])
+		if errors.Is(err, ErrTruncated) {
+			break
+		}
+		if err != nil {
+			return nil, d.fail(fmt.Errorf("%w: %v", ErrQPackEncoderStream, err))
+		}
+		consumed += n
+	}
+	d.encoderStream = append(d.encoderStream[:0], d.encoderStream[consumed:]...)
+
+	unblocked := []QPackFieldSection{}
+	blocked := d.blocked[:0]
+	for _, section := range d.blocked {
+		if section.requiredInsertCount > d.table.insertCount() {
+			blocked = append(blocked, section)
+			continue
+		}
+		headerFields, err := d.decodeFieldLines(section)
+		if err != nil {
+			return nil, d.fail(err)
+		}
+		unblocked = append(unblocked, QPackFieldSection{StreamID: section.streamID, HeaderFields: headerFields})
+	}
+	d.blocked = blocked
+	return unblocked, nil
+}
+
+// fail records the connection error err, dropping the state it left
+// inconsistent.
+func (d *QPackDecoder) fail(err error) error {
+	d.err = err
+	d.blocked = nil
+	d.encoderStream = nil
+	return err
+}
+
+func (d *QPackDecoder) readEncoderInstruction(b []byte) (int, error) {
+	var (
+		hf  HeaderField
+		n   int
+		err error
+	)
+	switch {
+	case b[0]&0x80 != 0:
+		// Insert with Name Reference
+		var index uint64
+		if index, n, err = decodeInteger(b, 6, maxQPackInteger); err != nil {
+			return 0, err
+		}
+		if b[0]&0x40 != 0 {
+			if hf, err = d.staticField(index); err != nil {
+				return 0, err
+			}
+		} else {
+			var ok bool
+			if index >= d.table.insertCount() {
+				return 0, fmt.Errorf("invalid relative index %d", index)
+			}
+			if hf, ok = d.table.get(d.table.insertCount() - 1 - index); !ok {
+				return 0, fmt.Errorf("reference to evicted entry")
+			}
+		}
+		var m int
+		if hf.value, m, err = decodeString(b[n:], 7, d.maxStringLength); err != nil {
+			return 0, err
+		}
+		n += m
+	case b[0]&0xc0 == 0x40:
+		// Insert with Literal Name
+		if hf.name, n, err = decodeString(b, 5, d.maxStringLength); err != nil {
+			return 0, err
+		}
+		var m int
+		if hf.value, m, err = decodeString(b[n:], 7, d.maxStringLength); err != nil {
+			return 0, err
+		}
+		n += m
+	case b[0]&0xe0 == 0x20:
+		// Set Dynamic Table Capacity
+		var capacity uint64
+		if capacity, n, err = decodeInteger(b, 5, maxQPackInteger); err != nil {
+			return 0, err
+		}
+		if capacity > d.maxTableCapacity {
+			return 0, fmt.Errorf("capacity %d exceeds %d", capacity, d.maxTableCapacity)
+		}
+		d.table.evict(d.table.oversize(capacity))
+		d.table.capacity = capacity
+		return n, nil
+	default:
+		// Duplicate
+		var index uint64
+		if index, n, err = decodeInteger(b, 5, maxQPackInteger); err != nil {
+			return 0, err
+		}
+		var ok bool
+		if index >= d.table.insertCount() {
+			return 0, fmt.Errorf("invalid relative index %d", index)
+		}
+		if hf, ok = d.table.get(d.table.insertCount() - 1 - index); !ok {
+			return 0, fmt.Errorf("reference to evicted entry")
+		}
+	}
+
+	if !d.table.insert(hf) {
+		return 0, fmt.Errorf("entry of size %d exceeds capacity %d", hf.size(), d.table.capacity)
+	}
+	return n, nil
+}
+
+// CancelStream drops the blocked field sections of a reset stream and tells
+// the encoder it will never acknowledge them.
+func (d *QPackDecoder) CancelStream(streamID uint64) {
+	blocked := d.blocked[:0]
+	for _, section := range d.blocked {
+		if section.streamID != streamID {
+			blocked = append(blocked, section)
+		}
+	}
+	d.blocked = blocked
+
+	// Without a dynamic table there is nothing to cancel.
+	if d.maxTableCapacity == 0 {
+		return
+	}
+	start := len(d.decoderStream)
+	d.decoderStream = appendInteger(d.decoderStream, streamID, 6)
+	d.decoderStream[start] |= 0x40
+}
+
+// DecoderStream returns the instructions to send on the decoder stream,
+// acknowledging the entries inserted since the last call.
+func (d *QPackDecoder) DecoderStream() []byte {
+	if d.table.insertCount() > d.acknowledged {
+		// Insert Count Increment
+		d.decoderStream = appendInteger(d.decoderStream, d.table.insertCount()-d.acknowledged, 6)
+		d.acknowledged = d.table.insertCount()
+	}
+	b := d.decoderStream
+	d.decoderStream = nil
+	return b
+}
+
+type qpackSectionRefs struct {
+	requiredInsertCount uint64
+	// minIndex is the oldest entry the section references, which
+	// cannot be evicted until the section is acknowledged.
+	minIndex uint64
+}
+
+type qpackLineKind uint8
+
+const (
+	qpackIndexedStatic qpackLineKind = iota
+	qpackIndexedDynamic
+	qpackLiteralStaticName
+	qpackLiteralDynamicName
+	qpackLiteralName
+)
+
+type qpackLine struct {
+	kind  qpackLineKind
+	index uint64 // static index or absolute dynamic index
+	hf    HeaderField
+	never bool
+}
+
+type QPackEncoder struct {
+	table qpackTable
+	// maxTableCapacity and maxBlockedStreams are the decoder's
+	// SETTINGS_QPACK_MAX_TABLE_CAPACITY and SETTINGS_QPACK_BLOCKED_STREAMS.
+	maxTableCapacity  uint64
+	maxBlockedStreams int
+	huffman           huffmanMode
+
+	knownReceivedCount uint64
+	// outstanding holds per stream the field sections referencing the
+	// dynamic table that are not acknowledged yet, oldest first.
+	outstanding map[uint64][]qpackSectionRefs
+
+	encoderStream []byte
+	// decoderStream holds the start of an instruction not fully received.
+	decoderStream []byte
+}
+
+func NewQPackEncoder(maxTableCapacity uint64, maxBlockedStreams int) *QPackEncoder {
+	return &QPackEncoder{
+		maxTableCapacity:  maxTableCapacity,
+		maxBlockedStreams: maxBlockedStreams,
+		huffman:           huffmanShorter,
+		outstanding:       map[uint64][]qpackSectionRefs{},
+	}
+}
+
+// minReferenced returns the oldest entry referenced by an unacknowledged
+// field section, or the insert count if there is none.
+func (e *QPackEncoder) minReferenced() uint64 {
+	min := e.table.insertCount()
+	for _, sections := range e.outstanding {
+		for _, section := range sections {
+			if section.minIndex < min {
+				min = section.minIndex
+			}
+		}
+	}
+	return min
+}
+
+func (e *QPackEncoder) isBlocked(streamID uint64) bool {
+	for _, section := range e.outstanding[streamID] {
+		if section.requiredInsertCount > e.knownReceivedCount {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *QPackEncoder) blockedStreams() int {
+	n := 0
+	for streamID := range e.outstanding {
+		if e.isBlocked(streamID) {
+			n++
+		}
+	}
+	return n
+}
+
+// SetDynamicTableCapacity changes the capacity of the dynamic table, which
+// cannot exceed the decoder's maximum nor evict referenced entries.
+func (e *QPackEncoder) SetDynamicTableCapacity(capacity uint64) error {
+	if capacity > e.maxTableCapacity {
+		return fmt.Errorf("dynamic table capacity %d exceeds %d", capacity, e.maxTableCapacity)
+	}
+	n := e.table.oversize(capacity)
+	if n > 0 && e.table.dropped+uint64(n) > e.minReferenced() {
+		return fmt.Errorf("dynamic table capacity %d would evict referenced entries", capacity)
+	}
+	e.table.evict(n)
+	e.table.capacity = capacity
+
+	// Set Dynamic Table Capacity
+	start := len(e.encoderStream)
+	e.encoderStream = appendInteger(e.encoderStream, capacity, 5)
+	e.encoderStream[start] |= 0x20
+	return nil
+}
+
+// staticSearch returns the static index of an exact match, or else of the
+// first entry with the same name.
+func qpackStaticSearch(hf HeaderField) (index int, nameOnly bool, found bool) {
+	index = -1
+	for i, entry := range qpackStaticTable {
+		if entry.name != hf.name {
+			continue
+		}
+		if entry.value == hf.value {
+			return i, false, true
+		}
+		if index == -1 {
+			index = i
+		}
+	}
+	return index, true, index != -1
+}
+
+// dynamicSearch is staticSearch for the dynamic table, newest entries first.
+func (e *QPackEncoder) dynamicSearch(hf HeaderField) (abs uint64, nameOnly bool, found bool) {
+	for i := len(e.table.entries) - 1; i >= 0; i-- {
+		entry := e.table.entries[i]
+		if entry.name != hf.name {
+			continue
+		}
+		if entry.value == hf.value {
+			return e.table.dropped + uint64(i), false, true
+		}
+		if !found {
+			abs, found = e.table.dropped+uint64(i), true
+		}
+	}
+	return abs, true, found
+}
+
+// insert adds hf to the dynamic table through the encoder stream, if it
+// fits without evicting an entry older than keep.
+func (e *QPackEncoder) insert(hf HeaderField, keep uint64) (uint64, bool) {
+	n, ok := e.table.fit(uint64(hf.size()))
+	if !ok || e.table.dropped+uint64(n) > keep {
+		return 0, false
+	}
+
+	start := len(e.encoderStream)
+	if index, nameOnly, found := qpackStaticSearch(hf); found && nameOnly {
+		// Insert with Name Reference, static table
+		e.encoderStream = appendInteger(e.encoderStream, uint64(index), 6)
+		e.encoderStream[start] |= 0xc0
+	} else if abs, _, found := e.dynamicSearch(hf); found && abs >= e.table.dropped+uint64(n) {
+		// Insert with Name Reference, dynamic table
+		e.encoderStream = appendInteger(e.encoderStream, e.table.insertCount()-1-abs, 6)
+		e.encoderStream[start] |= 0x80
+	} else {
+		// Insert with Literal Name
+		e.encoderStream = appendString(e.encoderStream, 0x40, 5, hf.name, e.huffman)
+	}
+	e.encoderStream = appendString(e.encoderStream, 0, 7, hf.value, e.huffman)
+
+	e.table.insert(hf)
+	return e.table.insertCount() - 1, true
+}
+
+// EncodeFieldSection encodes a field section for the given request stream.
+// The instructions it adds to the encoder stream have to be sent before,
+// or along with, the field section.
+func (e *QPackEncoder) EncodeFieldSection(streamID uint64, headerFields []HeaderField) []byte {
+	section := qpackSectionRefs{minIndex: e.table.insertCount()}
+	// A section referencing entries the decoder may not have yet blocks
+	// its stream, which is only allowed for so many streams.
+	canBlock := e.isBlocked(streamID) || e.blockedStreams() < e.maxBlockedStreams
+	usable := func(abs uint64) bool {
+		return abs < e.knownReceivedCount || canBlock
+	}
+	reference := func(abs uint64) {
+		if abs+1 > section.requiredInsertCount {
+			section.requiredInsertCount = abs + 1
+		}
+		if abs < section.minIndex {
+			section.minIndex = abs
+		}
+	}
+
+	lines := make([]qpackLine, 0, len(headerFields))
+	for _, hf := range headerFields {
+		line := qpackLine{hf: hf, kind: qpackLiteralName}
+		indexing := fieldIndexing(hf)
+		line.never = indexing == neverIndexed
+
+		staticIndex, staticNameOnly, staticFound := qpackStaticSearch(hf)
+		abs, dynamicNameOnly, dynamicFound := e.dynamicSearch(hf)
+		switch {
+		case staticFound && !staticNameOnly && !line.never:
+			line.kind, line.index = qpackIndexedStatic, uint64(staticIndex)
+		case dynamicFound && !dynamicNameOnly && !line.never && usable(abs):
+			line.kind, line.index = qpackIndexedDynamic, abs
+			reference(abs)
+		default:
+			// Without room to block, the entry is inserted for the
+			// sections sent once the decoder acknowledged it.
+			if indexing == incrementalIndexing && (!dynamicFound || dynamicNameOnly) {
+				keep := e.minReferenced()
+				if section.minIndex < keep {
+					keep = section.minIndex
+				}
+				if abs, ok := e.insert(hf, keep); ok && usable(abs) {
+					line.kind, line.index = qpackIndexedDynamic, abs
+					reference(abs)
+					break
+				}
+			}
+
+			// The table may have changed, look the name up again.
+			abs, _, dynamicFound = e.dynamicSearch(hf)
+			if staticFound {
+				line.kind, line.index = qpackLiteralStaticName, uint64(staticIndex)
+			} else if dynamicFound && usable(abs) {
+				line.kind, line.index = qpackLiteralDynamicName, abs
+				reference(abs)
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	// Base is the Required Insert Count, so every reference is relative.
+	base := section.requiredInsertCount
+	b := appendInteger(nil, encodeRequiredInsertCount(base, e.maxTableCapacity/32), 8)
+	b = append(b, 0x00)
+	for _, line := range lines {
+		start := len(b)
+		var never byte
+		switch line.kind {
+		case qpackIndexedStatic:
+			b = appendInteger(b, line.index, 6)
+			b[start] |= 0xc0
+			continue
+		case qpackIndexedDynamic:
+			b = appendInteger(b, base-1-line.index, 6)
+			b[start] |= 0x80
+			continue
+		case qpackLiteralStaticName:
+			if line.never {
+				never = 0x20
+			}
+			b = appendInteger(b, line.index, 4)
+			b[start] |= 0x50 | never
+		case qpackLiteralDynamicName:
+			if line.never {
+				never = 0x20
+			}
+			b = appendInteger(b, base-1-line.index, 4)
+			b[start] |= 0x40 | never
+		case qpackLiteralName:
+			if line.never {
+				never = 0x10
+			}
+			b = appendString(b, 0x20|never, 3, line.hf.name, e.huffman)
+		}
+		b = appendString(b, 0, 7, line.hf.value, e.huffman)
+	}
+
+	if section.requiredInsertCount != 0 {
+		e.outstanding[streamID] = append(e.outstanding[streamID], section)
+	}
+	return b
+}
+
+// EncoderStream returns the instructions to send on the encoder stream.
+func (e *QPackEncoder) EncoderStream() []byte {
+	b := e.encoderStream
+	e.encoderStream = nil
+	return b
+}
+
+// ReadDecoderStream processes data received on the decoder stream, which
+// may end in the middle of an instruction.
+func (e *QPackEncoder) ReadDecoderStream(b []byte) error {
+	e.decoderStream = append(e.decoderStream, b...)
+	consumed := 0
+	for consumed < len(e.decoderStream) {
+		n, err := e.readDecoderInstruction(e.decoderStream[consumed:])
+		if errors.Is(err, ErrTruncated) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrQPackDecoderStream, err)
+		}
+		consumed += n
+	}
+	e.decoderStream = append(e.decoderStream[:0], e.decoderStream[consumed:]...)
+	return nil
+}
+
+func (e *QPackEncoder) readDecoderInstruction(b []byte) (int, error) {
+	switch {
+	case b[0]&0x80 != 0:
+		// Section Acknowledgment
+		streamID, n, err := decodeInteger(b, 7, maxQPackInteger)
+		if err != nil {
+			return 0, err
+		}
+		sections := e.outstanding[streamID]
+		if len(sections) == 0 {
+			return 0, fmt.Errorf("no field section to acknowledge on stream %d", streamID)
+		}
+		if sections[0].requiredInsertCount > e.knownReceivedCount {
+			e.knownReceivedCount = sections[0].requiredInsertCount
+		}
+		if len(sections) == 1 {
+			delete(e.outstanding, streamID)
+		} else {
+			e.outstanding[streamID] = sections[1:]
+		}
+		return n, nil
+	case b[0]&0xc0 == 0x40:
+		// Stream Cancellation
+		streamID, n, err := decodeInteger(b, 6, maxQPackInteger)
+		if err != nil {
+			return 0, err
+		}
+		delete(e.outstanding, streamID)
+		return n, nil
+	default:
+		// Insert Count Increment
+		increment, n, err := decodeInteger(b, 6, maxQPackInteger)
+		if err != nil {
+			return 0, err
+		}
+		if increment == 0 || e.knownReceivedCount+increment > e.table.insertCount() {
+			return 0, fmt.Errorf("invalid Insert Count Increment %d", increment)
+		}
+		e.knownReceivedCount += increment
+		return n, nil
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func checkQPackTable(t *testing.T, table *qpackTable, insertCount, size uint64) {
+	t.Helper()
+	if table.insertCount() != insertCount {
+		t.Errorf("expected insert count %d got %d", insertCount, table.insertCount())
+	}
+	if table.size != size {
+		t.Errorf("expected dynamic table size %d got %d", size, table.size)
+	}
+}
+
+// TestRFC9204Examples replays RFC 9204 Appendix B against the decoder.
+func TestRFC9204Examples(t *testing.T) {
+	decoder := NewQPackDecoder(220, 1)
+
+	// B.1. Literal Field Line with Name Reference
+	headers, err := decoder.DecodeFieldSection(0, mustDecodeHex(t, "0000 510b2f696e6465782e68746d6c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHeaderFields(t, []HeaderField{{name: ":path", value: "/index.html"}}, headers)
+	if b := decoder.DecoderStream(); len(b) != 0 {
+		t.Errorf("unexpected decoder stream %x", b)
+	}
+
+	// B.2. Dynamic Table, the field section arriving first is blocked.
+	section := mustDecodeHex(t, "0381 10 11")
+	if _, err := decoder.DecodeFieldSection(4, section); !errors.Is(err, ErrQPackBlocked) {
+		t.Fatalf("expected %s got %v", ErrQPackBlocked, err)
+	}
+	unblocked, err := decoder.ReadEncoderStream(mustDecodeHex(t, `
+		3fbd01
+		c00f7777772e6578616d706c652e636f6d
+		c10c2f73616d706c652f70617468`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unblocked) != 1 || unblocked[0].StreamID != 4 {
+		t.Fatalf("expected stream 4 to be unblocked got %v", unblocked)
+	}
+	checkHeaderFields(t, []HeaderField{
+		{name: ":authority", value: "www.example.com"},
+		{name: ":path", value: "/sample/path"},
+	}, unblocked[0].HeaderFields)
+	if b := decoder.DecoderStream(); !bytes.Equal(b, mustDecodeHex(t, "84")) {
+		t.Errorf("expected Section Acknowledgment 84 got %x", b)
+	}
+	checkQPackTable(t, &decoder.table, 2, 106)
+
+	// B.3. Speculative Insert
+	if _, err := decoder.ReadEncoderStream(mustDecodeHex(t, "4a637573746f6d2d6b65790c637573746f6d2d76616c7565")); err != nil {
+		t.Fatal(err)
+	}
+	if b := decoder.DecoderStream(); !bytes.Equal(b, mustDecodeHex(t, "01")) {
+		t.Errorf("expected Insert Count Increment 01 got %x", b)
+	}
+	checkQPackTable(t, &decoder.table, 3, 160)
+
+	// B.4. Duplicate Instruction, Stream Cancellation
+	if _, err := decoder.ReadEncoderStream(mustDecodeHex(t, "02")); err != nil {
+		t.Fatal(err)
+	}
+	headers, err = decoder.DecodeFieldSection(8, mustDecodeHex(t, "0500 80 c1 81"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHeaderFields(t, []HeaderField{
+		{name: ":authority", value: "www.example.com"},
+		{name: ":path", value: "/"},
+		{name: "custom-key", value: "custom-value"},
+	}, headers)
+	decoder.CancelStream(8)
+	if b := decoder.DecoderStream(); !bytes.Equal(b, mustDecodeHex(t, "88 48")) {
+		t.Errorf("expected Section Acknowledgment and Stream Cancellation 88 48 got %x", b)
+	}
+	checkQPackTable(t, &decoder.table, 4, 217)
+
+	// B.5. Dynamic Table Insert, Eviction
+	if _, err := decoder.ReadEncoderStream(mustDecodeHex(t, "810d637573746f6d2d76616c756532")); err != nil {
+		t.Fatal(err)
+	}
+	if b := decoder.DecoderStream(); !bytes.Equal(b, mustDecodeHex(t, "01")) {
+		t.Errorf("expected Insert Count Increment 01 got %x", b)
+	}
+	checkQPackTable(t, &decoder.table, 5, 215)
+	if hf, ok := decoder.table.get(4); !ok || hf != (HeaderField{name: "custom-key", value: "custom-value2"}) {
+		t.Errorf("unexpected newest entry %s", hf)
+	}
+}
+
+func TestRequiredInsertCount(t *testing.T) {
+	// MaxEntries is 3 with a 100 octets table.
+	for _, test := range []struct {
+		requiredInsertCount uint64
+		totalInserts        uint64
+	}{
+		{0, 0}, {1, 1}, {5, 5}, {6, 5}, {7, 5}, {8, 5}, {9, 9}, {100, 98}, {100, 102},
+	} {
+		encoded := encodeRequiredInsertCount(test.requiredInsertCount, 3)
+		decoded, err := decodeRequiredInsertCount(encoded, 3, test.totalInserts)
+		if err != nil {
+			t.Fatalf("%d: %s", test.requiredInsertCount, err)
+		}
+		if decoded != test.requiredInsertCount {
+			t.Errorf("expected %d got %d", test.requiredInsertCount, decoded)
+		}
+	}
+
+	for _, encoded := range []uint64{7, 100} {
+		if _, err := decodeRequiredInsertCount(encoded, 3, 5); !errors.Is(err, ErrQPackDecompressionFailed) {
+			t.Errorf("%d: expected %s got %v", encoded, ErrQPackDecompressionFailed, err)
+		}
+	}
+	// Without a dynamic table only 0 is valid.
+	if _, err := decodeRequiredInsertCount(1, 0, 0); !errors.Is(err, ErrQPackDecompressionFailed) {
+		t.Errorf("expected %s got %v", ErrQPackDecompressionFailed, err)
+	}
+}
+
+func TestQPackDecoderErrors(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		encoder string
+		section string
+		err     error
+	}{
+		{name: "invalid static index", section: "0000 ff24", err: ErrQPackDecompressionFailed},
+		{name: "dynamic reference without table", section: "0000 80", err: ErrQPackDecompressionFailed},
+		{name: "truncated literal", section: "0000 5f1d05616263", err: ErrQPackDecompressionFailed},
+		{name: "unused Required Insert Count", encoder: "3fbd01 c00f7777772e6578616d706c652e636f6d", section: "0200 d1", err: ErrQPackDecompressionFailed},
+		{name: "reference beyond Required Insert Count", encoder: "3fbd01 c00f7777772e6578616d706c652e636f6d", section: "0200 10", err: ErrQPackDecompressionFailed},
+		{name: "too many blocked streams", section: "0200 80", err: ErrQPackDecompressionFailed},
+		{name: "capacity above maximum", encoder: "3fbe01", err: ErrQPackEncoderStream},
+		{name: "insert above capacity", encoder: "c00f7777772e6578616d706c652e636f6d", err: ErrQPackEncoderStream},
+		{name: "duplicate of unknown entry", encoder: "3fbd01 00", err: ErrQPackEncoderStream},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := NewQPackDecoder(220, 0)
+			var err error
+			if test.encoder != "" {
+				_, err = decoder.ReadEncoderStream(mustDecodeHex(t, test.encoder))
+			}
+			if err == nil && test.section != "" {
+				_, err = decoder.DecodeFieldSection(4, mustDecodeHex(t, test.section))
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("expected %s got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestQPackBlockedSectionFailure(t *testing.T) {
+	decoder := NewQPackDecoder(220, 2)
+	// Stream 4 is valid, stream 8 does not use its Required Insert Count.
+	for _, section := range []struct {
+		streamID uint64
+		section  string
+	}{{4, "0381 10 11"}, {8, "0300 d1"}} {
+		if _, err := decoder.DecodeFieldSection(section.streamID, mustDecodeHex(t, section.section)); !errors.Is(err, ErrQPackBlocked) {
+			t.Fatalf("expected %s got %v", ErrQPackBlocked, err)
+		}
+	}
+	_, err := decoder.ReadEncoderStream(mustDecodeHex(t, "3fbd01 c00f7777772e6578616d706c652e636f6d c10c2f73616d706c652f70617468"))
+	if !errors.Is(err, ErrQPackDecompressionFailed) {
+		t.Fatalf("expected %s got %v", ErrQPackDecompressionFailed, err)
+	}
+
+	// The decoder is failed for good, rather than left with stale blocked
+	// sections.
+	if len(decoder.blocked) != 0 {
+		t.Errorf("expected no blocked sections got %d", len(decoder.blocked))
+	}
+	if _, err := decoder.ReadEncoderStream(mustDecodeHex(t, "02")); !errors.Is(err, ErrQPackDecompressionFailed) {
+		t.Errorf("expected %s got %v", ErrQPackDecompressionFailed, err)
+	}
+	if _, err := decoder.DecodeFieldSection(12, mustDecodeHex(t, "0000 d1")); !errors.Is(err, ErrQPackDecompressionFailed) {
+		t.Errorf("expected %s got %v", ErrQPackDecompressionFailed, err)
+	}
+}
+
+func TestQPackPartialInstructions(t *testing.T) {
+	decoder := NewQPackDecoder(220, 0)
+	stream := mustDecodeHex(t, "3fbd01 c00f7777772e6578616d706c652e636f6d c10c2f73616d706c652f70617468")
+	for i := range stream {
+		if _, err := decoder.ReadEncoderStream(stream[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkQPackTable(t, &decoder.table, 2, 106)
+
+	encoder := NewQPackEncoder(220, 0)
+	encoder.table.capacity = 220
+	encoder.EncodeFieldSection(4, []HeaderField{{name: "custom-key", value: "custom-value"}})
+	// Insert Count Increment split over two reads is an error only once
+	// complete: the encoder never blocks, so nothing was inserted.
+	if err := encoder.ReadDecoderStream([]byte{0x3f}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.ReadDecoderStream([]byte{0x01}); !errors.Is(err, ErrQPackDecoderStream) {
+		t.Errorf("expected %s got %v", ErrQPackDecoderStream, err)
+	}
+}
+
+func TestQPackBlockedStreams(t *testing.T) {
+	encoder := NewQPackEncoder(220, 1)
+	decoder := NewQPackDecoder(220, 1)
+	if err := encoder.SetDynamicTableCapacity(220); err != nil {
+		t.Fatal(err)
+	}
+	headers := []HeaderField{{name: "custom-key", value: "custom-value"}}
+
+	// The first stream may block, the second has to do without the
+	// entries the decoder may not have.
+	first := encoder.EncodeFieldSection(4, headers)
+	second := encoder.EncodeFieldSection(8, headers)
+	if _, err := decoder.DecodeFieldSection(4, first); !errors.Is(err, ErrQPackBlocked) {
+		t.Fatalf("expected %s got %v", ErrQPackBlocked, err)
+	}
+	decoded, err := decoder.DecodeFieldSection(8, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHeaderFields(t, headers, decoded)
+
+	unblocked, err := decoder.ReadEncoderStream(encoder.EncoderStream())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unblocked) != 1 || unblocked[0].StreamID != 4 {
+		t.Fatalf("expected stream 4 to be unblocked got %v", unblocked)
+	}
+	checkHeaderFields(t, headers, unblocked[0].HeaderFields)
+	if err := encoder.ReadDecoderStream(decoder.DecoderStream()); err != nil {
+		t.Fatal(err)
+	}
+	if encoder.knownReceivedCount != 1 || len(encoder.outstanding) != 0 {
+		t.Errorf("expected the entry to be acknowledged, known received count %d", encoder.knownReceivedCount)
+	}
+
+	// A cancelled stream stops blocking, and its references are released.
+	blocked := encoder.EncodeFieldSection(12, []HeaderField{{name: "custom-key", value: "other-value"}})
+	if _, err := decoder.DecodeFieldSection(12, blocked); !errors.Is(err, ErrQPackBlocked) {
+		t.Fatalf("expected %s got %v", ErrQPackBlocked, err)
+	}
+	decoder.CancelStream(12)
+	if err := encoder.ReadDecoderStream(decoder.DecoderStream()); err != nil {
+		t.Fatal(err)
+	}
+	if len(encoder.outstanding) != 0 {
+		t.Errorf("expected no outstanding field section got %v", encoder.outstanding)
+	}
+	unblocked, err = decoder.ReadEncoderStream(encoder.EncoderStream())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unblocked) != 0 {
+		t.Errorf("expected the cancelled stream to be dropped got %v", unblocked)
+	}
+}
+
+func TestQPackEncoderEviction(t *testing.T) {
+	encoder := NewQPackEncoder(100, 10)
+	if err := encoder.SetDynamicTableCapacity(100); err != nil {
+		t.Fatal(err)
+	}
+	// Only one of these fits: the second cannot evict the first while
+	// the section referencing it is not acknowledged.
+	first := encoder.EncodeFieldSection(4, []HeaderField{{name: "custom-key", value: "custom-value-1"}})
+	second := encoder.EncodeFieldSection(8, []HeaderField{{name: "custom-key", value: "custom-value-2"}})
+	if encoder.table.insertCount() != 1 {
+		t.Fatalf("expected 1 insert got %d", encoder.table.insertCount())
+	}
+	if err := encoder.SetDynamicTableCapacity(0); err == nil {
+		t.Error("expected an error evicting a referenced entry")
+	}
+
+	decoder := NewQPackDecoder(100, 10)
+	if _, err := decoder.ReadEncoderStream(encoder.EncoderStream()); err != nil {
+		t.Fatal(err)
+	}
+	for i, section := range [][]byte{first, second} {
+		if _, err := decoder.DecodeFieldSection(uint64(4*(i+1)), section); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.ReadDecoderStream(decoder.DecoderStream()); err != nil {
+		t.Fatal(err)
+	}
+	if len(encoder.outstanding) != 0 {
+		t.Fatalf("expected no outstanding field section got %v", encoder.outstanding)
+	}
+	encoder.EncodeFieldSection(12, []HeaderField{{name: "custom-key", value: "custom-value-2"}})
+	if encoder.table.insertCount() != 2 || encoder.table.dropped != 1 {
+		t.Errorf("expected the first entry to be evicted, %d inserts %d dropped", encoder.table.insertCount(), encoder.table.dropped)
+	}
+}
+
+/*
+The QPACK offline interop format (https://github.com/quicwg/base-drafts/wiki/QPACK-Offline-Interop):
+a QIF file lists field sections as "name<TAB>value" lines separated by blank
+lines, and an encoded file, named <qif>.out.<table capacity>.<blocked
+streams>.<acknowledgment mode>, is a sequence of
+
+	+-------------------------------+
+	|        Stream ID (64)         |
+	+-------------------------------+
+	|          Length (32)          |
+	+-------------------------------+
+	|         Payload (Length)      |
+	+-------------------------------+
+
+blocks, where stream 0 is the encoder stream and the field section of the
+n-th section of the QIF file is sent on stream n.
+*/
+func readQIF(path string) ([][]HeaderField, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections := [][]HeaderField{}
+	section := []HeaderField{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#"):
+		case line == "":
+			if len(section) > 0 {
+				sections = append(sections, section)
+				section = []HeaderField{}
+			}
+		default:
+			name, value, ok := strings.Cut(line, "\t")
+			if !ok {
+				return nil, fmt.Errorf("invalid line %q", line)
+			}
+			section = append(section, HeaderField{name: name, value: value})
+		}
+	}
+	if len(section) > 0 {
+		sections = append(sections, section)
+	}
+	return sections, scanner.Err()
+}
+
+type qpackInteropParams struct {
+	capacity uint64
+	blocked  int
+	ack      bool
+}
+
+func parseInteropName(path string) (string, qpackInteropParams, error) {
+	params := qpackInteropParams{}
+	parts := strings.Split(filepath.Base(path), ".")
+	if len(parts) != 5 || parts[1] != "out" {
+		return "", params, fmt.Errorf("invalid encoded file name %s", path)
+	}
+	capacity, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return "", params, err
+	}
+	blocked, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return "", params, err
+	}
+	params.capacity, params.blocked, params.ack = capacity, blocked, parts[4] == "1"
+	return parts[0], params, nil
+}
+
+func appendInteropBlock(dst []byte, streamID uint64, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, streamID)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	return append(dst, payload...)
+}
+
+// decodeInterop decodes an encoded file, returning the field sections by
+// stream ID.
+func decodeInterop(r io.Reader, params qpackInteropParams) (map[uint64][]HeaderField, error) {
+	decoder := NewQPackDecoder(params.capacity, params.blocked)
+	decoded := map[uint64][]HeaderField{}
+	header := make([]byte, 12)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		streamID := binary.BigEndian.Uint64(header)
+		payload := make([]byte, binary.BigEndian.Uint32(header[8:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+
+		if streamID == 0 {
+			unblocked, err := decoder.ReadEncoderStream(payload)
+			if err != nil {
+				return nil, err
+			}
+			for _, section := range unblocked {
+				decoded[section.StreamID] = section.HeaderFields
+			}
+			continue
+		}
+		headers, err := decoder.DecodeFieldSection(streamID, payload)
+		if errors.Is(err, ErrQPackBlocked) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stream %d: %w", streamID, err)
+		}
+		decoded[streamID] = headers
+	}
+	if len(decoder.blocked) != 0 {
+		return nil, fmt.Errorf("%d field sections still blocked", len(decoder.blocked))
+	}
+	return decoded, nil
+}
+
+// encodeInterop encodes the field sections into the interop format. The
+// encoder stream is written after the field sections referencing it, so
+// that the decoder gets to block.
+func encodeInterop(sections [][]HeaderField, params qpackInteropParams) ([]byte, error) {
+	encoder := NewQPackEncoder(params.capacity, params.blocked)
+	decoder := NewQPackDecoder(params.capacity, params.blocked)
+	if err := encoder.SetDynamicTableCapacity(params.capacity); err != nil {
+		return nil, err
+	}
+
+	out := []byte{}
+	for i, section := range sections {
+		streamID := uint64(i + 1)
+		fieldSection := encoder.EncodeFieldSection(streamID, section)
+		out = appendInteropBlock(out, streamID, fieldSection)
+		instructions := encoder.EncoderStream()
+		if len(instructions) > 0 {
+			out = appendInteropBlock(out, 0, instructions)
+		}
+		if !params.ack {
+			continue
+		}
+
+		// Acknowledge through a decoder of our own.
+		if _, err := decoder.DecodeFieldSection(streamID, fieldSection); err != nil && !errors.Is(err, ErrQPackBlocked) {
+			return nil, err
+		}
+		if _, err := decoder.ReadEncoderStream(instructions); err != nil {
+			return nil, err
+		}
+		if err := encoder.ReadDecoderStream(decoder.DecoderStream()); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func checkInteropSections(t *testing.T, expected [][]HeaderField, decoded map[uint64][]HeaderField) {
+	t.Helper()
+	if len(decoded) != len(expected) {
+		t.Fatalf("expected %d field sections got %d", len(expected), len(decoded))
+	}
+	for i, section := range expected {
+		checkHeaderFields(t, section, decoded[uint64(i+1)])
+	}
+}
+
+// TestQPackEncodedFiles decodes the encoded files of
+// testdata/qpack/encoded, laid out as
+// encoded/<source>/<qif>.out.<capacity>.<blocked>.<ack> like the QPACK
+// offline interop repository, against the QIF files of testdata/qpack/qifs.
+// The only file is the exchange of RFC 9204 Appendix B, so this checks the
+// file format rather than interoperability with other implementations.
+func TestQPackEncodedFiles(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "qpack", "encoded", "*", "*.out.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no encoded files found")
+	}
+
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			name, params, err := parseInteropName(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := readQIF(filepath.Join("testdata", "qpack", "qifs", name+".qif"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			decoded, err := decodeInterop(bufio.NewReader(f), params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInteropSections(t, expected, decoded)
+		})
+	}
+}
+
+// TestQPackQIFRoundTrip encodes every QIF file with the settings the
+// interop runs use, and decodes the result back with our own decoder.
+func TestQPackQIFRoundTrip(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "qpack", "qifs", "*.qif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		sections, err := readQIF(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, params := range []qpackInteropParams{
+			{capacity: 0, blocked: 0},
+			{capacity: 256, blocked: 0, ack: true},
+			{capacity: 256, blocked: 100},
+			{capacity: 512, blocked: 100, ack: true},
+			{capacity: 4096, blocked: 100, ack: true},
+		} {
+			t.Run(fmt.Sprintf("%s.out.%d.%d.%t", filepath.Base(path), params.capacity, params.blocked, params.ack), func(t *testing.T) {
+				encoded, err := encodeInterop(sections, params)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := decodeInterop(bytes.NewReader(encoded), params)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkInteropSections(t, sections, decoded)
+			})
+		}
+	}
+}
@@ -0,0 +1,1181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrServerClosed = errors.New("server closed")
+)
+
+const (
+	// serverStreamWindow and serverConnWindow are the receive windows we
+	// grant clients for request bodies.
+	serverStreamWindow = 1 << 20
+	serverConnWindow   = 1 << 24
+	// defaultServerMaxConcurrentStreams is advertised when the Server
+	// sets no limit.
+	defaultServerMaxConcurrentStreams = 250
+	// responseBufferSize is how much of a response body is buffered
+	// before DATA frames are sent, unless the handler flushes.
+	responseBufferSize = 4 << 10
+)
+
+// Server serves HTTP/2 connections, dispatching every stream to an
+// http.Handler.
+type Server struct {
+	// Handler serves the requests, http.DefaultServeMux if nil.
+	Handler http.Handler
+	// TLSConfig configures ListenAndServeTLS. "h2" is added to its
+	// NextProtos.
+	TLSConfig *tls.Config
+	// MaxConcurrentStreams bounds the streams a client may open at once,
+	// 250 if zero. Streams beyond it are refused with REFUSED_STREAM.
+	MaxConcurrentStreams uint32
+	// Origins, if set, are sent in an ORIGIN frame on the TLS connections,
+	// telling clients they may send requests to those origins there too
+	// (RFC 8336).
+	Origins []string
+	// FrameTracer, if set, logs the frames of every connection.
+	FrameTracer *FrameTracer
+	// EventSink, if set, receives the events of every connection.
+	EventSink EventSink
+	// ErrorLog logs handler panics and rejected connections, the log
+	// package's standard logger if nil.
+	ErrorLog *log.Logger
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	closed    bool
+	// http1 serves the cleartext connections that are not h2c, handed
+	// over through http1Conns.
+	http1      *http.Server
+	http1Conns *connListener
+}
+
+// handler returns the handler serving the requests.
+func (s *Server) handler() http.Handler {
+	if s.Handler == nil {
+		return http.DefaultServeMux
+	}
+	return s.Handler
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (s *Server) maxConcurrentStreams() uint32 {
+	if s.MaxConcurrentStreams == 0 {
+		return defaultServerMaxConcurrentStreams
+	}
+	return s.MaxConcurrentStreams
+}
+
+// ListenAndServeTLS listens on addr and serves HTTP/2 over TLS, with the
+// certificate of certFile and keyFile unless TLSConfig has one. The TLS
+// policy of HTTP/2 applies to TLSConfig.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	config := applyTLSPolicy(s.TLSConfig)
+	if !containsString(config.NextProtos, "h2") {
+		config.NextProtos = append([]string{"h2"}, config.NextProtos...)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(tls.NewListener(listener, config))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve accepts connections on listener and serves each of them with
+// ServeConn, until Close is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]struct{}{}
+	}
+	s.listeners[listener] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, listener)
+		s.mu.Unlock()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves HTTP/2 on conn until either side closes it. A TLS
+// connection must negotiate "h2" with ALPN. On a cleartext connection the
+// client preface selects h2c, and anything else is served as HTTP/1.1.
+func (s *Server) ServeConn(conn net.Conn) {
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			s.logf("h2: TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		state := tlsConn.ConnectionState()
+		if state.NegotiatedProtocol != "h2" {
+			s.logf("h2: %s negotiated %q instead of h2", conn.RemoteAddr(), state.NegotiatedProtocol)
+			conn.Close()
+			return
+		}
+		tlsState = &state
+	} else {
+		sniffed, h2, err := sniffPreface(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if !h2 {
+			s.serveHTTP1(sniffed)
+			return
+		}
+		conn = sniffed
+	}
+	s.serveH2(conn, tlsState, nil)
+}
+
+// serveH2 serves HTTP/2 on conn, which starts with the client preface.
+// upgrade is the request of an h2c upgrade, if any, served on stream 1.
+func (s *Server) serveH2(conn net.Conn, tlsState *tls.ConnectionState, upgrade *h2cUpgrade) {
+	defer conn.Close()
+	sc := newServerConn(s, conn, tlsState)
+	sc.upgrade = upgrade
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if s.conns == nil {
+		s.conns = map[*serverConn]struct{}{}
+	}
+	s.conns[sc] = struct{}{}
+	s.mu.Unlock()
+
+	sc.serve()
+
+	s.mu.Lock()
+	delete(s.conns, sc)
+	s.mu.Unlock()
+}
+
+// Close closes the listeners, then sends GOAWAY on every connection and
+// closes it.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	listeners := s.listeners
+	conns := s.conns
+	http1 := s.http1
+	s.listeners, s.conns = nil, nil
+	s.mu.Unlock()
+
+	if http1 != nil {
+		http1.Close()
+	}
+
+	for listener := range listeners {
+		listener.Close()
+	}
+	for sc := range conns {
+		sc.closeWithError(ConnectionError{Code: NoError, Reason: "server closed"})
+	}
+	return nil
+}
+
+type serverConn struct {
+	srv      *Server
+	conn     *Conn
+	netConn  net.Conn
+	tlsState *tls.ConnectionState
+	handler  http.Handler
+	upgrade  *h2cUpgrade
+
+	// ctx is the parent of the stream contexts, canceled with the
+	// connection.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// cond is broadcast on every change of the state below.
+	cond              *sync.Cond
+	streams           map[uint32]*serverStream
+	lastStreamID      uint32
+	peerInitialWindow int64
+	maxFrameSize      uint32
+	sendWindow        int64
+	recvWindow        int64
+	// unacked counts the octets of request bodies consumed, but not yet
+	// returned to the client with a WINDOW_UPDATE.
+	unacked int64
+	// err is set once the connection is closed.
+	err error
+}
+
+func newServerConn(srv *Server, conn net.Conn, tlsState *tls.ConnectionState) *serverConn {
+	sc := &serverConn{
+		srv:               srv,
+		conn:              NewConn(conn),
+		netConn:           conn,
+		tlsState:          tlsState,
+		handler:           srv.handler(),
+		streams:           map[uint32]*serverStream{},
+		peerInitialWindow: defaultInitialWindowSize,
+		maxFrameSize:      defaultMaxFrameSize,
+		sendWindow:        defaultInitialWindowSize,
+		recvWindow:        serverConnWindow,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.ctx, sc.cancel = context.WithCancel(context.Background())
+	sc.conn.SetFrameTracer(srv.FrameTracer)
+	sc.conn.SetEventSink(srv.EventSink)
+	return sc
+}
+
+func (sc *serverConn) serve() {
+	if err := sc.conn.ReadPreface(); err != nil {
+		if errors.Is(err, ErrProtocol) {
+			sc.srv.logf("h2: %s: %v", sc.netConn.RemoteAddr(), err)
+		}
+		sc.closeWithError(err)
+		return
+	}
+	if sc.tlsState != nil {
+		if err := checkTLSPolicy(*sc.tlsState); err != nil {
+			sc.srv.logf("h2: %s: %v", sc.netConn.RemoteAddr(), err)
+			sc.closeWithError(ConnectionError{Code: InadequateSecurity, Reason: err.Error()})
+			return
+		}
+	}
+
+	settings := Frame{
+		Type: SettingFrameType,
+		Data: SettingFrame{Params: map[SettingParam]uint32{
+			SettingsMaxConcurrentStreams: sc.srv.maxConcurrentStreams(),
+			SettingsInitialWindowSize:    serverStreamWindow,
+			SettingsMaxHeaderListSize:    defaultMaxHeaderListSize,
+		}},
+	}
+	windowUpdate := Frame{
+		Type: WindowUpdateFrameType,
+		Data: WindowUpdateFrame{WindowSizeIncrement: serverConnWindow - defaultInitialWindowSize},
+	}
+	frames := []Frame{settings, windowUpdate}
+	if sc.tlsState != nil && len(sc.srv.Origins) > 0 {
+		frames = append(frames, Frame{Type: OriginFrameType, Data: OriginFrame{Origins: sc.srv.Origins}})
+	}
+	for _, frame := range frames {
+		if err := sc.conn.WriteFrame(frame); err != nil {
+			sc.closeWithError(err)
+			return
+		}
+	}
+	if sc.upgrade != nil {
+		if err := sc.serveUpgrade(); err != nil {
+			sc.closeWithError(err)
+			return
+		}
+	}
+
+	for first := true; ; first = false {
+		frame, err := sc.conn.ReadFrame()
+		switch {
+		case err == nil && first && (frame.Type != SettingFrameType || frame.Flags&AckFlag != UnsetFlag):
+			// The client preface ends with a SETTINGS frame.
+			err = ConnectionError{Code: ProtocolError, Reason: fmt.Sprintf("%s frame instead of SETTINGS", frame.Type)}
+		case errors.Is(err, ErrHeaderListTooLarge) && frame.Type == HeaderFrameType:
+			err = sc.refuseHeaderList(frame)
+		case err == nil:
+			err = sc.handleFrame(frame)
+		}
+		if err != nil {
+			sc.closeWithError(err)
+			return
+		}
+	}
+}
+
+// closeWithError closes the connection because of err, sending GOAWAY
+// first unless the connection is broken.
+func (sc *serverConn) closeWithError(err error) {
+	sc.mu.Lock()
+	if sc.err != nil {
+		sc.mu.Unlock()
+		return
+	}
+	sc.err = err
+	lastStreamID := sc.lastStreamID
+	for _, st := range sc.streams {
+		st.fail(err)
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	if !isConnBroken(err) {
+		connErr := connectionError(err)
+		sc.conn.WriteFrame(Frame{
+			Type: GoAwayFrameType,
+			Data: GoAwayFrame{LastStreamID: lastStreamID, ErrorCode: connErr.Code, DebugData: []byte(connErr.Reason)},
+		})
+	}
+	sc.cancel()
+	sc.conn.Close()
+}
+
+func (sc *serverConn) handleFrame(frame Frame) error {
+	switch payload := frame.Data.(type) {
+	case SettingFrame:
+		if frame.Flags&AckFlag != UnsetFlag {
+			return nil
+		}
+		return sc.handleSettings(payload.Params)
+	case HeaderFrame:
+		return sc.handleHeaders(frame, payload)
+	case DataFrame:
+		return sc.handleData(frame, payload)
+	case RSTStreamFrame:
+		return sc.handleReset(frame, payload)
+	case PingFrame:
+		if frame.Flags&AckFlag != UnsetFlag {
+			return nil
+		}
+		return sc.conn.WriteFrame(Frame{Type: PingFrameType, Flags: AckFlag, Data: payload})
+	case WindowUpdateFrame:
+		return sc.handleWindowUpdate(frame, payload)
+	case PushPromiseFrame:
+		return ConnectionError{Code: ProtocolError, Reason: "PUSH_PROMISE from a client"}
+	}
+	// GOAWAY from a client only means it opens no more streams.
+	return nil
+}
+
+// stream returns the open stream id, nil if it is closed. Frames on idle
+// streams are connection errors.
+func (sc *serverConn) stream(id uint32, frameType FrameType) (*serverStream, error) {
+	if st := sc.streams[id]; st != nil {
+		return st, nil
+	}
+	if id == 0 || id > sc.lastStreamID {
+		return nil, ConnectionError{Code: ProtocolError, Reason: fmt.Sprintf("%s frame on idle stream %d", frameType, id)}
+	}
+	return nil, nil
+}
+
+func (sc *serverConn) handleSettings(params map[SettingParam]uint32) error {
+	if err := sc.applySettings(params); err != nil {
+		return err
+	}
+	return sc.conn.WriteFrame(Frame{Type: SettingFrameType, Flags: AckFlag, Data: SettingFrame{}})
+}
+
+// applySettings validates and applies the settings of the client.
+func (sc *serverConn) applySettings(params map[SettingParam]uint32) error {
+	sc.mu.Lock()
+	for param, value := range params {
+		switch param {
+		case SettingsEnablePush:
+			if value > 1 {
+				sc.mu.Unlock()
+				return ConnectionError{Code: ProtocolError, Reason: fmt.Sprintf("%s of %d", param, value)}
+			}
+		case SettingsInitialWindowSize:
+			if value > maxWindowSize {
+				sc.mu.Unlock()
+				return ConnectionError{Code: FlowControlError, Reason: fmt.Sprintf("%s of %d", param, value)}
+			}
+			delta := int64(value) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					sc.mu.Unlock()
+					return ConnectionError{Code: FlowControlError, Reason: fmt.Sprintf("window of stream %d overflows", st.id)}
+				}
+			}
+			sc.peerInitialWindow = int64(value)
+		case SettingsMaxFrameSize:
+			if value < defaultMaxFrameSize || value > maxFrameSize {
+				sc.mu.Unlock()
+				return ConnectionError{Code: ProtocolError, Reason: fmt.Sprintf("%s of %d", param, value)}
+			}
+			sc.maxFrameSize = value
+		}
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	sc.conn.ApplySettings(params)
+	return nil
+}
+
+// refuseHeaderList answers a request whose header list exceeds our limit
+// with 431, keeping the connection.
+func (sc *serverConn) refuseHeaderList(frame Frame) error {
+	sc.mu.Lock()
+	if frame.StreamID%2 == 0 || frame.StreamID <= sc.lastStreamID {
+		sc.mu.Unlock()
+		return ConnectionError{Code: ProtocolError, Reason: fmt.Sprintf("oversized HEADERS on stream %d", frame.StreamID)}
+	}
+	sc.lastStreamID = frame.StreamID
+	sc.mu.Unlock()
+	return sc.conn.WriteFrame(Frame{
+		Type:     HeaderFrameType,
+		Flags:    EndHeaderFlag | EndStreamFlag,
+		StreamID: frame.StreamID,
+		Data:     HeaderFrame{HeaderFields: NewResponseHeader(http.StatusRequestHeaderFieldsTooLarge).HeaderFields()},
+	})
+}
+
+func (sc *serverConn) handleHeaders(frame Frame, payload HeaderFrame) error {
+	endStream := frame.Flags&EndStreamFlag != UnsetFlag
+	sc.mu.Lock()
+	if st := sc.streams[frame.StreamID]; st != nil {
+		sc.mu.Unlock()
+		return sc.handleTrailers(st, endStream, payload.HeaderFields)
+	}
+	if frame.StreamID%2 == 0 {
+		sc.mu.Unlock()
+		return ConnectionError{Code: ProtocolError, Reason: fmt.Sprintf("HEADERS on server stream %d", frame.StreamID)}
+	}
+	if frame.StreamID <= sc.lastStreamID {
+		sc.mu.Unlock()
+		return ConnectionError{Code: StreamClosed, Reason: fmt.Sprintf("HEADERS on closed stream %d", frame.StreamID)}
+	}
+	sc.lastStreamID = frame.StreamID
+	refused := uint32(len(sc.streams)) >= sc.srv.maxConcurrentStreams()
+	sc.mu.Unlock()
+
+	if refused {
+		return sc.writeReset(frame.StreamID, RefusedStream)
+	}
+	header, err := ParseRequestHeader(payload.HeaderFields)
+	if err != nil {
+		return sc.writeReset(frame.StreamID, ProtocolError)
+	}
+
+	st := &serverStream{
+		sc:         sc,
+		id:         frame.StreamID,
+		recvWindow: serverStreamWindow,
+		recvEnd:    endStream,
+	}
+	st.ctx, st.cancel = context.WithCancel(sc.ctx)
+	req, err := sc.newRequest(st, header, endStream)
+	if err != nil {
+		st.cancel()
+		return sc.writeReset(frame.StreamID, ProtocolError)
+	}
+
+	sc.startStream(st, req)
+	return nil
+}
+
+// startStream runs the handler of a new stream, unless the connection is
+// closed.
+func (sc *serverConn) startStream(st *serverStream, req *http.Request) {
+	sc.mu.Lock()
+	if sc.err != nil {
+		sc.mu.Unlock()
+		st.cancel()
+		return
+	}
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[st.id] = st
+	sc.mu.Unlock()
+
+	go sc.runHandler(st, req)
+}
+
+func (sc *serverConn) handleTrailers(st *serverStream, endStream bool, headerFields []HeaderField) error {
+	sc.mu.Lock()
+	ended := st.recvEnd
+	sc.mu.Unlock()
+	if ended {
+		return ConnectionError{Code: StreamClosed, Reason: fmt.Sprintf("HEADERS after END_STREAM on stream %d", st.id)}
+	}
+	if !endStream {
+		st.abort(ProtocolError, fmt.Errorf("%w: trailers without END_STREAM", ErrMalformedHeader))
+		return nil
+	}
+	for _, hf := range headerFields {
+		err := validateField(hf)
+		if hf.IsPseudo() {
+			err = fmt.Errorf("%w: %s in trailers", ErrMalformedHeader, hf.name)
+		}
+		if err != nil {
+			st.abort(ProtocolError, err)
+			return nil
+		}
+	}
+
+	sc.mu.Lock()
+	st.trailer = headerFields
+	st.endRecv()
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *serverConn) handleData(frame Frame, payload DataFrame) error {
+	length := int64(frame.Length)
+	sc.mu.Lock()
+	if length > sc.recvWindow {
+		sc.mu.Unlock()
+		return ConnectionError{Code: FlowControlError, Reason: "connection window exceeded"}
+	}
+	sc.recvWindow -= length
+	st, err := sc.stream(frame.StreamID, frame.Type)
+	if err != nil {
+		sc.mu.Unlock()
+		return err
+	}
+
+	// Padding, and the data nobody will read, are returned at once.
+	var code ErrCode
+	var streamIncrement uint32
+	returned := length - int64(len(payload.Data))
+	switch {
+	case st == nil:
+		returned = length
+		code = StreamClosed
+	case st.recvEnd:
+		returned = length
+		code, err = StreamClosed, fmt.Errorf("%w: DATA after END_STREAM on stream %d", ErrProtocol, st.id)
+	case length > st.recvWindow:
+		returned = length
+		code, err = FlowControlError, fmt.Errorf("%w: window of stream %d exceeded", ErrProtocol, st.id)
+	default:
+		st.recvWindow -= length
+		if !st.bodyClosed {
+			st.body.Write(payload.Data)
+		} else {
+			returned = length
+		}
+		if frame.Flags&EndStreamFlag != UnsetFlag {
+			st.endRecv()
+		}
+		streamIncrement = st.consumed(returned)
+		sc.cond.Broadcast()
+	}
+	increment := sc.consumed(returned)
+	sc.mu.Unlock()
+
+	switch {
+	case st == nil:
+		if err := sc.writeReset(frame.StreamID, code); err != nil {
+			return err
+		}
+	case err != nil:
+		st.abort(code, err)
+	default:
+		if err := sc.writeWindowUpdate(st.id, streamIncrement); err != nil {
+			return err
+		}
+	}
+	return sc.writeWindowUpdate(0, increment)
+}
+
+func (sc *serverConn) handleReset(frame Frame, payload RSTStreamFrame) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st, err := sc.stream(frame.StreamID, frame.Type)
+	if st != nil {
+		st.fail(StreamError{StreamID: st.id, Code: payload.ErrorCode, Remote: true})
+	}
+	return err
+}
+
+func (sc *serverConn) handleWindowUpdate(frame Frame, payload WindowUpdateFrame) error {
+	increment := int64(payload.WindowSizeIncrement)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if frame.StreamID == 0 {
+		if increment == 0 {
+			return ConnectionError{Code: ProtocolError, Reason: "WINDOW_UPDATE of 0"}
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return ConnectionError{Code: FlowControlError, Reason: "connection window overflows"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st, err := sc.stream(frame.StreamID, frame.Type)
+	if st == nil {
+		return err
+	}
+	switch st.sendWindow += increment; {
+	case increment == 0:
+		go st.abort(ProtocolError, fmt.Errorf("%w: WINDOW_UPDATE of 0 on stream %d", ErrProtocol, st.id))
+	case st.sendWindow > maxWindowSize:
+		go st.abort(FlowControlError, fmt.Errorf("%w: window of stream %d overflows", ErrProtocol, st.id))
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// consumed returns n octets to the connection window and, once half of it
+// is used, returns the increment to send.
+func (sc *serverConn) consumed(n int64) uint32 {
+	sc.unacked += n
+	if sc.unacked < serverConnWindow/2 {
+		return 0
+	}
+	increment := sc.unacked
+	sc.recvWindow += increment
+	sc.unacked = 0
+	return uint32(increment)
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, increment uint32) error {
+	if increment == 0 {
+		return nil
+	}
+	return sc.conn.WriteFrame(Frame{
+		Type:     WindowUpdateFrameType,
+		StreamID: streamID,
+		Data:     WindowUpdateFrame{WindowSizeIncrement: increment},
+	})
+}
+
+func (sc *serverConn) writeReset(streamID uint32, code ErrCode) error {
+	return sc.conn.WriteFrame(Frame{Type: RSTStreamFrameType, StreamID: streamID, Data: RSTStreamFrame{ErrorCode: code}})
+}
+
+// removeStream forgets a closed stream, with sc.mu held.
+func (sc *serverConn) removeStream(st *serverStream) {
+	if st.removed {
+		return
+	}
+	st.removed = true
+	delete(sc.streams, st.id)
+	sc.cond.Broadcast()
+}
+
+// newRequest converts a request header to the *http.Request given to the
+// handler.
+func (sc *serverConn) newRequest(st *serverStream, header *RequestHeader, endStream bool) (*http.Request, error) {
+	req := &http.Request{
+		Method:     header.Method,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     http.Header{},
+		Host:       header.Authority,
+		RemoteAddr: sc.netConn.RemoteAddr().String(),
+		RequestURI: header.Path,
+		TLS:        sc.tlsState,
+	}
+	var err error
+	if header.Method == http.MethodConnect {
+		req.URL = &url.URL{Host: header.Authority}
+		req.RequestURI = header.Authority
+	} else if req.URL, err = url.ParseRequestURI(header.Path); err != nil {
+		return nil, err
+	}
+
+	var cookies []string
+	for _, hf := range header.Fields {
+		switch hf.name {
+		case "cookie":
+			// Cookie fields are split in HTTP/2 (RFC 9113 section
+			// 8.2.3).
+			cookies = append(cookies, hf.value)
+		case "host":
+			if req.Host == "" {
+				req.Host = hf.value
+			}
+		default:
+			req.Header.Add(hf.name, hf.value)
+		}
+	}
+	if len(cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	for _, value := range req.Header.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if req.Trailer == nil {
+					req.Trailer = http.Header{}
+				}
+				req.Trailer[http.CanonicalHeaderKey(name)] = nil
+			}
+		}
+	}
+
+	if endStream {
+		req.Body = http.NoBody
+	} else {
+		req.ContentLength = -1
+		if n, err := strconv.ParseInt(req.Header.Get("Content-Length"), 10, 64); err == nil {
+			req.ContentLength = n
+		}
+		req.Body = &serverRequestBody{st: st, req: req}
+	}
+	return req.WithContext(st.ctx), nil
+}
+
+func (sc *serverConn) runHandler(st *serverStream, req *http.Request) {
+	w := &responseWriter{st: st, req: req, handlerHeader: http.Header{}}
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				stack := make([]byte, 64<<10)
+				stack = stack[:runtime.Stack(stack, false)]
+				sc.srv.logf("h2: panic serving %s: %v\n%s", req.RemoteAddr, p, stack)
+			}
+			st.abort(InternalError, fmt.Errorf("handler panic: %v", p))
+		} else if err := w.finish(); err == nil {
+			st.endSend()
+		}
+		st.cancel()
+	}()
+	sc.handler.ServeHTTP(w, req)
+}
+
+type serverStream struct {
+	sc *serverConn
+	id uint32
+	// ctx is the context of the request, canceled once the stream is
+	// reset or the handler returns.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The fields below are guarded by sc.mu.
+	sendWindow int64
+	recvWindow int64
+	unacked    int64
+	sentEnd    bool
+	recvEnd    bool
+	body       bytes.Buffer
+	bodyClosed bool
+	trailer    []HeaderField
+	// err is set once the stream is reset or the connection closed.
+	err     error
+	removed bool
+}
+
+// fail closes the stream with err, with sc.mu held.
+func (st *serverStream) fail(err error) {
+	if st.err == nil {
+		st.err = err
+	}
+	st.cancel()
+	st.sc.removeStream(st)
+}
+
+// failed returns the error the stream was closed with, if any.
+func (st *serverStream) failed() error {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	return st.err
+}
+
+// endRecv records END_STREAM from the client, with sc.mu held.
+func (st *serverStream) endRecv() {
+	st.recvEnd = true
+	if st.sentEnd {
+		st.sc.removeStream(st)
+	}
+	st.sc.cond.Broadcast()
+}
+
+// endSend records the end of the response. The rest of a request body
+// nobody reads is declined with RST_STREAM NO_ERROR (RFC 9113 section
+// 8.1).
+func (st *serverStream) endSend() {
+	sc := st.sc
+	sc.mu.Lock()
+	st.sentEnd = true
+	pending := !st.recvEnd && !st.removed
+	if !pending {
+		sc.removeStream(st)
+	}
+	sc.mu.Unlock()
+	if pending {
+		st.abort(NoError, nil)
+	}
+}
+
+// abort resets the stream with code, unless it is already closed, and
+// fails it with err.
+func (st *serverStream) abort(code ErrCode, err error) {
+	sc := st.sc
+	sc.mu.Lock()
+	open := !st.removed
+	if err == nil {
+		err = StreamError{StreamID: st.id, Code: code}
+	}
+	st.fail(err)
+	sc.mu.Unlock()
+	if open {
+		sc.writeReset(st.id, code)
+	}
+}
+
+// consumed returns n octets to the stream window and, once half of it is
+// used, returns the increment to send.
+func (st *serverStream) consumed(n int64) uint32 {
+	if st.recvEnd || st.err != nil {
+		return 0
+	}
+	st.unacked += n
+	if st.unacked < serverStreamWindow/2 {
+		return 0
+	}
+	increment := st.unacked
+	st.recvWindow += increment
+	st.unacked = 0
+	return uint32(increment)
+}
+
+// reserveWindow waits until both send windows are open and takes up to n
+// octets from them, no more than a frame can carry.
+func (st *serverStream) reserveWindow(n int) (int, error) {
+	sc := st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if st.err != nil {
+			return 0, st.err
+		}
+		window := st.sendWindow
+		if sc.sendWindow < window {
+			window = sc.sendWindow
+		}
+		if window > 0 {
+			if int64(n) > window {
+				n = int(window)
+			}
+			if n > int(sc.maxFrameSize) {
+				n = int(sc.maxFrameSize)
+			}
+			st.sendWindow -= int64(n)
+			sc.sendWindow -= int64(n)
+			return n, nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+// writeData sends p in DATA frames under flow control, the last one
+// carrying END_STREAM if end is set.
+func (st *serverStream) writeData(p []byte, end bool) error {
+	for len(p) > 0 || end {
+		n := 0
+		if len(p) > 0 {
+			var err error
+			if n, err = st.reserveWindow(len(p)); err != nil {
+				return err
+			}
+		}
+		flags := UnsetFlag
+		if end && n == len(p) {
+			flags = EndStreamFlag
+			end = false
+		}
+		if err := st.sc.conn.WriteFrame(Frame{Type: DataFrameType, Flags: flags, StreamID: st.id, Data: DataFrame{Data: p[:n]}}); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// serverRequestBody is the body of a request, read from the DATA frames
+// buffered by the connection.
+type serverRequestBody struct {
+	st  *serverStream
+	req *http.Request
+	eof bool
+}
+
+func (b *serverRequestBody) Read(p []byte) (int, error) {
+	st := b.st
+	sc := st.sc
+	sc.mu.Lock()
+	for st.body.Len() == 0 && !st.recvEnd && st.err == nil && !st.bodyClosed {
+		sc.cond.Wait()
+	}
+	switch {
+	case st.bodyClosed:
+		sc.mu.Unlock()
+		return 0, http.ErrBodyReadAfterClose
+	case st.recvEnd && st.body.Len() == 0:
+		trailer := st.trailer
+		sc.mu.Unlock()
+		if !b.eof {
+			b.eof = true
+			for _, hf := range trailer {
+				if b.req.Trailer == nil {
+					b.req.Trailer = http.Header{}
+				}
+				b.req.Trailer.Add(hf.name, hf.value)
+			}
+		}
+		return 0, io.EOF
+	case !st.recvEnd && st.err != nil:
+		err := st.err
+		sc.mu.Unlock()
+		return 0, err
+	}
+	n, _ := st.body.Read(p)
+	connIncrement := sc.consumed(int64(n))
+	streamIncrement := st.consumed(int64(n))
+	sc.mu.Unlock()
+
+	sc.writeWindowUpdate(0, connIncrement)
+	sc.writeWindowUpdate(st.id, streamIncrement)
+	return n, nil
+}
+
+func (b *serverRequestBody) Close() error {
+	st := b.st
+	sc := st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st.bodyClosed {
+		return nil
+	}
+	st.bodyClosed = true
+	increment := sc.consumed(int64(st.body.Len()))
+	st.body.Reset()
+	sc.cond.Broadcast()
+	go sc.writeWindowUpdate(0, increment)
+	return nil
+}
+
+// responseWriter is the http.ResponseWriter of a stream. The response
+// header is sent with the first DATA frame, or with END_STREAM if there is
+// no body.
+type responseWriter struct {
+	st  *serverStream
+	req *http.Request
+
+	// handlerHeader is the header the handler modifies, header its copy
+	// taken by WriteHeader.
+	handlerHeader http.Header
+	header        http.Header
+	status        int
+	sentHeader    bool
+	buf           bytes.Buffer
+	err           error
+}
+
+var (
+	_ http.ResponseWriter = (*responseWriter)(nil)
+	_ http.Flusher        = (*responseWriter)(nil)
+)
+
+func (w *responseWriter) Header() http.Header {
+	return w.handlerHeader
+}
+
+// WriteHeader sends informational responses at once, and records the
+// final one.
+func (w *responseWriter) WriteHeader(status int) {
+	if status < 100 || status > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", status))
+	}
+	if w.status != 0 {
+		return
+	}
+	if status < 200 && status != http.StatusSwitchingProtocols {
+		if w.err == nil {
+			w.err = w.writeHeaders(status, w.handlerHeader, false)
+		}
+		return
+	}
+	w.status = status
+	w.header = w.handlerHeader.Clone()
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowed(w.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.req.Method == http.MethodHead {
+		return len(p), nil
+	}
+	w.buf.Write(p)
+	if w.buf.Len() >= responseBufferSize {
+		if err := w.flush(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *responseWriter) Flush() {
+	w.FlushError()
+}
+
+// FlushError sends the header and the buffered body, for
+// http.ResponseController.
+func (w *responseWriter) FlushError() error {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.flush(false)
+}
+
+// flush sends the header if it was not yet, then the buffered body, ending
+// the stream if end is set.
+func (w *responseWriter) flush(end bool) error {
+	if w.err != nil {
+		return w.err
+	}
+	if !w.sentHeader {
+		w.sentHeader = true
+		if _, ok := w.header["Content-Type"]; !ok && w.buf.Len() > 0 && bodyAllowed(w.status) {
+			w.header.Set("Content-Type", http.DetectContentType(w.buf.Bytes()))
+		}
+		headerEnd := end && w.buf.Len() == 0
+		if w.err = w.writeHeaders(w.status, w.header, headerEnd); w.err != nil || headerEnd {
+			return w.err
+		}
+	}
+	if w.buf.Len() > 0 || end {
+		w.err = w.st.writeData(w.buf.Bytes(), end)
+		w.buf.Reset()
+	}
+	return w.err
+}
+
+// finish ends the response once the handler returned.
+func (w *responseWriter) finish() error {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	trailer := w.trailer()
+	if !w.sentHeader && len(trailer) == 0 && bodyAllowed(w.status) && w.header.Get("Content-Length") == "" && w.req.Method != http.MethodHead {
+		w.header.Set("Content-Length", strconv.Itoa(w.buf.Len()))
+	}
+	if len(trailer) == 0 {
+		return w.flush(true)
+	}
+	if err := w.flush(false); err != nil {
+		return err
+	}
+	if w.err = w.st.failed(); w.err != nil {
+		return w.err
+	}
+	w.err = w.st.sc.conn.WriteFrame(Frame{
+		Type:     HeaderFrameType,
+		Flags:    EndHeaderFlag | EndStreamFlag,
+		StreamID: w.st.id,
+		Data:     HeaderFrame{HeaderFields: trailer},
+	})
+	return w.err
+}
+
+// trailer returns the trailer fields: those declared in the Trailer
+// header, and those set with the http.TrailerPrefix.
+func (w *responseWriter) trailer() []HeaderField {
+	trailer := http.Header{}
+	for _, value := range w.header.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := w.handlerHeader[name]; ok {
+				trailer[name] = values
+			}
+		}
+	}
+	for name, values := range w.handlerHeader {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			trailer[strings.TrimPrefix(name, http.TrailerPrefix)] = values
+		}
+	}
+	return headerFields(trailer)
+}
+
+func (w *responseWriter) writeHeaders(status int, header http.Header, end bool) error {
+	if err := w.st.failed(); err != nil {
+		return err
+	}
+	response := NewResponseHeader(status)
+	if _, ok := header["Date"]; !ok && status >= 200 {
+		response.Add("date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	for _, hf := range headerFields(header) {
+		if connectionSpecificFields[hf.name] || strings.HasPrefix(hf.name, strings.ToLower(http.TrailerPrefix)) {
+			continue
+		}
+		response.Fields = append(response.Fields, hf)
+	}
+	flags := EndHeaderFlag
+	if end {
+		flags |= EndStreamFlag
+	}
+	return w.st.sc.conn.WriteFrame(Frame{
+		Type:     HeaderFrameType,
+		Flags:    flags,
+		StreamID: w.st.id,
+		Data:     HeaderFrame{HeaderFields: response.HeaderFields()},
+	})
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTLSServer serves handler over TLS on a local port, returning its
+// URL and a certificate pool trusting it.
+func newTestTLSServer(t *testing.T, srv *Server) (string, *tls.Config) {
+	cert, pool := newTestCertificate(t, "127.0.0.1")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + listener.Addr().String(), &tls.Config{RootCAs: pool}
+}
+
+// newNetHTTPClient returns a net/http client speaking HTTP/2 only.
+func newNetHTTPClient(t *testing.T, tlsConfig *tls.Config) *http.Client {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"h2"}
+	transport := &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+func TestServerNetHTTPClient(t *testing.T) {
+	url, tlsConfig := newTestTLSServer(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/trailers":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Trailer", "X-Length")
+			w.Write(body)
+			w.Header().Set("X-Length", "7")
+			w.Header().Set(http.TrailerPrefix+"X-Request-Trailer", r.Trailer.Get("X-Checksum"))
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("X-Proto", r.Proto)
+			w.Header().Set("X-Cookie", r.Header.Get("Cookie"))
+			io.WriteString(w, "<html>"+r.Method+" "+r.URL.RequestURI()+" "+r.Host)
+		}
+	})})
+	client := newNetHTTPClient(t, tlsConfig)
+
+	req, _ := http.NewRequest("GET", url+"/path?q=1", nil)
+	req.AddCookie(&http.Cookie{Name: "a", Value: "1"})
+	req.AddCookie(&http.Cookie{Name: "b", Value: "2"})
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	host := strings.TrimPrefix(url, "https://")
+	if resp.ProtoMajor != 2 || string(body) != "<html>GET /path?q=1 "+host {
+		t.Errorf("unexpected response %s %q", resp.Proto, body)
+	}
+	if resp.Header.Get("X-Proto") != "HTTP/2.0" || resp.Header.Get("X-Cookie") != "a=1; b=2" {
+		t.Errorf("unexpected header %v", resp.Header)
+	}
+	if resp.Header.Get("Content-Type") != "text/html; charset=utf-8" || resp.ContentLength != int64(len(body)) || resp.Header.Get("Date") == "" {
+		t.Errorf("unexpected header %v", resp.Header)
+	}
+
+	req, _ = http.NewRequest("POST", url+"/trailers", &trailerSetter{Reader: strings.NewReader("payload")})
+	req.Trailer = http.Header{"X-Checksum": nil}
+	req.Body.(*trailerSetter).trailer = req.Trailer
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "payload" || resp.Trailer.Get("X-Length") != "7" || resp.Trailer.Get("X-Request-Trailer") != "42" {
+		t.Errorf("unexpected response %q %v", body, resp.Trailer)
+	}
+
+	resp, err = client.Get(url + "/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204 got %d", resp.StatusCode)
+	}
+}
+
+func TestServerFlush(t *testing.T) {
+	release := make(chan struct{})
+	url, tlsConfig := newTestTLSServer(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second")
+	})})
+	defer close(release)
+	client := newNetHTTPClient(t, tlsConfig)
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The first write arrives before the handler returns.
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first" {
+		t.Errorf("unexpected body %q %v", buf, err)
+	}
+	if resp.ContentLength != -1 {
+		t.Errorf("expected no content-length got %d", resp.ContentLength)
+	}
+}
+
+func TestServerTransportEcho(t *testing.T) {
+	url, tlsConfig := newTestTLSServer(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})})
+	transport := &Transport{TLSClientConfig: tlsConfig}
+	defer transport.CloseIdleConnections()
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<17)
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	received := sha256.New()
+	if _, err := io.Copy(received, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if sent := sha256.Sum256(body); !bytes.Equal(received.Sum(nil), sent[:]) {
+		t.Error("the echoed body differs")
+	}
+}
+
+// newTestServerConn serves a connection with srv, returning the client end
+// which has sent its preface and SETTINGS.
+func newTestServerConn(t *testing.T, srv *Server) *testServer {
+	clientConn, serverConn := net.Pipe()
+	go srv.ServeConn(serverConn)
+	c := &testServer{t: t, conn: NewConn(clientConn), frames: make(chan Frame, 1000)}
+	t.Cleanup(func() { c.conn.Close() })
+	go func() {
+		defer close(c.frames)
+		for {
+			frame, err := c.conn.ReadFrame()
+			if err != nil {
+				return
+			}
+			c.frames <- frame
+		}
+	}()
+	if err := c.conn.WritePreface(); err != nil {
+		t.Fatal(err)
+	}
+	c.write(Frame{Type: SettingFrameType, Data: SettingFrame{}})
+	return c
+}
+
+func testRequestHeader(path string) []HeaderField {
+	return NewRequestHeader("GET", "https", "example.com", path).HeaderFields()
+}
+
+func TestServerRefusedStream(t *testing.T) {
+	release := make(chan struct{})
+	c := newTestServerConn(t, &Server{
+		MaxConcurrentStreams: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}),
+	})
+	settings := c.next(SettingFrameType)
+	if settings.Data.(SettingFrame).Params[SettingsMaxConcurrentStreams] != 1 {
+		t.Errorf("unexpected settings %v", settings.Data)
+	}
+
+	c.writeHeaders(1, EndStreamFlag, testRequestHeader("/"))
+	c.writeHeaders(3, EndStreamFlag, testRequestHeader("/"))
+	frame := c.next(RSTStreamFrameType)
+	if frame.StreamID != 3 || frame.Data.(RSTStreamFrame).ErrorCode != RefusedStream {
+		t.Errorf("expected REFUSED_STREAM on 3 got %v", frame)
+	}
+
+	close(release)
+	frame = c.next(HeaderFrameType)
+	if frame.StreamID != 1 || frame.Flags&EndStreamFlag == UnsetFlag {
+		t.Errorf("unexpected response %v", frame)
+	}
+	// The slot is freed once the handler returned, maybe just after the
+	// response was sent.
+	for id := uint32(5); ; id += 2 {
+		c.writeHeaders(id, EndStreamFlag, testRequestHeader("/"))
+		frame := c.next(HeaderFrameType, RSTStreamFrameType)
+		if frame.Type == HeaderFrameType && frame.StreamID == id {
+			break
+		}
+		if id > 100 {
+			t.Fatalf("unexpected frame %v", frame)
+		}
+	}
+}
+
+func TestServerHandlerPanic(t *testing.T) {
+	var logged bytes.Buffer
+	c := newTestServerConn(t, &Server{
+		ErrorLog: log.New(&logged, "", 0),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/abort" {
+				panic(http.ErrAbortHandler)
+			}
+			panic("boom")
+		}),
+	})
+
+	c.writeHeaders(1, EndStreamFlag, testRequestHeader("/"))
+	frame := c.next(RSTStreamFrameType)
+	if frame.StreamID != 1 || frame.Data.(RSTStreamFrame).ErrorCode != InternalError {
+		t.Errorf("expected INTERNAL_ERROR got %v", frame)
+	}
+	c.writeHeaders(3, EndStreamFlag, testRequestHeader("/abort"))
+	if frame := c.next(RSTStreamFrameType); frame.StreamID != 3 {
+		t.Errorf("unexpected frame %v", frame)
+	}
+
+	// The connection is still usable.
+	c.write(Frame{Type: PingFrameType, Data: PingFrame{Data: [8]byte{7}}})
+	if frame := c.next(PingFrameType); frame.Flags&AckFlag == UnsetFlag {
+		t.Errorf("expected a PING ACK got %v", frame)
+	}
+	if !strings.Contains(logged.String(), "boom") || strings.Count(logged.String(), "panic serving") != 1 {
+		t.Errorf("unexpected log %q", logged.String())
+	}
+}
+
+func TestServerBadPreface(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		(&Server{ErrorLog: log.New(io.Discard, "", 0)}).ServeConn(serverConn)
+		close(done)
+	}()
+	defer clientConn.Close()
+
+	go io.WriteString(clientConn, "PRI * HTTP/2.0\r\n\r\nXX\r\n\r\n")
+	frame, err := NewConn(clientConn).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goAway, ok := frame.Data.(GoAwayFrame); !ok || goAway.ErrorCode != ProtocolError {
+		t.Errorf("expected GOAWAY PROTOCOL_ERROR got %v", frame)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv := &Server{}
+	url, tlsConfig := newTestTLSServer(t, srv)
+	cc, err := DialClientConn(context.Background(), "tcp", strings.TrimPrefix(url, "https://"), tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	srv.Close()
+	if err := srv.Serve(nil); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("expected %s got %v", ErrServerClosed, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); cc.canTakeNewRequest(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still open after Close")
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInadequateSecurity = errors.New("inadequate security")
+)
+
+/*
+HTTP/2 over TLS requires TLS 1.2 or later, without compression or
+renegotiation (RFC 9113 section 9.2). With TLS 1.2, the cipher suites of
+the block list of RFC 7540 Appendix A must not be used: those without
+ephemeral key exchange, and those not using an AEAD cipher.
+
+An endpoint which negotiated anything weaker may close the connection with
+a connection error of type INADEQUATE_SECURITY.
+
+crypto/tls implements neither compression nor renegotiation on the server
+side; clients never renegotiate with RenegotiateNever.
+*/
+
+// allowedCipherSuites are the TLS 1.2 cipher suites of crypto/tls which
+// are not on the block list, by order of preference.
+var allowedCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// blockedCipherSuites are the cipher suites of crypto/tls on the block
+// list. The list has many more, which crypto/tls cannot negotiate.
+var blockedCipherSuites = map[uint16]bool{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                true,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           true,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            true,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            true,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         true,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         true,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         true,
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    true,
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          true,
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     true,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      true,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: true,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   true,
+}
+
+// SecureClientTLSConfig returns a client configuration meeting the TLS
+// requirements of HTTP/2, offering h2 and HTTP/1.1. Certificates are
+// verified against the system roots.
+func SecureClientTLSConfig() *tls.Config {
+	return applyTLSPolicy(&tls.Config{NextProtos: []string{"h2", "http/1.1"}})
+}
+
+// SecureServerTLSConfig returns a server configuration meeting the TLS
+// requirements of HTTP/2, offering h2 with certs.
+func SecureServerTLSConfig(certs ...tls.Certificate) *tls.Config {
+	return applyTLSPolicy(&tls.Config{Certificates: certs, NextProtos: []string{"h2"}})
+}
+
+// applyTLSPolicy returns a copy of config, nil for the defaults, with TLS
+// 1.2 at least, without the blocked cipher suites and renegotiation.
+func applyTLSPolicy(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if config.CipherSuites == nil {
+		config.CipherSuites = append([]uint16(nil), allowedCipherSuites...)
+	} else {
+		suites := []uint16{}
+		for _, suite := range config.CipherSuites {
+			if !blockedCipherSuites[suite] {
+				suites = append(suites, suite)
+			}
+		}
+		config.CipherSuites = suites
+	}
+	config.Renegotiation = tls.RenegotiateNever
+	return config
+}
+
+// checkTLSPolicy returns an error wrapping ErrInadequateSecurity if state
+// does not meet the TLS requirements of HTTP/2.
+func checkTLSPolicy(state tls.ConnectionState) error {
+	if state.Version < tls.VersionTLS12 {
+		return fmt.Errorf("%w: TLS version %#04x", ErrInadequateSecurity, state.Version)
+	}
+	if state.Version == tls.VersionTLS12 && blockedCipherSuites[state.CipherSuite] {
+		return fmt.Errorf("%w: cipher suite %s", ErrInadequateSecurity, tls.CipherSuiteName(state.CipherSuite))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+)
+
+func TestApplyTLSPolicy(t *testing.T) {
+	config := applyTLSPolicy(&tls.Config{
+		MinVersion: tls.VersionTLS10,
+		CipherSuites: []uint16{
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		},
+		Renegotiation: tls.RenegotiateFreelyAsClient,
+	})
+	if config.MinVersion != tls.VersionTLS12 || config.Renegotiation != tls.RenegotiateNever {
+		t.Errorf("unexpected config %v", config)
+	}
+	if expected := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}; !reflect.DeepEqual(config.CipherSuites, expected) {
+		t.Errorf("expected %v got %v", expected, config.CipherSuites)
+	}
+
+	config = SecureClientTLSConfig()
+	if config.InsecureSkipVerify || config.MinVersion != tls.VersionTLS12 || !reflect.DeepEqual(config.CipherSuites, allowedCipherSuites) {
+		t.Errorf("unexpected default config %v", config)
+	}
+}
+
+func TestCheckTLSPolicy(t *testing.T) {
+	tests := []struct {
+		state tls.ConnectionState
+		ok    bool
+	}{
+		{tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}, true},
+		{tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, true},
+		{tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_RSA_WITH_AES_128_GCM_SHA256}, false},
+		{tls.ConnectionState{Version: tls.VersionTLS11, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, false},
+	}
+	for _, test := range tests {
+		err := checkTLSPolicy(test.state)
+		if (err == nil) != test.ok || (err != nil && !errors.Is(err, ErrInadequateSecurity)) {
+			t.Errorf("%s: unexpected error %v", tls.CipherSuiteName(test.state.CipherSuite), err)
+		}
+	}
+}
+
+func TestServerInadequateSecurity(t *testing.T) {
+	// A listener configured outside of the Server may allow anything.
+	cert, pool := newTestCertificate(t, "127.0.0.1")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{ErrorLog: log.New(io.Discard, "", 0)}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	// Our client refuses the cipher suite.
+	if _, err := DialClientConn(context.Background(), "tcp", listener.Addr().String(), &tls.Config{RootCAs: pool}, nil); err == nil {
+		t.Error("expected the handshake to fail")
+	}
+
+	// The server refuses a client which allows it.
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		RootCAs:      pool,
+		NextProtos:   []string{"h2"},
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewConn(conn)
+	if err := c.WritePreface(); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := c.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goAway, ok := frame.Data.(GoAwayFrame); !ok || goAway.ErrorCode != InadequateSecurity {
+		t.Errorf("expected GOAWAY INADEQUATE_SECURITY got %v", frame)
+	}
+}
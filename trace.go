@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceFormat uint8
+
+const (
+	// TraceText logs frames the way h2dump prints them.
+	TraceText TraceFormat = iota
+	// TraceJSON logs one JSON object per frame.
+	TraceJSON
+)
+
+// defaultTraceDataLimit is how many octets of DATA a trace shows.
+const defaultTraceDataLimit = 64
+
+// FrameTracer logs the frames of a connection, with decoded header lists
+// and truncated DATA. It can be shared by several connections.
+type FrameTracer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format TraceFormat
+	// DataLimit is the number of DATA octets logged per frame, -1 for
+	// all of them.
+	DataLimit int
+	// now is replaced by tests.
+	now func() time.Time
+}
+
+func NewFrameTracer(w io.Writer, format TraceFormat) *FrameTracer {
+	return &FrameTracer{
+		w:         w,
+		format:    format,
+		DataLimit: defaultTraceDataLimit,
+		now:       time.Now,
+	}
+}
+
+// ParseTraceFormat returns the format called name, "text" or "json".
+func ParseTraceFormat(name string) (TraceFormat, error) {
+	switch name {
+	case "text":
+		return TraceText, nil
+	case "json":
+		return TraceJSON, nil
+	}
+	return 0, fmt.Errorf("unknown trace format %q", name)
+}
+
+type traceHeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type tracePriority struct {
+	Exclusive        bool   `json:"exclusive"`
+	StreamDependency uint32 `json:"stream_dependency"`
+	Weight           uint8  `json:"weight"`
+}
+
+// traceFrame is the JSON form of a frame, only the fields relevant to its
+// type are set.
+type traceFrame struct {
+	Type     string   `json:"type"`
+	Flags    []string `json:"flags"`
+	StreamID uint32   `json:"stream_id"`
+	Length   uint32   `json:"length"`
+
+	Headers          []traceHeaderField `json:"headers,omitempty"`
+	Priority         *tracePriority     `json:"priority,omitempty"`
+	Data             *string            `json:"data,omitempty"`
+	DataTruncated    bool               `json:"data_truncated,omitempty"`
+	Settings         map[string]uint32  `json:"settings,omitempty"`
+	ErrorCode        string             `json:"error_code,omitempty"`
+	LastStreamID     *uint32            `json:"last_stream_id,omitempty"`
+	PromisedStreamID uint32             `json:"promised_stream_id,omitempty"`
+	Increment        uint32             `json:"increment,omitempty"`
+	Opaque           string             `json:"opaque_data,omitempty"`
+	Origins          []string           `json:"origins,omitempty"`
+}
+
+type frameTraceEvent struct {
+	Time      string `json:"time"`
+	Direction string `json:"direction"`
+	traceFrame
+}
+
+// TraceFrame logs a frame sent, or received if sent is false.
+func (t *FrameTracer) TraceFrame(sent bool, frame Frame) {
+	direction := "recv"
+	if sent {
+		direction = "send"
+	}
+
+	buf := bytes.Buffer{}
+	switch t.format {
+	case TraceJSON:
+		json.NewEncoder(&buf).Encode(t.event(direction, frame))
+	default:
+		fmt.Fprintf(&buf, "%s %s ", t.now().Format("15:04:05.000000"), direction)
+		printFrame(&buf, frame, t.DataLimit)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.w.Write(buf.Bytes())
+}
+
+func (t *FrameTracer) event(direction string, frame Frame) frameTraceEvent {
+	return frameTraceEvent{
+		Time:       t.now().UTC().Format(time.RFC3339Nano),
+		Direction:  direction,
+		traceFrame: newTraceFrame(frame, t.DataLimit),
+	}
+}
+
+// newTraceFrame converts frame, keeping at most dataLimit octets of data
+// unless it is negative.
+func newTraceFrame(frame Frame, dataLimit int) traceFrame {
+	event := traceFrame{
+		Type:     frame.Type.String(),
+		Flags:    frame.FlagNames(),
+		StreamID: frame.StreamID,
+		Length:   frame.Length,
+	}
+	addHeaders := func(headerFields []HeaderField) {
+		for _, hf := range headerFields {
+			event.Headers = append(event.Headers, traceHeaderField{Name: hf.name, Value: hf.value})
+		}
+	}
+	addData := func(b []byte) {
+		if dataLimit >= 0 && len(b) > dataLimit {
+			b = b[:dataLimit]
+			event.DataTruncated = true
+		}
+		s := strings.ToValidUTF8(string(b), "�")
+		event.Data = &s
+	}
+	switch payload := frame.Data.(type) {
+	case DataFrame:
+		addData(payload.Data)
+	case HeaderFrame:
+		if frame.Flags&PriorityFlag != UnsetFlag {
+			event.Priority = &tracePriority{payload.Exclusive, payload.StreamDependency, payload.Weight}
+		}
+		addHeaders(payload.HeaderFields)
+	case PriorityFrame:
+		event.Priority = &tracePriority{payload.Exclusive, payload.StreamDependency, payload.Weight}
+	case RSTStreamFrame:
+		event.ErrorCode = payload.ErrorCode.String()
+	case SettingFrame:
+		event.Settings = map[string]uint32{}
+		for param, value := range payload.Params {
+			event.Settings[param.String()] = value
+		}
+	case PushPromiseFrame:
+		event.PromisedStreamID = payload.PromisedStreamID
+		addHeaders(payload.HeaderFields)
+	case PingFrame:
+		event.Opaque = hex.EncodeToString(payload.Data[:])
+	case GoAwayFrame:
+		event.LastStreamID = &payload.LastStreamID
+		event.ErrorCode = payload.ErrorCode.String()
+		if len(payload.DebugData) > 0 {
+			addData(payload.DebugData)
+		}
+	case WindowUpdateFrame:
+		event.Increment = payload.WindowSizeIncrement
+	case OriginFrame:
+		event.Origins = payload.Origins
+	case UnknownFrame:
+		addData(payload.Payload)
+	}
+	return event
+}
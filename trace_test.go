@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tracedExchange sends a request over a pipe with both ends traced.
+func tracedExchange(t *testing.T, format TraceFormat) string {
+	t.Helper()
+	out := bytes.Buffer{}
+	tracer := NewFrameTracer(&out, format)
+	tracer.DataLimit = 8
+	tracer.now = func() time.Time { return time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC) }
+
+	clientConn, serverConn := net.Pipe()
+	client, server := NewConn(clientConn), NewConn(serverConn)
+	defer client.Close()
+	defer server.Close()
+	client.SetFrameTracer(tracer)
+
+	frames := []Frame{
+		{Type: HeaderFrameType, StreamID: 1, Flags: EndHeaderFlag, Data: HeaderFrame{
+			HeaderFields: NewRequestHeader("POST", "https", "example.com", "/").HeaderFields(),
+		}},
+		{Type: DataFrameType, StreamID: 1, Flags: EndStreamFlag, Data: DataFrame{Data: []byte("hello, world")}},
+	}
+	go func() {
+		for _, frame := range frames {
+			if err := server.WriteFrame(frame); err != nil {
+				return
+			}
+		}
+	}()
+	for range frames {
+		if _, err := client.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go server.ReadFrame()
+	if err := client.WriteFrame(Frame{Type: RSTStreamFrameType, StreamID: 1, Data: RSTStreamFrame{ErrorCode: Cancel}}); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestFrameTraceText(t *testing.T) {
+	expected := `12:00:00.000000 recv HEADERS flags=END_HEADERS stream=1 length=13
+    :method: POST
+    :scheme: https
+    :authority: example.com
+    :path: /
+12:00:00.000000 recv DATA flags=END_STREAM stream=1 length=12
+    "hello, w"... (4 more octets)
+12:00:00.000000 send RST_STREAM flags=- stream=1 length=4
+    error=CANCEL
+`
+	if out := tracedExchange(t, TraceText); out != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestFrameTraceJSON(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(tracedExchange(t, TraceJSON), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 events got %d", len(lines))
+	}
+
+	events := make([]map[string]any, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &events[i]); err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+	}
+	headers := events[0]["headers"].([]any)
+	if len(headers) != 4 || headers[2].(map[string]any)["value"] != "example.com" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+	if events[1]["data"] != "hello, w" || events[1]["data_truncated"] != true {
+		t.Errorf("expected truncated DATA got %s", lines[1])
+	}
+	expected := `{"time":"2026-10-18T12:00:00Z","direction":"send","type":"RST_STREAM","flags":[],"stream_id":1,"length":4,"error_code":"CANCEL"}`
+	if lines[2] != expected {
+		t.Errorf("expected %s got %s", expected, lines[2])
+	}
+}
+
+func TestParseTraceFormat(t *testing.T) {
+	if format, err := ParseTraceFormat("json"); err != nil || format != TraceJSON {
+		t.Errorf("expected json got %v, %v", format, err)
+	}
+	if _, err := ParseTraceFormat("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
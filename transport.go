@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+	ErrUnsupportedScheme     = errors.New("unsupported protocol scheme")
+)
+
+// defaultUserAgent is sent when a request has no User-Agent.
+const defaultUserAgent = "go/h2"
+
+const (
+	defaultMaxRetries   = 2
+	defaultRetryBackoff = 10 * time.Millisecond
+	maxRetryBackoff     = time.Second
+)
+
+// errUseHTTP1 reports that a server negotiated HTTP/1.1 with ALPN.
+var errUseHTTP1 = errors.New("server negotiated http/1.1")
+
+// Transport is an http.RoundTripper sending requests over HTTP/2, sharing
+// connections by authority between concurrent requests, and dialing more
+// when MAX_CONCURRENT_STREAMS is reached. Servers which
+// negotiate HTTP/1.1 with ALPN are sent requests over HTTP/1.1, which the
+// Proto of their responses tells. Requests the server did not process are
+// sent again on another connection.
+type Transport struct {
+	// TLSClientConfig configures the TLS connections, nil for the
+	// defaults. Its NextProtos, {"h2", "http/1.1"} if nil, decide whether
+	// HTTP/1.1 is offered.
+	TLSClientConfig *tls.Config
+	// ConnConfig configures the HTTP/2 connections, nil for the defaults.
+	ConnConfig *ClientConnConfig
+	// ResponseHeaderTimeout, if non-zero, bounds the time to wait for the
+	// response header once the request header is written.
+	ResponseHeaderTimeout time.Duration
+	// AllowHTTP permits http URLs, sent over cleartext h2c with prior
+	// knowledge.
+	AllowHTTP bool
+	// IdleConnTimeout, if non-zero, closes the connections which have had
+	// no stream for that long, unless ConnConfig sets an IdleTimeout.
+	IdleConnTimeout time.Duration
+	// MaxRetries bounds how many times a request the server did not
+	// process, refusing its stream or sending GOAWAY before it, is sent
+	// again on another connection: 2 if zero, never if negative. Requests
+	// with a body are retried only if GetBody is set.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubled for each
+	// next one up to a second: 10ms if zero, none if negative.
+	RetryBackoff time.Duration
+
+	poolOnce sync.Once
+	pool     clientConnPool
+
+	mu sync.Mutex
+	// http1 sends the requests to the authorities in http1Addrs. Its
+	// first connection to each is the one which negotiated HTTP/1.1, kept
+	// in http1Conns until it dials.
+	http1      *http.Transport
+	http1Addrs map[string]bool
+	http1Conns map[string][]net.Conn
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// RoundTrip implements http.RoundTripper. The request body is sent as it
+// is read, and the response body is read as it arrives.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The body is closed by the connection once the request is sent on
+	// it, before by us.
+	closeBody := func() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+	}
+	if req.URL == nil {
+		closeBody()
+		return nil, errors.New("nil request URL")
+	}
+	if req.URL.Scheme != "https" && (req.URL.Scheme != "http" || !t.AllowHTTP) {
+		closeBody()
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedScheme, req.URL.Scheme)
+	}
+	header, err := requestHeader(req)
+	if err != nil {
+		closeBody()
+		return nil, err
+	}
+
+	addr := authorityAddr(req.URL)
+	if req.URL.Scheme == "https" && t.usesHTTP1(addr) {
+		return t.http1Transport().RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var timer *time.Timer
+	var timedOut atomic.Bool
+	if t.ResponseHeaderTimeout > 0 {
+		ctx = WithClientTrace(ctx, &ClientTrace{
+			WroteHeaders: func(WroteHeadersInfo) {
+				timer = time.AfterFunc(t.ResponseHeaderTimeout, func() {
+					timedOut.Store(true)
+					cancel()
+				})
+			},
+		})
+	}
+
+	// A request the server did not process is sent again on another
+	// connection, within the retry budget. A request misdirected to a
+	// connection shared with another authority is sent again once on a
+	// fresh connection.
+	body := req.Body
+	var avoid *ClientConn
+	misdirected := false
+	for retries := 0; ; {
+		cc, err := t.conn(ctx, req.URL.Scheme, addr, avoid)
+		if errors.Is(err, errUseHTTP1) {
+			cancel()
+			if body != req.Body {
+				r := *req
+				r.Body = body
+				req = &r
+			}
+			return t.http1Transport().RoundTrip(req)
+		}
+		if err != nil {
+			cancel()
+			if body != nil {
+				body.Close()
+			}
+			return nil, err
+		}
+		clientReq := &ClientRequest{Header: header}
+		if body != nil && body != http.NoBody {
+			clientReq.Body = &requestBody{ReadCloser: body, req: req, clientReq: clientReq}
+		}
+		clientResp, err := cc.roundTrip(ctx, clientReq, true)
+		if timer != nil && !timer.Stop() && err == nil {
+			// The timer fired while the response was returned.
+			clientResp.Body.Close()
+			err = ErrResponseHeaderTimeout
+		}
+		if err != nil && canRetry(err) && retries < t.maxRetries() {
+			if rewound, rewindErr := rewindBody(req); rewindErr == nil {
+				retries++
+				if waitErr := sleepContext(ctx, t.retryBackoff(retries)); waitErr != nil {
+					if rewound != nil {
+						rewound.Close()
+					}
+					cancel()
+					return nil, err
+				}
+				body, avoid = rewound, cc
+				continue
+			}
+		}
+		if err != nil {
+			cancel()
+			if timedOut.Load() {
+				return nil, ErrResponseHeaderTimeout
+			}
+			return nil, err
+		}
+		if clientResp.Header.Status == http.StatusMisdirectedRequest && !misdirected {
+			if body, err = rewindBody(req); err == nil {
+				misdirected = true
+				clientResp.Body.Close()
+				t.pool.misdirected(req.URL.Scheme+"://"+addr, cc)
+				avoid = nil
+				continue
+			}
+		}
+		return newResponse(req, cc, clientResp, cancel), nil
+	}
+}
+
+// canRetry reports whether err tells that the server did not process the
+// request, refusing its stream or going away before it, so that it can be
+// sent again (RFC 9113 section 8.7).
+func canRetry(err error) bool {
+	var streamErr StreamError
+	if errors.As(err, &streamErr) {
+		return streamErr.Remote && streamErr.Code == RefusedStream
+	}
+	var goAwayErr GoAwayError
+	return errors.As(err, &goAwayErr)
+}
+
+// maxRetries returns the retry budget of a request.
+func (t *Transport) maxRetries() int {
+	if t.MaxRetries == 0 {
+		return defaultMaxRetries
+	}
+	return t.MaxRetries
+}
+
+// retryBackoff returns the wait before retry n, from 1: RetryBackoff,
+// doubled for every retry before, up to maxRetryBackoff.
+func (t *Transport) retryBackoff(n int) time.Duration {
+	backoff := t.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	for ; n > 1 && backoff > 0 && backoff < maxRetryBackoff; n-- {
+		backoff *= 2
+	}
+	return backoff
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rewindBody returns the body of req to send it again, an error if it
+// cannot be read again.
+func rewindBody(req *http.Request) (io.ReadCloser, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req.Body, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be rewound without GetBody")
+	}
+	return req.GetBody()
+}
+
+// conn returns a connection to addr other than avoid, which may be nil,
+// with a stream reserved for the request, dialing one if none can take
+// it.
+func (t *Transport) conn(ctx context.Context, scheme, addr string, avoid *ClientConn) (*ClientConn, error) {
+	t.poolOnce.Do(func() { t.pool.dial = t.dial })
+	return t.pool.get(ctx, scheme+"://"+addr, avoid)
+}
+
+// dial connects to the authority of a pool key.
+func (t *Transport) dial(ctx context.Context, key string) (*ClientConn, error) {
+	scheme, addr, _ := strings.Cut(key, "://")
+	if scheme == "http" {
+		return DialClientConnH2C(ctx, "tcp", addr, t.connConfig())
+	}
+	return t.dialTLS(ctx, addr)
+}
+
+// connConfig returns ConnConfig, with the IdleConnTimeout.
+func (t *Transport) connConfig() *ClientConnConfig {
+	config := &ClientConnConfig{}
+	if t.ConnConfig != nil {
+		*config = *t.ConnConfig
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = t.IdleConnTimeout
+	}
+	return config
+}
+
+// tlsConfig returns the TLS configuration offering h2 and HTTP/1.1,
+// unless TLSClientConfig lists other NextProtos, under the TLS policy of
+// HTTP/2.
+func (t *Transport) tlsConfig() *tls.Config {
+	config := applyTLSPolicy(t.TLSClientConfig)
+	if config.NextProtos == nil {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return config
+}
+
+// dialTLS connects to addr, returning errUseHTTP1 if the server
+// negotiates HTTP/1.1, or no protocol, while we offered it.
+func (t *Transport) dialTLS(ctx context.Context, addr string) (*ClientConn, error) {
+	config := t.tlsConfig()
+	tlsConn, err := dialTLS(ctx, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	switch protocol := tlsConn.ConnectionState().NegotiatedProtocol; {
+	case protocol == "h2":
+	case (protocol == "" || protocol == "http/1.1") && containsString(config.NextProtos, "http/1.1"):
+		t.mu.Lock()
+		if t.http1Addrs == nil {
+			t.http1Addrs = map[string]bool{}
+			t.http1Conns = map[string][]net.Conn{}
+		}
+		t.http1Addrs[addr] = true
+		t.http1Conns[addr] = append(t.http1Conns[addr], tlsConn)
+		t.mu.Unlock()
+		return nil, errUseHTTP1
+	default:
+		tlsConn.Close()
+		return nil, fmt.Errorf("%w: got %q", ErrH2NotNegotiated, protocol)
+	}
+
+	cc, err := NewClientConn(tlsConn, t.connConfig())
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// usesHTTP1 reports whether the server at addr negotiated HTTP/1.1.
+func (t *Transport) usesHTTP1(addr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.http1Addrs[addr]
+}
+
+// http1Transport returns the transport sending requests over HTTP/1.1.
+func (t *Transport) http1Transport() *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.http1 == nil {
+		config := t.tlsConfig()
+		config.NextProtos = []string{"http/1.1"}
+		t.http1 = &http.Transport{
+			TLSClientConfig:       config,
+			DialTLSContext:        t.dialHTTP1,
+			ResponseHeaderTimeout: t.ResponseHeaderTimeout,
+		}
+	}
+	return t.http1
+}
+
+// dialHTTP1 returns the connection which negotiated HTTP/1.1 with addr, or
+// dials a new one.
+func (t *Transport) dialHTTP1(ctx context.Context, network, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	if conns := t.http1Conns[addr]; len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		t.http1Conns[addr] = conns[:len(conns)-1]
+		t.mu.Unlock()
+		return conn, nil
+	}
+	config := t.http1.TLSClientConfig
+	t.mu.Unlock()
+	return dialTLS(ctx, network, addr, config)
+}
+
+// CloseIdleConnections closes the connections without requests in flight.
+func (t *Transport) CloseIdleConnections() {
+	t.pool.closeIdle()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, conns := range t.http1Conns {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(t.http1Conns, addr)
+	}
+	if t.http1 != nil {
+		t.http1.CloseIdleConnections()
+	}
+}
+
+// authorityAddr returns the host:port to dial for u.
+func authorityAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// requestHeader converts the header of req to its HTTP/2 form, with
+// lowercase field names and without connection-specific fields.
+func requestHeader(req *http.Request) (*RequestHeader, error) {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if host == "" {
+		return nil, errors.New("request without host")
+	}
+	header := NewRequestHeader(method, req.URL.Scheme, host, req.URL.RequestURI())
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if lower == "host" || connectionSpecificFields[lower] {
+			continue
+		}
+		for _, value := range req.Header[name] {
+			if lower == "te" && value != "trailers" {
+				continue
+			}
+			if strings.ContainsAny(value, "\r\n\x00") {
+				return nil, fmt.Errorf("%w: invalid value for %s", ErrMalformedHeader, lower)
+			}
+			header.Add(lower, value)
+		}
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		header.Add("user-agent", defaultUserAgent)
+	}
+	if len(req.Trailer) > 0 {
+		trailers := make([]string, 0, len(req.Trailer))
+		for name := range req.Trailer {
+			trailers = append(trailers, strings.ToLower(name))
+		}
+		sort.Strings(trailers)
+		header.Add("trailer", strings.Join(trailers, ", "))
+	}
+	if req.ContentLength > 0 {
+		header.Add("content-length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	return header, nil
+}
+
+// requestBody sets the request trailers once the body is read, as callers
+// may fill in http.Request.Trailer while the body is sent.
+type requestBody struct {
+	io.ReadCloser
+	req       *http.Request
+	clientReq *ClientRequest
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.clientReq.Trailer = headerFields(b.req.Trailer)
+	}
+	return n, err
+}
+
+// headerFields converts h to a header list with lowercase names.
+func headerFields(h http.Header) []HeaderField {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := []HeaderField{}
+	for _, name := range names {
+		for _, value := range h[name] {
+			fields = append(fields, NewHeaderField(strings.ToLower(name), value))
+		}
+	}
+	return fields
+}
+
+func newResponse(req *http.Request, cc *ClientConn, clientResp *ClientResponse, cancel context.CancelFunc) *http.Response {
+	status := clientResp.Header.Status
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        http.Header{},
+		ContentLength: -1,
+		Request:       req,
+	}
+	for _, hf := range clientResp.Header.Fields {
+		resp.Header.Add(hf.Name(), hf.Value())
+	}
+	if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = n
+	}
+	// Declared trailers are listed with no values until the body is read.
+	for _, value := range resp.Header.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if resp.Trailer == nil {
+					resp.Trailer = http.Header{}
+				}
+				resp.Trailer[http.CanonicalHeaderKey(name)] = nil
+			}
+		}
+	}
+	if state, ok := cc.ConnectionState(); ok {
+		resp.TLS = &state
+	}
+	resp.Body = &responseBody{resp: resp, clientResp: clientResp, cancel: cancel}
+	return resp
+}
+
+// responseBody fills in the response trailers at the end of the body and
+// releases the request context once closed.
+type responseBody struct {
+	resp       *http.Response
+	clientResp *ClientResponse
+	cancel     context.CancelFunc
+	eof        bool
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.clientResp.Body.Read(p)
+	if err == io.EOF && !b.eof {
+		b.eof = true
+		for _, hf := range b.clientResp.Trailer() {
+			if b.resp.Trailer == nil {
+				b.resp.Trailer = http.Header{}
+			}
+			b.resp.Trailer.Add(hf.Name(), hf.Value())
+		}
+	}
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	err := b.clientResp.Body.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestTransport returns an HTTP/2 server backed by net/http and a
+// Transport trusting it.
+func newTestTransport(t *testing.T, handler http.Handler) (*httptest.Server, *Transport) {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	transport := &Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	t.Cleanup(transport.CloseIdleConnections)
+	return srv, transport
+}
+
+func TestTransportGet(t *testing.T) {
+	srv, transport := newTestTransport(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.Header().Set("X-Agent", r.UserAgent())
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), r.Header.Get("X-Custom"))
+	}))
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", srv.URL+"/path?q=1", nil)
+		req.Header.Set("X-Custom", "value")
+		req.Header.Set("Connection", "keep-alive")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || resp.Proto != "HTTP/2.0" || resp.TLS == nil {
+			t.Errorf("unexpected response %v", resp)
+		}
+		if resp.Header.Get("X-Proto") != "HTTP/2.0" || resp.Header.Get("X-Agent") != defaultUserAgent {
+			t.Errorf("unexpected header %v", resp.Header)
+		}
+		if string(body) != "GET /path?q=1 value" {
+			t.Errorf("unexpected body %q", body)
+		}
+	}
+	if n := len(transport.pool.conns["https://"+srv.Listener.Addr().String()]); n != 1 {
+		t.Errorf("expected a single connection got %d", n)
+	}
+}
+
+func TestTransportStreamsBodies(t *testing.T) {
+	srv, transport := newTestTransport(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Echo the body as it arrives, well beyond the initial windows.
+		io.Copy(w, r.Body)
+	}))
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	req, _ := http.NewRequest("POST", srv.URL, io.NopCloser(bytes.NewReader(body)))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	received := sha256.New()
+	if _, err := io.Copy(received, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if sent := sha256.Sum256(body); !bytes.Equal(received.Sum(nil), sent[:]) {
+		t.Error("the echoed body differs")
+	}
+}
+
+func TestTransportTrailers(t *testing.T) {
+	srv, transport := newTestTransport(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Trailer", "X-Echo")
+		w.WriteHeader(200)
+		io.WriteString(w, "body")
+		w.Header().Set("X-Echo", r.Trailer.Get("X-Checksum"))
+		w.Header().Set(http.TrailerPrefix+"X-Undeclared", "late")
+	}))
+
+	req, _ := http.NewRequest("PUT", srv.URL, strings.NewReader("payload"))
+	req.Trailer = http.Header{"X-Checksum": nil}
+	req.Body = &trailerSetter{Reader: strings.NewReader("payload"), trailer: req.Trailer}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, ok := resp.Trailer["X-Echo"]; !ok {
+		t.Errorf("expected the declared trailer got %v", resp.Trailer)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Trailer.Get("X-Echo") != "42" || resp.Trailer.Get("X-Undeclared") != "late" {
+		t.Errorf("unexpected trailer %v", resp.Trailer)
+	}
+}
+
+// trailerSetter fills in a request trailer once its body is read.
+type trailerSetter struct {
+	io.Reader
+	trailer http.Header
+}
+
+func (r *trailerSetter) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.trailer.Set("X-Checksum", "42")
+	}
+	return n, err
+}
+
+func (r *trailerSetter) Close() error {
+	return nil
+}
+
+func TestTransportCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv, transport := newTestTransport(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %s got %v", context.Canceled, err)
+	}
+}
+
+func TestTransportResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv, transport := newTestTransport(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer close(release)
+	transport.ResponseHeaderTimeout = 20 * time.Millisecond
+
+	req, _ := http.NewRequest("GET", srv.URL+"/slow", nil)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, ErrResponseHeaderTimeout) {
+		t.Errorf("expected %s got %v", ErrResponseHeaderTimeout, err)
+	}
+
+	// The timeout no longer applies once the response header arrived.
+	req, _ = http.NewRequest("GET", srv.URL+"/fast", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "ok" {
+		t.Errorf("unexpected body %q %v", body, err)
+	}
+}
+
+func TestTransportUnsupportedScheme(t *testing.T) {
+	for _, url := range []string{"ftp://example.com/", "http://example.com/"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if _, err := (&Transport{}).RoundTrip(req); !errors.Is(err, ErrUnsupportedScheme) {
+			t.Errorf("%s: expected %s got %v", url, ErrUnsupportedScheme, err)
+		}
+	}
+}
+
+func TestTransportHTTP1Fallback(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	transport := &Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	defer transport.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.Proto != "HTTP/1.1" || string(body) != "HTTP/1.1" {
+			t.Errorf("unexpected response %s %q %v", resp.Proto, body, err)
+		}
+		if resp.TLS == nil || resp.TLS.NegotiatedProtocol != "http/1.1" {
+			t.Errorf("unexpected TLS state %v", resp.TLS)
+		}
+	}
+	// The connection which negotiated HTTP/1.1 carries the requests.
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expected a single connection got %d", n)
+	}
+}
+
+// newScriptedTransport returns a Transport whose connections are served by
+// the test servers sent on the channel, one per dial.
+func newScriptedTransport(t *testing.T, transport *Transport) <-chan *testServer {
+	servers := make(chan *testServer, 10)
+	transport.poolOnce.Do(func() {})
+	transport.pool.dial = func(ctx context.Context, key string) (*ClientConn, error) {
+		cc, s := newTestClientConn(t, nil)
+		servers <- s
+		return cc, nil
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return servers
+}
+
+// readBody reads the DATA frames of a request up to END_STREAM.
+func (s *testServer) readBody(streamID uint32) string {
+	s.t.Helper()
+	body := ""
+	for {
+		frame := s.next(DataFrameType)
+		if frame.StreamID != streamID {
+			continue
+		}
+		body += string(frame.Data.(DataFrame).Data)
+		if frame.Flags&EndStreamFlag != UnsetFlag {
+			return body
+		}
+	}
+}
+
+func TestTransportRetry(t *testing.T) {
+	transport := &Transport{RetryBackoff: -1}
+	servers := newScriptedTransport(t, transport)
+	post := func() <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			req, _ := http.NewRequest("POST", "https://example.com/", strings.NewReader("payload"))
+			resp, err := transport.RoundTrip(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			errs <- err
+		}()
+		return errs
+	}
+	ok := []HeaderField{{name: ":status", value: "200"}}
+
+	// A refused stream is sent again on another connection.
+	errs := post()
+	first := <-servers
+	frame := first.next(HeaderFrameType)
+	first.write(Frame{Type: RSTStreamFrameType, StreamID: frame.StreamID, Data: RSTStreamFrame{ErrorCode: RefusedStream}})
+	second := <-servers
+	frame = second.next(HeaderFrameType)
+	if body := second.readBody(frame.StreamID); body != "payload" {
+		t.Errorf("unexpected body %q", body)
+	}
+	second.writeHeaders(frame.StreamID, EndStreamFlag, ok)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// So is a request beyond the last stream of GOAWAY.
+	errs = post()
+	frame = first.next(HeaderFrameType)
+	first.write(Frame{Type: GoAwayFrameType, Data: GoAwayFrame{LastStreamID: 0, ErrorCode: NoError}})
+	frame = second.next(HeaderFrameType)
+	if body := second.readBody(frame.StreamID); body != "payload" {
+		t.Errorf("unexpected body %q", body)
+	}
+	second.writeHeaders(frame.StreamID, EndStreamFlag, ok)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransportRetryExhausted(t *testing.T) {
+	transport := &Transport{MaxRetries: 1, RetryBackoff: -1}
+	servers := newScriptedTransport(t, transport)
+	refuse := func(s *testServer) {
+		frame := s.next(HeaderFrameType)
+		s.write(Frame{Type: RSTStreamFrameType, StreamID: frame.StreamID, Data: RSTStreamFrame{ErrorCode: RefusedStream}})
+	}
+	expectRefused := func(err error) {
+		t.Helper()
+		var streamErr StreamError
+		if !errors.As(err, &streamErr) || streamErr.Code != RefusedStream {
+			t.Errorf("expected REFUSED_STREAM got %v", err)
+		}
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		_, err := transport.RoundTrip(req)
+		errs <- err
+	}()
+	first := <-servers
+	refuse(first)
+	refuse(<-servers)
+	expectRefused(<-errs)
+
+	// A body which cannot be rewound is not sent again.
+	go func() {
+		req, _ := http.NewRequest("POST", "https://example.com/", io.NopCloser(strings.NewReader("payload")))
+		_, err := transport.RoundTrip(req)
+		errs <- err
+	}()
+	refuse(first)
+	expectRefused(<-errs)
+}